@@ -0,0 +1,160 @@
+package app
+
+import (
+	"github.com/cpacia/ipfsindex/db"
+	"github.com/ipfs/go-cid"
+	"time"
+)
+
+const AddFileCommand Command = 0x01
+
+func init() {
+	RegisterCommand(CommandDef{
+		Command: AddFileCommand,
+		Name:    "AddFile",
+		Parse:   parseAddFile,
+		Handle:  handleAddFile,
+	})
+}
+
+// AddFileScript publishes a file. Version and Unknown are set when parsing
+// and Unknown is serialized after the known data elements.
+type AddFileScript struct {
+	Cid         cid.Cid
+	Description string
+	Category    string
+
+	// Optional metadata describing the file. Size is in bytes and Language
+	// is meant to be an IETF language tag such as "en".
+	Size     uint64
+	MimeType string
+	Filename string
+	Language string
+	License  string
+
+	// Tags classify the file alongside its category. Each tag is pushed as
+	// its own data element.
+	Tags []string
+
+	Version byte
+	Unknown []DataElement
+}
+
+func (as *AddFileScript) Command() Command {
+	return AddFileCommand
+}
+
+func (as *AddFileScript) ID() []byte {
+	return as.Cid.Bytes()
+}
+
+func (as *AddFileScript) Parsed() ParsedScript {
+	return ParsedScript{
+		Version:     as.Version,
+		Description: as.Description,
+		Cid:         as.Cid,
+		Category:    as.Category,
+		Size:        as.Size,
+		MimeType:    as.MimeType,
+		Filename:    as.Filename,
+		Language:    as.Language,
+		License:     as.License,
+		Tags:        as.Tags,
+		Unknown:     as.Unknown,
+	}
+}
+
+// Serialize serializes the script with the current protocol version.
+func (as *AddFileScript) Serialize() ([]byte, error) {
+	builder := newScriptBuilder(AddFileCommand)
+	builder.AddData(append([]byte{byte(Cid)}, as.Cid.Bytes()...))
+	if as.Description != "" {
+		builder.AddData(append([]byte{byte(Description)}, []byte(as.Description)...))
+	}
+	if as.Category != "" {
+		builder.AddData(append([]byte{byte(Category)}, []byte(as.Category)...))
+	}
+	if as.Size > 0 {
+		builder.AddData(append([]byte{byte(Size)}, encodeUint(as.Size)...))
+	}
+	if as.MimeType != "" {
+		builder.AddData(append([]byte{byte(MimeType)}, []byte(as.MimeType)...))
+	}
+	if as.Filename != "" {
+		builder.AddData(append([]byte{byte(Filename)}, []byte(as.Filename)...))
+	}
+	if as.Language != "" {
+		builder.AddData(append([]byte{byte(Language)}, []byte(as.Language)...))
+	}
+	if as.License != "" {
+		builder.AddData(append([]byte{byte(License)}, []byte(as.License)...))
+	}
+	for _, tag := range as.Tags {
+		builder.AddData(append([]byte{byte(Tag)}, []byte(tag)...))
+	}
+	return finishScript(builder, as.Unknown)
+}
+
+func parseAddFile(ps ParsedScript) (Script, error) {
+	return &AddFileScript{
+		Cid:         ps.Cid,
+		Description: ps.Description,
+		Category:    ps.Category,
+		Size:        ps.Size,
+		MimeType:    ps.MimeType,
+		Filename:    ps.Filename,
+		Language:    ps.Language,
+		License:     ps.License,
+		Tags:        ps.Tags,
+		Version:     ps.Version,
+		Unknown:     ps.Unknown,
+	}, nil
+}
+
+// handleAddFile saves and indexes a new file descriptor and records its
+// confirmation or removal from a block.
+func handleAddFile(l *TransactionListener, s ScriptOutput) {
+	as := s.Script.(*AddFileScript)
+	txid := s.Txid.String()
+	ts := time.Now()
+	if s.Tx.Height > 0 {
+		ts = s.Tx.BlockTime
+	}
+	fd := &db.FileDescriptor{}
+	if l.db.Where("txid = ?", txid).First(fd).RecordNotFound() {
+		fd = &db.FileDescriptor{
+			Txid:        txid,
+			Category:    as.Category,
+			Description: as.Description,
+			Timestamp:   ts,
+			Hot:         db.HotScore(0, ts),
+			Height:      confirmedHeight(s.Tx.Height),
+			BlockHash:   l.blockHash(s.Tx.Height),
+			Cid:         as.Cid.String(),
+			Size:        int64(as.Size),
+			MimeType:    as.MimeType,
+			Filename:    as.Filename,
+			Language:    as.Language,
+			License:     as.License,
+			RawScript:   s.Output.ScriptPubKey,
+			Publisher:   l.paidBy(s.Txid),
+		}
+		l.db.Save(fd)
+		if err := l.db.SaveTags(txid, as.Tags); err != nil {
+			log.Errorf("Error saving tags of %s: %s", txid, err)
+		}
+		l.db.Index(txid, *fd)
+		log.Debugf("Received new file descriptor, tx: %s", txid)
+	} else if s.Tx.Height > 0 {
+		fd.Height, fd.Timestamp, fd.BlockHash = uint32(s.Tx.Height), ts, l.blockHash(s.Tx.Height)
+		fd.Hot = db.HotScore(l.db.NetScore(*fd), fd.Timestamp)
+		l.db.Model(fd).Updates(&db.FileDescriptor{Height: fd.Height, Timestamp: fd.Timestamp, BlockHash: fd.BlockHash, Hot: fd.Hot})
+		l.db.Index(txid, *fd)
+		log.Debugf("Updated file descriptor with confirmation, tx: %s", txid)
+	} else if fd.Height > 0 {
+		log.Warningf("File descriptor removed from block %s by reorg, tx: %s", fd.BlockHash, txid)
+		fd.Height, fd.BlockHash = 0, ""
+		l.db.Model(fd).Updates(map[string]interface{}{"height": 0, "block_hash": ""})
+		l.db.Index(txid, *fd)
+	}
+}
@@ -0,0 +1,264 @@
+// Package apptest provides an in-memory wallet for testing code which depends
+// on app.Wallet.
+package apptest
+
+import (
+	"bytes"
+	"errors"
+	"github.com/OpenBazaar/wallet-interface"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/bchutil"
+	"sync"
+	"time"
+)
+
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// FakeWallet is an in-memory implementation of app.Wallet. Transactions passed
+// to Broadcast are recorded rather than relayed and transaction callbacks are
+// only fired when the test calls Notify.
+type FakeWallet struct {
+	FeePerByte   uint64
+	BroadcastErr error
+	Rates        *FakeExchangeRates
+
+	params    *chaincfg.Params
+	keys      map[string]*btcec.PrivateKey
+	current   map[wallet.KeyPurpose]btcutil.Address
+	txns      map[chainhash.Hash]wallet.Txn
+	broadcast []*wire.MsgTx
+	listeners []func(wallet.TransactionCallback)
+	height    uint32
+	tipHash   chainhash.Hash
+	blocks    map[uint32]chainhash.Hash
+	lock      sync.Mutex
+}
+
+func NewFakeWallet() *FakeWallet {
+	return &FakeWallet{
+		FeePerByte: 1,
+		Rates:      &FakeExchangeRates{Rates: map[string]float64{"USD": 500}},
+		params:     &chaincfg.RegressionNetParams,
+		keys:       make(map[string]*btcec.PrivateKey),
+		current:    make(map[wallet.KeyPurpose]btcutil.Address),
+		txns:       make(map[chainhash.Hash]wallet.Txn),
+		blocks:     make(map[uint32]chainhash.Hash),
+	}
+}
+
+func (w *FakeWallet) Params() *chaincfg.Params {
+	return w.params
+}
+
+// CurrentAddress returns the same address for a purpose until NewAddress is
+// called, mirroring the SPV wallet's behavior for unused addresses.
+func (w *FakeWallet) CurrentAddress(purpose wallet.KeyPurpose) btcutil.Address {
+	w.lock.Lock()
+	addr, ok := w.current[purpose]
+	w.lock.Unlock()
+	if ok {
+		return addr
+	}
+	return w.NewAddress(purpose)
+}
+
+// NewAddress generates a new key and makes its address the current address
+// for the purpose.
+func (w *FakeWallet) NewAddress(purpose wallet.KeyPurpose) btcutil.Address {
+	addr, key := w.newKey()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.keys[addr.String()] = key
+	w.current[purpose] = addr
+	return addr
+}
+
+// NewForeignKey returns a key and address the wallet does not own, for use
+// as the sender of a payment.
+func (w *FakeWallet) NewForeignKey() (*btcec.PrivateKey, btcutil.Address) {
+	addr, key := w.newKey()
+	return key, addr
+}
+
+func (w *FakeWallet) newKey() (btcutil.Address, *btcec.PrivateKey) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		panic(err)
+	}
+	addr, err := bchutil.NewCashAddressPubKeyHash(btcutil.Hash160(key.PubKey().SerializeCompressed()), w.params)
+	if err != nil {
+		panic(err)
+	}
+	return addr, key
+}
+
+func (w *FakeWallet) DecodeAddress(addr string) (btcutil.Address, error) {
+	return bchutil.DecodeAddress(addr, w.params)
+}
+
+func (w *FakeWallet) ScriptToAddress(script []byte) (btcutil.Address, error) {
+	return bchutil.ExtractPkScriptAddrs(script, w.params)
+}
+
+func (w *FakeWallet) GetKey(addr btcutil.Address) (*btcec.PrivateKey, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	key, ok := w.keys[addr.String()]
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+	return key, nil
+}
+
+func (w *FakeWallet) GetFeePerByte(feeLevel wallet.FeeLevel) uint64 {
+	return w.FeePerByte
+}
+
+func (w *FakeWallet) GetTransaction(txid chainhash.Hash) (wallet.Txn, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	txn, ok := w.txns[txid]
+	if !ok {
+		return txn, ErrTransactionNotFound
+	}
+	return txn, nil
+}
+
+func (w *FakeWallet) Broadcast(tx *wire.MsgTx) error {
+	if w.BroadcastErr != nil {
+		return w.BroadcastErr
+	}
+	w.AddTransaction(tx, 0)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.broadcast = append(w.broadcast, tx)
+	return nil
+}
+
+// Broadcasts returns the transactions passed to Broadcast.
+func (w *FakeWallet) Broadcasts() []*wire.MsgTx {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]*wire.MsgTx{}, w.broadcast...)
+}
+
+// AddTransaction stores tx so that it can be returned by GetTransaction.
+func (w *FakeWallet) AddTransaction(tx *wire.MsgTx, height int32) {
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.txns[tx.TxHash()] = wallet.Txn{
+		Txid:      tx.TxHash().String(),
+		Height:    height,
+		Timestamp: time.Now(),
+		Bytes:     buf.Bytes(),
+	}
+}
+
+func (w *FakeWallet) ChainTip() (uint32, chainhash.Hash) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.height, w.tipHash
+}
+
+// SetChainTip sets the height and hash returned by ChainTip.
+func (w *FakeWallet) SetChainTip(height uint32, hash chainhash.Hash) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.height = height
+	w.tipHash = hash
+	w.blocks[height] = hash
+}
+
+// SetBlockHash sets the hash returned by BlockHash for a height below the tip.
+func (w *FakeWallet) SetBlockHash(height uint32, hash chainhash.Hash) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.blocks[height] = hash
+}
+
+func (w *FakeWallet) BlockHash(height uint32) (chainhash.Hash, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	hash, ok := w.blocks[height]
+	if !ok {
+		return chainhash.Hash{}, errors.New("block not found")
+	}
+	return hash, nil
+}
+
+func (w *FakeWallet) ExchangeRates() wallet.ExchangeRates {
+	return w.Rates
+}
+
+func (w *FakeWallet) AddTransactionListener(listener func(wallet.TransactionCallback)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.listeners = append(w.listeners, listener)
+}
+
+// Notify stores tx and passes it to the registered transaction listeners as
+// if it had been seen on the network at the given height.
+func (w *FakeWallet) Notify(tx *wire.MsgTx, height int32, blockTime time.Time) {
+	w.AddTransaction(tx, height)
+	txid := tx.TxHash()
+	cb := wallet.TransactionCallback{
+		Txid:      txid.CloneBytes(),
+		Height:    height,
+		Timestamp: time.Now(),
+		BlockTime: blockTime,
+	}
+	for i, out := range tx.TxOut {
+		cb.Outputs = append(cb.Outputs, wallet.TransactionOutput{
+			ScriptPubKey: out.PkScript,
+			Value:        out.Value,
+			Index:        uint32(i),
+		})
+	}
+	for _, in := range tx.TxIn {
+		cb.Inputs = append(cb.Inputs, wallet.TransactionInput{
+			OutpointHash:  in.PreviousOutPoint.Hash.CloneBytes(),
+			OutpointIndex: in.PreviousOutPoint.Index,
+		})
+	}
+	w.lock.Lock()
+	listeners := append([]func(wallet.TransactionCallback){}, w.listeners...)
+	w.lock.Unlock()
+	for _, l := range listeners {
+		l(cb)
+	}
+}
+
+func (w *FakeWallet) Start() {}
+
+func (w *FakeWallet) Close() {}
+
+// FakeExchangeRates serves fixed exchange rates.
+type FakeExchangeRates struct {
+	Rates map[string]float64
+}
+
+func (r *FakeExchangeRates) GetExchangeRate(currencyCode string) (float64, error) {
+	rate, ok := r.Rates[currencyCode]
+	if !ok {
+		return 0, errors.New("Currency not tracked")
+	}
+	return rate, nil
+}
+
+func (r *FakeExchangeRates) GetLatestRate(currencyCode string) (float64, error) {
+	return r.GetExchangeRate(currencyCode)
+}
+
+func (r *FakeExchangeRates) GetAllRates(cacheOK bool) (map[string]float64, error) {
+	return r.Rates, nil
+}
+
+func (r *FakeExchangeRates) UnitsPerCoin() int {
+	return 100000000
+}
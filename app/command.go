@@ -0,0 +1,62 @@
+package app
+
+import (
+	"fmt"
+	"github.com/OpenBazaar/wallet-interface"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// CommandDef defines a command of the protocol. Scripts are serialized by
+// their own Serialize method.
+type CommandDef struct {
+	Command Command
+	Name    string
+
+	// Parse builds a script from the data elements of a script carrying the
+	// command.
+	Parse func(ps ParsedScript) (Script, error)
+
+	// Handle persists a script seen by the transaction listener. It is called
+	// every time the transaction is seen, including when it confirms and
+	// when it is reorged out of a block.
+	Handle func(l *TransactionListener, s ScriptOutput)
+}
+
+// ScriptOutput is an output carrying a script in a transaction seen by the
+// wallet.
+type ScriptOutput struct {
+	Script Script
+	Txid   chainhash.Hash
+	Output wallet.TransactionOutput
+	Tx     wallet.TransactionCallback
+}
+
+var commands = make(map[Command]CommandDef)
+
+// RegisterCommand adds a command to the protocol. It is meant to be called
+// from the init function of the file defining the command and panics if the
+// command is already registered.
+func RegisterCommand(def CommandDef) {
+	if _, ok := commands[def.Command]; ok {
+		panic(fmt.Sprintf("command 0x%02x registered twice", byte(def.Command)))
+	}
+	commands[def.Command] = def
+}
+
+func (c Command) String() string {
+	if def, ok := commands[c]; ok {
+		return def.Name
+	}
+	return fmt.Sprintf("Unknown(0x%02x)", byte(c))
+}
+
+// BloomFilters returns the header pushes of the registered commands, with and
+// without the protocol version, for matching our scripts in bloom filters.
+// Scripts with any other version aren't matched; see ProtocolVersion.
+func BloomFilters() [][]byte {
+	var filters [][]byte
+	for c := range commands {
+		filters = append(filters, []byte{FlagByte, byte(c)}, []byte{FlagByte, ProtocolVersion, byte(c)})
+	}
+	return filters
+}
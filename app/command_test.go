@@ -0,0 +1,105 @@
+package app
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+const testCommand Command = 0x7E
+
+// testScript is a command carrying only a comment, registered by the tests to
+// check that commands can be added without touching the parser or listener.
+type testScript struct {
+	Comment string
+}
+
+func (ts *testScript) Command() Command {
+	return testCommand
+}
+
+func (ts *testScript) ID() []byte {
+	return []byte(ts.Comment)
+}
+
+func (ts *testScript) Parsed() ParsedScript {
+	return ParsedScript{Comment: ts.Comment}
+}
+
+func (ts *testScript) Serialize() ([]byte, error) {
+	builder := newScriptBuilder(testCommand)
+	builder.AddData(append([]byte{byte(Comment)}, []byte(ts.Comment)...))
+	return finishScript(builder, nil)
+}
+
+func TestRegisterCommand(t *testing.T) {
+	var handled []ScriptOutput
+	RegisterCommand(CommandDef{
+		Command: testCommand,
+		Name:    "Test",
+		Parse: func(ps ParsedScript) (Script, error) {
+			return &testScript{Comment: ps.Comment}, nil
+		},
+		Handle: func(l *TransactionListener, s ScriptOutput) {
+			handled = append(handled, s)
+		},
+	})
+	defer delete(commands, testCommand)
+
+	if testCommand.String() != "Test" || AddFileCommand.String() != "AddFile" || VoteCommand.String() != "Vote" {
+		t.Errorf("Unexpected command names %s, %s and %s", testCommand, AddFileCommand, VoteCommand)
+	}
+	if s := Command(0x7F).String(); s != "Unknown(0x7f)" {
+		t.Errorf("Expected unknown command name, got %s", s)
+	}
+	found := false
+	for _, f := range BloomFilters() {
+		if bytes.Equal(f, []byte{FlagByte, ProtocolVersion, byte(testCommand)}) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Registered command missing from the bloom filters")
+	}
+
+	env := newTestEnv(t)
+	defer env.Close()
+	comment := "long enough for the minimum script size"
+	tx := scriptTx(t, &testScript{Comment: comment})
+	env.wallet.Notify(tx, 100, time.Now())
+	if len(handled) != 1 || handled[0].Script.(*testScript).Comment != comment || handled[0].Tx.Height != 100 {
+		t.Fatalf("Registered command not dispatched: %+v", handled)
+	}
+	if handled[0].Txid != tx.TxHash() || handled[0].Output.Index != 0 || handled[0].Output.Value != 0 {
+		t.Errorf("Unexpected script output %+v", handled[0])
+	}
+}
+
+func TestBloomFilters(t *testing.T) {
+	filters := make(map[string]bool)
+	for _, f := range BloomFilters() {
+		filters[string(f)] = true
+	}
+	if len(filters) != 2*len(commands) {
+		t.Errorf("Expected two filters per command, got %d for %d commands", len(filters), len(commands))
+	}
+	for c := range commands {
+		if !filters[string([]byte{FlagByte, byte(c)})] || !filters[string([]byte{FlagByte, ProtocolVersion, byte(c)})] {
+			t.Errorf("Missing filters for %s", c)
+		}
+		// Filters match whole pushes, so a newer version header is never
+		// delivered to nodes running this version.
+		if filters[string([]byte{FlagByte, ProtocolVersion + 1, byte(c)})] {
+			t.Errorf("Unexpected filter for a newer version of %s", c)
+		}
+	}
+}
+
+func TestRegisterCommand_Duplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a command twice did not panic")
+		}
+	}()
+	RegisterCommand(CommandDef{Command: VoteCommand, Name: "Vote"})
+}
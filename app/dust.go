@@ -1,9 +1,7 @@
 package app
 
-import "github.com/cpacia/BitcoinCash-Wallet"
-
 // Set equal to one USD penny. Must use exchange rate provider for this.
-func MinimumInputSize(w *bitcoincash.SPVWallet) (uint64, error) {
+func MinimumInputSize(w Wallet) (uint64, error) {
 	rate, err := w.ExchangeRates().GetExchangeRate("USD")
 	if err != nil {
 		return 0, err
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/cpacia/ipfsindex/db"
+)
+
+const EditFileCommand Command = 0x03
+
+func init() {
+	RegisterCommand(CommandDef{
+		Command: EditFileCommand,
+		Name:    "EditFile",
+		Parse:   parseEditFile,
+		Handle:  handleEditFile,
+	})
+}
+
+// EditFileScript changes the description or category of the file published
+// by Txid. Empty fields are left unchanged. It is only honored if paid for by
+// the publisher of the file, either directly or through a payment request.
+type EditFileScript struct {
+	Txid        chainhash.Hash
+	Description string
+	Category    string
+	Version     byte
+	Unknown     []DataElement
+}
+
+func (es *EditFileScript) Command() Command {
+	return EditFileCommand
+}
+
+func (es *EditFileScript) ID() []byte {
+	return es.Txid.CloneBytes()
+}
+
+func (es *EditFileScript) Parsed() ParsedScript {
+	return ParsedScript{
+		Version:     es.Version,
+		Txid:        es.Txid,
+		Description: es.Description,
+		Category:    es.Category,
+		Unknown:     es.Unknown,
+	}
+}
+
+// Serialize serializes the script with the current protocol version.
+func (es *EditFileScript) Serialize() ([]byte, error) {
+	builder := newScriptBuilder(EditFileCommand)
+	txid, err := toBigEndian(&es.Txid)
+	if err != nil {
+		return []byte{}, err
+	}
+	builder.AddData(append([]byte{byte(Txid)}, txid...))
+	if es.Description != "" {
+		builder.AddData(append([]byte{byte(Description)}, []byte(es.Description)...))
+	}
+	if es.Category != "" {
+		builder.AddData(append([]byte{byte(Category)}, []byte(es.Category)...))
+	}
+	return finishScript(builder, es.Unknown)
+}
+
+func parseEditFile(ps ParsedScript) (Script, error) {
+	if ps.Txid.IsEqual(&chainhash.Hash{}) || (ps.Description == "" && ps.Category == "") {
+		return nil, ErrInvalidScript
+	}
+	return &EditFileScript{
+		Txid:        ps.Txid,
+		Description: ps.Description,
+		Category:    ps.Category,
+		Version:     ps.Version,
+		Unknown:     ps.Unknown,
+	}, nil
+}
+
+func handleEditFile(l *TransactionListener, s ScriptOutput) {
+	es := s.Script.(*EditFileScript)
+	handleRevision(l, s, es.Txid, db.Revision{
+		Action:      db.RevisionEdit,
+		Description: es.Description,
+		Category:    es.Category,
+	})
+}
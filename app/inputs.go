@@ -0,0 +1,37 @@
+package app
+
+import (
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	btc "github.com/btcsuite/btcutil"
+	"github.com/cpacia/bchutil"
+)
+
+// InputAddresses returns the addresses which funded tx, in input order and
+// without duplicates. Addresses are recovered from the signature scripts so
+// only P2PKH and P2SH inputs can be identified.
+func InputAddresses(tx *wire.MsgTx, params *chaincfg.Params) []btc.Address {
+	var addrs []btc.Address
+	seen := make(map[string]bool)
+	for _, in := range tx.TxIn {
+		pushes, err := txscript.PushedData(in.SignatureScript)
+		if err != nil || len(pushes) == 0 {
+			continue
+		}
+		last := pushes[len(pushes)-1]
+		var addr btc.Address
+		if len(pushes) == 2 && (len(last) == btcec.PubKeyBytesLenCompressed || len(last) == btcec.PubKeyBytesLenUncompressed) {
+			addr, err = bchutil.NewCashAddressPubKeyHash(btc.Hash160(last), params)
+		} else {
+			addr, err = bchutil.NewCashAddressScriptHash(last, params)
+		}
+		if err != nil || seen[addr.String()] {
+			continue
+		}
+		seen[addr.String()] = true
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
@@ -1,13 +1,13 @@
 package app
 
 import (
+	"bytes"
+	"errors"
 	"github.com/OpenBazaar/wallet-interface"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
-	"github.com/cpacia/BitcoinCash-Wallet"
 	"github.com/cpacia/ipfsindex/db"
-	"github.com/jinzhu/gorm"
 	"sync"
 	"time"
 )
@@ -19,22 +19,37 @@ type UserEntry struct {
 	Timestamp   time.Time
 	AmountToPay uint64
 	AmountPaid  uint64
+
+	// Burn is the part of AmountToPay sent to the script's output, where it
+	// can never be spent. It weights a vote.
+	Burn uint64
 }
 
+const (
+	// entryExpiry is how long a user has to pay for a request.
+	entryExpiry = time.Minute * 10
+
+	// finishedRequestRetention is how long finished requests are kept so
+	// their status can be queried and late payments to their address can be
+	// refunded.
+	finishedRequestRetention = time.Hour * 24 * 7
+)
+
 type TransactionListener struct {
 	UserEntries map[string]UserEntry
-	wallet      *bitcoincash.SPVWallet
+	wallet      Wallet
 	db          *db.Database
-	addrChan    chan [2]string
+	statusChan  chan PaymentStatus
+	rescanning  bool
 	lock        sync.RWMutex
 }
 
-func NewTransactionListener(wallet *bitcoincash.SPVWallet, db *db.Database, addrChan chan [2]string) *TransactionListener {
-	tl := &TransactionListener{make(map[string]UserEntry), wallet, db, addrChan, sync.RWMutex{}}
+func NewTransactionListener(wallet Wallet, db *db.Database, statusChan chan PaymentStatus) *TransactionListener {
+	tl := &TransactionListener{make(map[string]UserEntry), wallet, db, statusChan, false, sync.RWMutex{}}
+	tl.loadEntries()
 	ticker := time.NewTicker(time.Minute)
 	go func() {
-		select {
-		case <-ticker.C:
+		for range ticker.C {
 			tl.cleanup()
 		}
 	}()
@@ -42,12 +57,22 @@ func NewTransactionListener(wallet *bitcoincash.SPVWallet, db *db.Database, addr
 }
 
 func (l *TransactionListener) ListenBitcoinCash(tx wallet.TransactionCallback) {
-	entries := make(map[UserEntry][]wallet.Utxo)
+	paid := make(map[string]UserEntry)
 	chainHash, err := chainhash.NewHash(tx.Txid)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	// The funding address is only needed to refund payments so it's looked
+	// up lazily, at most once per transaction.
+	var senderAddr *string
+	sender := func() string {
+		if senderAddr == nil {
+			a := l.fundingAddress(*chainHash)
+			senderAddr = &a
+		}
+		return *senderAddr
+	}
 	for _, out := range tx.Outputs {
 		addr, err := l.wallet.ScriptToAddress(out.ScriptPubKey)
 		if err != nil {
@@ -56,132 +81,431 @@ func (l *TransactionListener) ListenBitcoinCash(tx wallet.TransactionCallback) {
 				log.Error(err)
 				continue
 			}
-			if parsedScript.Command() == AddFileCommand {
-				ts := time.Now()
-				if tx.Height > 0 {
-					ts = tx.BlockTime
-				}
-				fd := &db.FileDescriptor{}
-				if l.db.Where("txid = ?", chainHash.String()).First(fd).RecordNotFound() {
-					l.db.Save(&db.FileDescriptor{
-						Txid:        chainHash.String(),
-						Category:    parsedScript.(*AddFileScript).Category,
-						Description: parsedScript.(*AddFileScript).Description,
-						Timestamp:   ts,
-						Height:      uint32(tx.Height),
-						Cid:         parsedScript.(*AddFileScript).Cid.String(),
-					})
-					if tx.Height > 0 {
-						l.db.Index(chainHash.String(), db.FileDescriptor{
-							Category:    parsedScript.(*AddFileScript).Category,
-							Description: parsedScript.(*AddFileScript).Description,
-							Cid:         parsedScript.(*AddFileScript).Cid.String(),
-						})
-					}
-					log.Debugf("Received new file descriptor, tx: %s", chainHash.String())
-				} else {
-					l.db.Model(fd).Updates(&db.FileDescriptor{Height: uint32(tx.Height), Timestamp: ts})
-					l.db.Index(chainHash.String(), db.FileDescriptor{
-						Category:    parsedScript.(*AddFileScript).Category,
-						Description: parsedScript.(*AddFileScript).Description,
-						Cid:         parsedScript.(*AddFileScript).Cid.String(),
-					})
-					log.Debugf("Updated file descriptor with confirmation, tx: %s", chainHash.String())
-				}
-			} else if parsedScript.Command() == VoteCommand {
-				ts := time.Now()
-				if tx.Height > 0 {
-					ts = tx.BlockTime
-				}
-				v := &db.Vote{}
-				if l.db.Where("txid = ?", chainHash.String()).First(v).RecordNotFound() {
-					l.db.Save(&db.Vote{
-						FDTxid:    parsedScript.(*VoteScript).Txid.String(),
-						Txid:      chainHash.String(),
-						Comment:   parsedScript.(*VoteScript).Comment,
-						Timestamp: ts,
-						Height:    uint32(tx.Height),
-						Upvote:    parsedScript.(*VoteScript).Upvote,
-					})
-					if tx.Height > 0 {
-						l.updateVoteColumns(parsedScript.(*VoteScript).Upvote, parsedScript.(*VoteScript).Txid.String())
-					}
-					log.Debugf("Received new vote, tx: %s", chainHash.String())
-				} else {
-					l.db.Model(v).Updates(&db.Vote{Height: uint32(tx.Height), Timestamp: ts})
-					l.updateVoteColumns(v.Upvote, v.FDTxid)
-					log.Debugf("Updated vote with confirmation, tx: %s", chainHash.String())
-				}
+			if def := commands[parsedScript.Command()]; def.Handle != nil {
+				def.Handle(l, ScriptOutput{
+					Script: parsedScript,
+					Txid:   *chainHash,
+					Output: out,
+					Tx:     tx,
+				})
 			}
 			continue
 		}
-		l.lock.RLock()
+		op := wire.NewOutPoint(chainHash, out.Index)
+		l.lock.Lock()
 		entry, ok := l.UserEntries[addr.String()]
-		l.lock.RUnlock()
 		if !ok {
+			l.lock.Unlock()
+			l.handleLatePayment(addr, op, out, tx.Height, sender)
 			continue
 		}
-		op := wire.NewOutPoint(chainHash, out.Index)
-		u := wallet.Utxo{
-			Value:        out.Value,
-			ScriptPubkey: out.ScriptPubKey,
-			WatchOnly:    false,
-			AtHeight:     tx.Height,
-			Op:           *op,
+		if !l.recordPayment(entry.ID, op, out, tx.Height, sender()) {
+			l.lock.Unlock()
+			continue
 		}
-		utxos := entries[entry]
-		utxos = append(utxos, u)
 		entry.AmountPaid += uint64(out.Value)
-		l.lock.Lock()
 		l.UserEntries[addr.String()] = entry
 		l.lock.Unlock()
-		entries[entry] = utxos
+		l.db.Model(&db.PaymentRequest{}).Where("request_id = ?", entry.ID).UpdateColumn("amount_paid", entry.AmountPaid)
+		if entry.AmountPaid < entry.AmountToPay {
+			l.setState(entry, PaymentPartial, "", "")
+		} else if entry.AmountPaid-uint64(out.Value) < entry.AmountToPay {
+			paid[addr.String()] = entry
+		}
 		log.Debugf("Received transaction %s for req:%s", chainHash.String(), entry.ID)
 	}
 
-	for e, utxos := range entries {
-		if e.AmountPaid < e.AmountToPay {
+	for _, e := range paid {
+		l.setState(e, PaymentBroadcasting, "", "")
+		go l.broadcast(e)
+	}
+}
+
+// Resume broadcasts the scripts for any persisted entries which were paid in
+// full before the listener was last shut down, rolls back records orphaned
+// while it was down and continues any interrupted rescan.
+func (l *TransactionListener) Resume() {
+	var paid []UserEntry
+	l.lock.RLock()
+	for _, e := range l.UserEntries {
+		if e.AmountPaid >= e.AmountToPay {
+			paid = append(paid, e)
+		}
+	}
+	l.lock.RUnlock()
+	for _, e := range paid {
+		log.Debugf("Resuming broadcast for req:%s", e.ID)
+		l.setState(e, PaymentBroadcasting, "", "")
+		go l.broadcast(e)
+	}
+	if n := l.CheckOrphans(); n > 0 {
+		log.Warningf("Rolled back %d records orphaned while shut down", n)
+	}
+	if _, err := l.ResumeRescan(); err != nil && err != ErrRescanNotFound && err != ErrRescanUnsupported {
+		log.Errorf("Error resuming rescan: %s", err.Error())
+	}
+}
+
+func (l *TransactionListener) broadcast(e UserEntry) {
+	defer l.removeEntry(e)
+	var outpoints []db.PaymentOutpoint
+	if err := l.db.Where("request_id = ? AND spent_by = ''", e.ID).Order("id asc").Find(&outpoints).Error; err != nil {
+		log.Errorf("Error loading utxos: req:%s: %s", e.ID, err.Error())
+		l.setState(e, PaymentFailed, "", "failed to load payment")
+		return
+	}
+	utxos, err := outpointUtxos(outpoints)
+	if err != nil {
+		log.Errorf("Error loading utxos: req:%s: %s", e.ID, err.Error())
+		l.setState(e, PaymentFailed, "", "failed to load payment")
+		return
+	}
+	// Revisions not paid for by the publisher would be ignored, so the
+	// payment is returned rather than spent on them.
+	if err := l.checkRevision(e.Script, payer(outpoints)); err != nil {
+		log.Warningf("Refunding req:%s: %s", e.ID, err.Error())
+		l.refund(e.ID, "not the publisher")
+		l.setState(e, PaymentFailed, "", err.Error())
+		return
+	}
+	var refunds []*wire.TxOut
+	if overpaid := int64(e.AmountPaid) - int64(e.AmountToPay); overpaid > 0 && len(outpoints) > 0 {
+		// Return the overpayment to whoever sent the payment which pushed
+		// the request over the amount due.
+		if out, err := l.refundOutput(outpoints[len(outpoints)-1].Sender, overpaid); err == nil {
+			refunds = append(refunds, out)
+		}
+	}
+	tx, err := BuildTransaction(l.wallet, utxos, e.Script, int64(e.Burn), refunds...)
+	if err == nil {
+		// Record who paid for the transaction before broadcasting it, so that
+		// its script is attributed to them however soon it is seen.
+		hash := tx.TxHash()
+		err = l.db.Model(&db.PaymentRequest{}).Where("request_id = ?", e.ID).UpdateColumns(map[string]interface{}{
+			"txid":   hash.String(),
+			"sender": payer(outpoints),
+		}).Error
+	}
+	if err == nil {
+		err = l.wallet.Broadcast(tx)
+	}
+	if err != nil {
+		log.Errorf("Error making transaction: req:%s: %s", e.ID, err.Error())
+		l.refund(e.ID, "broadcast failed")
+		l.setState(e, PaymentFailed, "", err.Error())
+		return
+	}
+	hash := tx.TxHash()
+	if len(refunds) > 0 {
+		l.db.Create(&db.Refund{
+			RequestID: e.ID,
+			Address:   outpoints[len(outpoints)-1].Sender,
+			Amount:    refunds[0].Value,
+			Txid:      hash.String(),
+			Reason:    "overpaid",
+		})
+	}
+	l.spendOutpoints(outpoints, hash)
+	l.setState(e, PaymentBroadcast, hash.String(), "")
+	log.Debugf("Successfuly broadcast transaction %s for req:%s", hash.String(), e.ID)
+}
+
+// handleLatePayment refunds a payment to the address of a request which has
+// already expired or been completed. Payments which were already recorded,
+// including those since spent by the index transaction or a refund, are
+// ignored.
+func (l *TransactionListener) handleLatePayment(addr btcutil.Address, op *wire.OutPoint, out wallet.TransactionOutput, height int32, sender func() string) {
+	req := new(db.PaymentRequest)
+	if l.db.Where("address = ? AND state IN (?)", addr.String(), finishedStates).Order("timestamp desc").First(req).RecordNotFound() {
+		return
+	}
+	if !l.recordPayment(req.RequestID, op, out, height, sender()) {
+		return
+	}
+	log.Debugf("Received late payment %s for req:%s", op.String(), req.RequestID)
+	l.refund(req.RequestID, "late payment")
+}
+
+// refund returns the outputs recorded for a request to the addresses which
+// funded them, less the fee. Outputs whose sender is unknown are left in place.
+func (l *TransactionListener) refund(requestID, reason string) {
+	var outpoints []db.PaymentOutpoint
+	if err := l.db.Where("request_id = ? AND spent_by = ''", requestID).Find(&outpoints).Error; err != nil {
+		log.Errorf("Error loading utxos for refund: req:%s: %s", requestID, err.Error())
+		return
+	}
+	bySender := make(map[string][]db.PaymentOutpoint)
+	for _, o := range outpoints {
+		bySender[o.Sender] = append(bySender[o.Sender], o)
+	}
+	for sender, ops := range bySender {
+		if sender == "" {
+			log.Warningf("Unable to refund %d outputs for req:%s: sender unknown", len(ops), requestID)
 			continue
 		}
-		go func(e2 UserEntry, utxoList []wallet.Utxo) {
-			defer func() {
-				l.lock.Lock()
-				delete(l.UserEntries, e.Address.String())
-				l.lock.Unlock()
-			}()
-			hash, err := MakeTransaction(l.wallet, utxos, e2.Script)
-			if err != nil {
-				log.Errorf("Error making transaction: req:%s: %s", e2.ID, err.Error())
-				return
-			}
-			l.addrChan <- [2]string{e2.Address.String(), hash.String()}
-			log.Debugf("Successfuly broadcast transaction %s for req:%s", hash.String(), e2.ID)
-		}(e, utxos)
+		addr, err := l.wallet.DecodeAddress(sender)
+		if err != nil {
+			log.Errorf("Error decoding refund address for req:%s: %s", requestID, err.Error())
+			continue
+		}
+		utxos, err := outpointUtxos(ops)
+		if err != nil {
+			log.Errorf("Error loading utxos for refund: req:%s: %s", requestID, err.Error())
+			continue
+		}
+		hash, amount, err := MakeRefund(l.wallet, utxos, addr)
+		if err != nil {
+			log.Errorf("Error making refund: req:%s: %s", requestID, err.Error())
+			continue
+		}
+		l.db.Create(&db.Refund{
+			RequestID: requestID,
+			Address:   sender,
+			Amount:    amount,
+			Txid:      hash.String(),
+			Reason:    reason,
+		})
+		l.spendOutpoints(ops, *hash)
+		log.Debugf("Refunded %d sats to %s in %s for req:%s (%s)", amount, sender, hash.String(), requestID, reason)
+	}
+}
+
+// spendOutpoints marks outpoints as spent by txid.
+func (l *TransactionListener) spendOutpoints(outpoints []db.PaymentOutpoint, txid chainhash.Hash) {
+	ids := make([]uint, 0, len(outpoints))
+	for _, o := range outpoints {
+		ids = append(ids, o.ID)
+	}
+	if err := l.db.Model(&db.PaymentOutpoint{}).Where("id IN (?)", ids).UpdateColumn("spent_by", txid.String()).Error; err != nil {
+		log.Errorf("Error marking payments spent by %s: %s", txid.String(), err.Error())
 	}
 }
 
-func (l *TransactionListener) updateVoteColumns(upvote bool, txid string) {
-	column := "downvotes"
-	sign := "-"
-	if upvote {
-		column = "upvotes"
-		sign = "+"
+func (l *TransactionListener) refundOutput(sender string, amount int64) (*wire.TxOut, error) {
+	if sender == "" {
+		return nil, errors.New("sender unknown")
+	}
+	addr, err := l.wallet.DecodeAddress(sender)
+	if err != nil {
+		return nil, err
 	}
-	l.db.Model(&db.FileDescriptor{}).Where(`txid="`+txid+`"`).UpdateColumn(column, gorm.Expr(column+"+1")).UpdateColumn("net", gorm.Expr("net"+sign+"1"))
+	return RefundOutput(l.wallet, addr, amount)
 }
 
-func (l *TransactionListener) NewEntry(addr btcutil.Address, entry UserEntry) {
+// payer returns the sender of the first payment to a request whose sender is
+// known.
+func payer(outpoints []db.PaymentOutpoint) string {
+	for _, o := range outpoints {
+		if o.Sender != "" {
+			return o.Sender
+		}
+	}
+	return ""
+}
+
+// paidBy returns the address of the user who paid for a transaction. Scripts
+// broadcast for payment requests are funded from our own payment addresses, so
+// they are attributed to the sender of the payment. Other transactions are
+// attributed to the address of their first input.
+func (l *TransactionListener) paidBy(txid chainhash.Hash) string {
+	req := new(db.PaymentRequest)
+	if !l.db.Where("txid = ? AND sender != ''", txid.String()).First(req).RecordNotFound() {
+		return req.Sender
+	}
+	return l.fundingAddress(txid)
+}
+
+// fundingAddress returns the address of the first input of the transaction
+// or an empty string if it cannot be determined.
+func (l *TransactionListener) fundingAddress(txid chainhash.Hash) string {
+	addrs := l.inputAddresses(txid)
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0]
+}
+
+// inputAddresses returns the addresses of the inputs of the transaction in
+// order.
+func (l *TransactionListener) inputAddresses(txid chainhash.Hash) []string {
+	txn, err := l.wallet.GetTransaction(txid)
+	if err != nil {
+		return nil
+	}
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	if err := msgTx.Deserialize(bytes.NewReader(txn.Bytes)); err != nil {
+		return nil
+	}
+	var addrs []string
+	for _, addr := range InputAddresses(msgTx, l.wallet.Params()) {
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+// recordPayment persists an output paying to a request. It returns false if
+// the output was already recorded.
+func (l *TransactionListener) recordPayment(requestID string, op *wire.OutPoint, out wallet.TransactionOutput, height int32, sender string) bool {
+	if !l.db.Where("outpoint = ?", op.String()).First(&db.PaymentOutpoint{}).RecordNotFound() {
+		return false
+	}
+	err := l.db.Create(&db.PaymentOutpoint{
+		RequestID:    requestID,
+		Outpoint:     op.String(),
+		Txid:         op.Hash.String(),
+		Index:        op.Index,
+		Value:        out.Value,
+		ScriptPubKey: out.ScriptPubKey,
+		Height:       height,
+		Sender:       sender,
+	}).Error
+	if err != nil {
+		log.Errorf("Error saving payment for req:%s: %s", requestID, err.Error())
+		return false
+	}
+	return true
+}
+
+func outpointUtxos(outpoints []db.PaymentOutpoint) ([]wallet.Utxo, error) {
+	var utxos []wallet.Utxo
+	for _, o := range outpoints {
+		hash, err := chainhash.NewHashFromStr(o.Txid)
+		if err != nil {
+			return nil, err
+		}
+		utxos = append(utxos, wallet.Utxo{
+			Value:        o.Value,
+			ScriptPubkey: o.ScriptPubKey,
+			WatchOnly:    false,
+			AtHeight:     o.Height,
+			Op:           *wire.NewOutPoint(hash, o.Index),
+		})
+	}
+	return utxos, nil
+}
+
+func (l *TransactionListener) updateTally(fdTxid string) {
+	if err := l.db.UpdateTally(fdTxid); err != nil {
+		log.Errorf("Error updating vote tally for %s: %s", fdTxid, err.Error())
+	}
+}
+
+// blockHash returns the hash of the block at the given height in the wallet's
+// chain. An empty string is returned for unconfirmed transactions or if the
+// wallet doesn't know the block.
+func (l *TransactionListener) blockHash(height int32) string {
+	if height <= 0 {
+		return ""
+	}
+	hash, err := l.wallet.BlockHash(uint32(height))
+	if err != nil {
+		log.Warningf("Error looking up block at height %d: %s", height, err.Error())
+		return ""
+	}
+	return hash.String()
+}
+
+// confirmedHeight maps the wallet's height to the height we store. Dead
+// transactions are reported with a negative height and are stored as
+// unconfirmed.
+func confirmedHeight(height int32) uint32 {
+	if height <= 0 {
+		return 0
+	}
+	return uint32(height)
+}
+
+func (l *TransactionListener) NewEntry(addr btcutil.Address, entry UserEntry) error {
+	script, err := entry.Script.Serialize()
+	if err != nil {
+		return err
+	}
 	l.lock.Lock()
-	defer l.lock.Unlock()
+	err = l.db.Create(&db.PaymentRequest{
+		RequestID:   entry.ID,
+		Address:     addr.String(),
+		Script:      script,
+		AmountToPay: entry.AmountToPay,
+		AmountPaid:  entry.AmountPaid,
+		Burn:        entry.Burn,
+		Timestamp:   entry.Timestamp,
+		State:       string(PaymentPending),
+	}).Error
+	if err != nil {
+		l.lock.Unlock()
+		return err
+	}
 	l.UserEntries[addr.String()] = entry
+	l.lock.Unlock()
+	l.setState(entry, PaymentPending, "", "")
+	return nil
 }
 
-func (l *TransactionListener) cleanup() {
+// loadEntries restores the user entries persisted by a previous run.
+func (l *TransactionListener) loadEntries() {
+	var requests []db.PaymentRequest
+	l.db.Where("state NOT IN (?)", finishedStates).Order("timestamp asc").Find(&requests)
+	for _, r := range requests {
+		script, err := ParseScript(r.Script)
+		if err != nil {
+			log.Errorf("Error loading script for req:%s: %s", r.RequestID, err.Error())
+			continue
+		}
+		addr, err := l.wallet.DecodeAddress(r.Address)
+		if err != nil {
+			log.Errorf("Error loading address for req:%s: %s", r.RequestID, err.Error())
+			continue
+		}
+		l.UserEntries[r.Address] = UserEntry{
+			ID:          r.RequestID,
+			Script:      script,
+			Address:     addr,
+			Timestamp:   r.Timestamp,
+			AmountToPay: r.AmountToPay,
+			AmountPaid:  r.AmountPaid,
+			Burn:        r.Burn,
+		}
+	}
+	log.Debugf("Loaded %d pending payment requests", len(l.UserEntries))
+}
+
+func (l *TransactionListener) removeEntry(e UserEntry) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
+	if current, ok := l.UserEntries[e.Address.String()]; ok && current.ID == e.ID {
+		delete(l.UserEntries, e.Address.String())
+	}
+}
+
+// deleteRequest deletes a finished request. Its spent outpoints are kept so
+// that replays of its payments are still recognized.
+func (l *TransactionListener) deleteRequest(id string) {
+	l.db.Unscoped().Where("request_id = ? AND spent_by = ''", id).Delete(&db.PaymentOutpoint{})
+	l.db.Unscoped().Where("request_id = ?", id).Delete(&db.PaymentRequest{})
+}
+
+// cleanup expires entries which have not been paid in full in time. Partial
+// payments are refunded. Finished requests are kept for a while so that their
+// status can be queried and late payments to their address can be refunded.
+func (l *TransactionListener) cleanup() {
+	var expired []UserEntry
+	l.lock.Lock()
 	for k, v := range l.UserEntries {
-		if v.Timestamp.Add(time.Minute * 10).Before(time.Now()) {
+		if v.Timestamp.Add(entryExpiry).Before(time.Now()) && v.AmountPaid < v.AmountToPay {
 			delete(l.UserEntries, k)
+			expired = append(expired, v)
+		}
+	}
+	l.lock.Unlock()
+	for _, e := range expired {
+		l.setState(e, PaymentExpired, "", "")
+		if e.AmountPaid > 0 {
+			l.refund(e.ID, "underpaid")
 		}
 	}
+	var stale []db.PaymentRequest
+	l.db.Where("state IN (?) AND timestamp < ?", finishedStates, time.Now().Add(-finishedRequestRetention)).Find(&stale)
+	for _, r := range stale {
+		l.deleteRequest(r.RequestID)
+	}
 }
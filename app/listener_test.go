@@ -0,0 +1,705 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/OpenBazaar/wallet-interface"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/bchutil"
+	"github.com/cpacia/ipfsindex/app/apptest"
+	"github.com/cpacia/ipfsindex/db"
+	"github.com/ipfs/go-cid"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var _ Wallet = (*apptest.FakeWallet)(nil)
+
+type testEnv struct {
+	wallet     *apptest.FakeWallet
+	db         *db.Database
+	listener   *TransactionListener
+	statusChan chan PaymentStatus
+	dir        string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "ipfsindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := apptest.NewFakeWallet()
+	statusChan := make(chan PaymentStatus, 100)
+	tl := NewTransactionListener(w, database, statusChan)
+	w.AddTransactionListener(tl.ListenBitcoinCash)
+	return &testEnv{w, database, tl, statusChan, dir}
+}
+
+func (e *testEnv) Close() {
+	e.db.Close()
+	os.RemoveAll(e.dir)
+}
+
+// waitForState reads status events until one with the given state arrives.
+func (e *testEnv) waitForState(t *testing.T, state PaymentState) PaymentStatus {
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case status := <-e.statusChan:
+			if status.State == state {
+				return status
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for payment state %s", state)
+		}
+	}
+}
+
+func testCid(t *testing.T) cid.Cid {
+	id, err := cid.Decode("QmNp85zy9RLrQ5oQD4hPyS39ezrrXpcaa7R4Y9kxdWQLLQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *id
+}
+
+// scriptTx returns a transaction carrying script in an OP_RETURN output.
+func scriptTx(t *testing.T, script Script) *wire.MsgTx {
+	ser, err := script.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{0x01}, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(0, ser))
+	return tx
+}
+
+// fundedBy sets the input of tx to spend from key.
+func fundedBy(t *testing.T, tx *wire.MsgTx, key *btcec.PrivateKey) *wire.MsgTx {
+	sigScript, err := txscript.NewScriptBuilder().AddData(make([]byte, 71)).AddData(key.PubKey().SerializeCompressed()).Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.TxIn[0].SignatureScript = sigScript
+	return tx
+}
+
+// paymentTx returns a transaction spending from key which pays value to addr.
+func paymentTx(t *testing.T, key *btcec.PrivateKey, addr btcutil.Address, value int64) *wire.MsgTx {
+	script, err := bchutil.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigScript, err := txscript.NewScriptBuilder().AddData(make([]byte, 71)).AddData(key.PubKey().SerializeCompressed()).Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{0x02}, uint32(value)), sigScript, nil))
+	tx.AddTxOut(wire.NewTxOut(value, script))
+	return tx
+}
+
+func (e *testEnv) newEntry(t *testing.T, amount uint64) UserEntry {
+	addr := e.wallet.NewAddress(wallet.EXTERNAL)
+	entry := UserEntry{
+		ID:          addr.String(),
+		Script:      &AddFileScript{Cid: testCid(t), Description: "hello world"},
+		Address:     addr,
+		Timestamp:   time.Now(),
+		AmountToPay: amount,
+	}
+	if err := e.listener.NewEntry(addr, entry); err != nil {
+		t.Fatal(err)
+	}
+	e.waitForState(t, PaymentPending)
+	return entry
+}
+
+func TestTransactionListener_AddFile(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	tx := scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world", Category: "Music", Size: 2048, MimeType: "audio/mpeg", Tags: []string{"Lo-Fi", "chill"}})
+	txid := tx.TxHash().String()
+
+	env.wallet.Notify(tx, 0, time.Time{})
+	fd := new(db.FileDescriptor)
+	if env.db.Where("txid = ?", txid).First(fd).RecordNotFound() {
+		t.Fatal("File descriptor not saved")
+	}
+	if fd.Height != 0 || fd.Category != "Music" || fd.Cid != testCid(t).String() || fd.Size != 2048 || fd.MimeType != "audio/mpeg" {
+		t.Errorf("Unconfirmed file descriptor saved incorrectly: %+v", fd)
+	}
+	if !bytes.Equal(fd.RawScript, tx.TxOut[0].PkScript) {
+		t.Errorf("Raw script not saved: %x", fd.RawScript)
+	}
+	if tags, _ := env.db.Tags(txid); len(tags) != 2 || tags[0] != "chill" || tags[1] != "lo-fi" {
+		t.Errorf("Tags not saved: %v", tags)
+	}
+	if ids, _, _ := env.db.Query("hello", 10, 0); len(ids) != 0 {
+		t.Error("Unconfirmed file descriptor was indexed as confirmed")
+	}
+	if results, _ := env.db.Search(db.SearchOptions{Query: "hello", Limit: 10}); results == nil || results.Total != 1 {
+		t.Error("Unconfirmed file descriptor was not indexed")
+	}
+
+	blockHash := chainhash.Hash{0xaa}
+	env.wallet.SetChainTip(100, blockHash)
+	env.wallet.Notify(tx, 100, time.Now())
+	fd = new(db.FileDescriptor)
+	env.db.Where("txid = ?", txid).First(fd)
+	if fd.Height != 100 || fd.BlockHash != blockHash.String() {
+		t.Errorf("Confirmation not recorded: height %d, block %s", fd.Height, fd.BlockHash)
+	}
+	if ids, _, _ := env.db.Query("hello", 10, 0); len(ids) != 1 || ids[0] != txid {
+		t.Errorf("Confirmed file descriptor not indexed: %v", ids)
+	}
+
+	// Reorg
+	env.wallet.Notify(tx, 0, time.Time{})
+	fd = new(db.FileDescriptor)
+	env.db.Where("txid = ?", txid).First(fd)
+	if fd.Height != 0 || fd.BlockHash != "" {
+		t.Errorf("Reorg not rolled back: height %d, block %s", fd.Height, fd.BlockHash)
+	}
+	if ids, _, _ := env.db.Query("hello", 10, 0); len(ids) != 0 {
+		t.Error("Reorged file descriptor still indexed as confirmed")
+	}
+}
+
+func TestTransactionListener_Vote(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	fdTx := scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world"})
+	env.wallet.Notify(fdTx, 100, time.Now())
+	fdTxid := fdTx.TxHash()
+
+	voteTx := scriptTx(t, &VoteScript{Txid: fdTxid, Upvote: true, Comment: "nice"})
+	tally := func() *db.FileDescriptor {
+		fd := new(db.FileDescriptor)
+		env.db.Where("txid = ?", fdTxid.String()).First(fd)
+		return fd
+	}
+
+	env.wallet.Notify(voteTx, 0, time.Time{})
+	if fd := tally(); fd.Upvotes != 0 {
+		t.Errorf("Unconfirmed vote counted: %d upvotes", fd.Upvotes)
+	}
+
+	// Seeing the confirmation twice must not double count.
+	env.wallet.Notify(voteTx, 101, time.Now())
+	env.wallet.Notify(voteTx, 101, time.Now())
+	if fd := tally(); fd.Upvotes != 1 || fd.Net != 1 {
+		t.Errorf("Expected one upvote, got %d upvotes and net %d", fd.Upvotes, fd.Net)
+	}
+
+	// Reorg
+	env.wallet.Notify(voteTx, 0, time.Time{})
+	if fd := tally(); fd.Upvotes != 0 || fd.Net != 0 {
+		t.Errorf("Reorged vote still counted: %d upvotes and net %d", fd.Upvotes, fd.Net)
+	}
+}
+
+func TestTransactionListener_ReorgBelowTip(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// As during a sync or rescan, the transactions' blocks are below the tip.
+	fdBlock, voteBlock := chainhash.Hash{0x01}, chainhash.Hash{0x02}
+	env.wallet.SetChainTip(200, chainhash.Hash{0xff})
+	env.wallet.SetBlockHash(100, fdBlock)
+	env.wallet.SetBlockHash(101, voteBlock)
+
+	fdTx := scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world"})
+	fdTxid := fdTx.TxHash()
+	voteTx := scriptTx(t, &VoteScript{Txid: fdTxid, Upvote: true, Comment: "nice"})
+	env.wallet.Notify(fdTx, 100, time.Now())
+	env.wallet.Notify(voteTx, 101, time.Now())
+
+	load := func() (*db.FileDescriptor, *db.Vote) {
+		fd, v := new(db.FileDescriptor), new(db.Vote)
+		env.db.Where("txid = ?", fdTxid.String()).First(fd)
+		env.db.Where("txid = ?", voteTx.TxHash().String()).First(v)
+		return fd, v
+	}
+	fd, v := load()
+	if fd.BlockHash != fdBlock.String() || v.BlockHash != voteBlock.String() {
+		t.Errorf("Block hashes not recorded: descriptor %q, vote %q", fd.BlockHash, v.BlockHash)
+	}
+	if fd.Upvotes != 1 {
+		t.Errorf("Expected one upvote, got %d", fd.Upvotes)
+	}
+
+	// Both blocks are orphaned.
+	env.wallet.Notify(voteTx, 0, time.Time{})
+	env.wallet.Notify(fdTx, 0, time.Time{})
+	fd, v = load()
+	if fd.Height != 0 || fd.BlockHash != "" || v.Height != 0 || v.BlockHash != "" {
+		t.Errorf("Reorg not rolled back: descriptor %d/%q, vote %d/%q", fd.Height, fd.BlockHash, v.Height, v.BlockHash)
+	}
+	if fd.Upvotes != 0 || fd.Net != 0 {
+		t.Errorf("Reorged vote still counted: %d upvotes and net %d", fd.Upvotes, fd.Net)
+	}
+	if ids, _, _ := env.db.Query("hello", 10, 0); len(ids) != 0 {
+		t.Error("Reorged file descriptor still indexed as confirmed")
+	}
+}
+
+func TestTransactionListener_CheckOrphans(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	fdBlock, voteBlock := chainhash.Hash{0x01}, chainhash.Hash{0x02}
+	env.wallet.SetChainTip(101, voteBlock)
+	env.wallet.SetBlockHash(100, fdBlock)
+	fdTx := scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world"})
+	fdTxid := fdTx.TxHash()
+	voteTx := scriptTx(t, &VoteScript{Txid: fdTxid, Upvote: true, Comment: "nice"})
+	env.wallet.Notify(fdTx, 100, time.Now())
+	env.wallet.Notify(voteTx, 101, time.Now())
+
+	if n := env.listener.CheckOrphans(); n != 0 {
+		t.Errorf("Expected nothing orphaned, got %d", n)
+	}
+
+	// Block 101 is replaced while we are shut down.
+	env.wallet.SetChainTip(101, chainhash.Hash{0x03})
+	if n := env.listener.CheckOrphans(); n != 1 {
+		t.Errorf("Expected the vote to be orphaned, got %d records", n)
+	}
+	fd, v := new(db.FileDescriptor), new(db.Vote)
+	env.db.Where("txid = ?", fdTxid.String()).First(fd)
+	env.db.Where("txid = ?", voteTx.TxHash().String()).First(v)
+	if fd.Height != 100 || fd.BlockHash != fdBlock.String() {
+		t.Errorf("Descriptor in a valid block rolled back: %d/%q", fd.Height, fd.BlockHash)
+	}
+	if v.Height != 0 || v.BlockHash != "" || fd.Upvotes != 0 {
+		t.Errorf("Orphaned vote not rolled back: %d/%q, %d upvotes", v.Height, v.BlockHash, fd.Upvotes)
+	}
+}
+
+func TestTransactionListener_WeightedVote(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	fdTx := scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world"})
+	env.wallet.Notify(fdTx, 100, time.Now())
+	fdTxid := fdTx.TxHash()
+
+	// The value of the vote's output is burned and weights the vote.
+	voteTx := scriptTx(t, &VoteScript{Txid: fdTxid, Upvote: false, Comment: "meh"})
+	voteTx.TxOut[0].Value = 2500
+	env.wallet.Notify(voteTx, 101, time.Now())
+
+	v := new(db.Vote)
+	env.db.Where("txid = ?", voteTx.TxHash().String()).First(v)
+	if v.Weight != 2500 {
+		t.Errorf("Expected vote weight 2500, got %d", v.Weight)
+	}
+	fd := new(db.FileDescriptor)
+	env.db.Where("txid = ?", fdTxid.String()).First(fd)
+	if fd.Downvotes != 1 || fd.WeightedDownvotes != 2500 || fd.WeightedNet != -2500 {
+		t.Errorf("Unexpected weighted tally %+v", fd)
+	}
+}
+
+func TestTransactionListener_VotePolicy(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	env.db.TallyPolicy = db.TallyLatestPerVoter
+
+	fdTx := scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world"})
+	env.wallet.Notify(fdTx, 100, time.Now())
+	fdTxid := fdTx.TxHash()
+
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	voter, err := bchutil.NewCashAddressPubKeyHash(btcutil.Hash160(key.PubKey().SerializeCompressed()), env.wallet.Params())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vote := func(upvote bool, comment string, height int32) *wire.MsgTx {
+		tx := fundedBy(t, scriptTx(t, &VoteScript{Txid: fdTxid, Upvote: upvote, Comment: comment}), key)
+		env.wallet.Notify(tx, height, time.Now())
+		return tx
+	}
+
+	// The voter changes their mind in a later block.
+	upTx := vote(true, "nice", 101)
+	vote(false, "changed my mind", 102)
+
+	v := new(db.Vote)
+	env.db.Where("txid = ?", upTx.TxHash().String()).First(v)
+	if v.Voter != voter.String() || v.InputAddresses != voter.String() {
+		t.Errorf("Expected vote funded by %s, got voter %s and inputs %s", voter, v.Voter, v.InputAddresses)
+	}
+	fd := new(db.FileDescriptor)
+	env.db.Where("txid = ?", fdTxid.String()).First(fd)
+	if fd.Upvotes != 1 || fd.Downvotes != 1 || fd.Upvoters != 0 || fd.Downvoters != 1 || fd.Net != -1 {
+		t.Errorf("Expected only the latest vote to count, got %+v", fd)
+	}
+}
+
+func TestTransactionListener_SiteVoters(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	env.db.TallyPolicy = db.TallyLatestPerVoter
+
+	fdTx := scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world"})
+	env.wallet.Notify(fdTx, 100, time.Now())
+	fdTxid := fdTx.TxHash()
+
+	// Two users vote through the site, paying to the same address, so both
+	// votes are funded by it.
+	addr := env.wallet.NewAddress(wallet.EXTERNAL)
+	var senders []btcutil.Address
+	var votes []*wire.MsgTx
+	for i, comment := range []string{"nice", "great"} {
+		entry := UserEntry{
+			ID:          fmt.Sprintf("vote%d", i),
+			Script:      &VoteScript{Txid: fdTxid, Upvote: true, Comment: comment},
+			Address:     addr,
+			Timestamp:   time.Now(),
+			AmountToPay: 100000,
+		}
+		if err := env.listener.NewEntry(addr, entry); err != nil {
+			t.Fatal(err)
+		}
+		env.waitForState(t, PaymentPending)
+		key, sender := env.wallet.NewForeignKey()
+		env.wallet.Notify(paymentTx(t, key, addr, 100000+int64(i)), 0, time.Time{})
+		env.waitForState(t, PaymentBroadcast)
+		broadcasts := env.wallet.Broadcasts()
+		senders = append(senders, sender)
+		votes = append(votes, broadcasts[len(broadcasts)-1])
+	}
+	for _, tx := range votes {
+		env.wallet.Notify(tx, 101, time.Now())
+	}
+
+	for i, tx := range votes {
+		v := new(db.Vote)
+		env.db.Where("txid = ?", tx.TxHash().String()).First(v)
+		if v.Voter != senders[i].String() || v.InputAddresses != addr.String() {
+			t.Errorf("Expected vote paid by %s through %s, got voter %s and inputs %s", senders[i], addr, v.Voter, v.InputAddresses)
+		}
+	}
+	fd := new(db.FileDescriptor)
+	env.db.Where("txid = ?", fdTxid.String()).First(fd)
+	if fd.Upvoters != 2 || fd.Net != 2 {
+		t.Errorf("Expected both site voters to count, got %+v", fd)
+	}
+}
+
+func TestTransactionListener_SiteRevisions(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Every script is paid for through the same site address.
+	addr := env.wallet.NewAddress(wallet.EXTERNAL)
+	publisherKey, publisher := env.wallet.NewForeignKey()
+	otherKey, other := env.wallet.NewForeignKey()
+	pay := func(id string, script Script, key *btcec.PrivateKey, state PaymentState) PaymentStatus {
+		entry := UserEntry{
+			ID:          id,
+			Script:      script,
+			Address:     addr,
+			Timestamp:   time.Now(),
+			AmountToPay: 100000,
+		}
+		if err := env.listener.NewEntry(addr, entry); err != nil {
+			t.Fatal(err)
+		}
+		env.waitForState(t, PaymentPending)
+		env.wallet.Notify(paymentTx(t, key, addr, 100000+int64(len(id))), 0, time.Time{})
+		return env.waitForState(t, state)
+	}
+
+	pay("add", &AddFileScript{Cid: testCid(t), Description: "hello world"}, publisherKey, PaymentBroadcast)
+	broadcasts := env.wallet.Broadcasts()
+	fdTx := broadcasts[len(broadcasts)-1]
+	env.wallet.Notify(fdTx, 100, time.Now())
+	fdTxid := fdTx.TxHash()
+	load := func() *db.FileDescriptor {
+		fd := new(db.FileDescriptor)
+		env.db.Where("txid = ?", fdTxid.String()).First(fd)
+		return fd
+	}
+	if fd := load(); fd.Publisher != publisher.String() {
+		t.Fatalf("Expected publisher %s, got %s", publisher, fd.Publisher)
+	}
+
+	// Someone else paying the site for an edit is refunded.
+	status := pay("spam", &EditFileScript{Txid: fdTxid, Description: "spam spam spam"}, otherKey, PaymentFailed)
+	if status.Error != ErrNotPublisher.Error() {
+		t.Errorf("Expected %q, got %q", ErrNotPublisher, status.Error)
+	}
+	broadcasts = env.wallet.Broadcasts()
+	refundScript, _ := bchutil.PayToAddrScript(other)
+	if refund := broadcasts[len(broadcasts)-1]; len(refund.TxOut) != 1 || !bytes.Equal(refund.TxOut[0].PkScript, refundScript) {
+		t.Error("Expected a refund to the other payer")
+	}
+
+	// The publisher paying the site for an edit is honored.
+	pay("edit", &EditFileScript{Txid: fdTxid, Description: "hello mars"}, publisherKey, PaymentBroadcast)
+	broadcasts = env.wallet.Broadcasts()
+	env.wallet.Notify(broadcasts[len(broadcasts)-1], 101, time.Now())
+	if fd := load(); fd.Description != "hello mars" {
+		t.Errorf("Edit by the publisher not applied: %s", fd.Description)
+	}
+}
+
+func TestTransactionListener_EditFile(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	publisher, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fdTx := fundedBy(t, scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world", Category: "Music"}), publisher)
+	env.wallet.Notify(fdTx, 100, time.Now())
+	fdTxid := fdTx.TxHash()
+	load := func() *db.FileDescriptor {
+		fd := new(db.FileDescriptor)
+		env.db.Where("txid = ?", fdTxid.String()).First(fd)
+		return fd
+	}
+	if fd := load(); fd.Publisher == "" {
+		t.Fatal("Publisher not recorded")
+	}
+
+	// Only the publisher can edit the file.
+	env.wallet.Notify(fundedBy(t, scriptTx(t, &EditFileScript{Txid: fdTxid, Description: "spam spam spam"}), other), 101, time.Now())
+	if fd := load(); fd.Description != "hello world" {
+		t.Errorf("Edit by another key applied: %s", fd.Description)
+	}
+
+	editTx := fundedBy(t, scriptTx(t, &EditFileScript{Txid: fdTxid, Description: "hello mars"}), publisher)
+	env.wallet.Notify(editTx, 0, time.Time{})
+	if fd := load(); fd.Description != "hello world" {
+		t.Errorf("Unconfirmed edit applied: %s", fd.Description)
+	}
+	env.wallet.Notify(editTx, 102, time.Now())
+	if fd := load(); fd.Description != "hello mars" || fd.Category != "Music" {
+		t.Errorf("Edit not applied: %+v", fd)
+	}
+
+	env.wallet.Notify(fundedBy(t, scriptTx(t, &RetractFileScript{Txid: fdTxid}), publisher), 103, time.Now())
+	if fd := load(); !fd.Retracted {
+		t.Error("Retraction not applied")
+	}
+	revisions, err := env.db.Revisions(fdTxid.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || revisions[1].Txid != editTx.TxHash().String() || revisions[2].Action != db.RevisionRetract {
+		t.Errorf("Unexpected revisions %+v", revisions)
+	}
+}
+
+func TestTransactionListener_Payment(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	entry := env.newEntry(t, 100000)
+	key, _ := env.wallet.NewForeignKey()
+
+	env.wallet.Notify(paymentTx(t, key, entry.Address, 40000), 0, time.Time{})
+	status := env.waitForState(t, PaymentPartial)
+	if status.AmountPaid != 40000 {
+		t.Errorf("Expected 40000 paid, got %d", status.AmountPaid)
+	}
+
+	env.wallet.Notify(paymentTx(t, key, entry.Address, 60000), 0, time.Time{})
+	status = env.waitForState(t, PaymentBroadcast)
+
+	broadcasts := env.wallet.Broadcasts()
+	if len(broadcasts) != 1 {
+		t.Fatalf("Expected 1 broadcast transaction, got %d", len(broadcasts))
+	}
+	if status.Txid != broadcasts[0].TxHash().String() {
+		t.Errorf("Status txid %s does not match broadcast %s", status.Txid, broadcasts[0].TxHash().String())
+	}
+	ser, _ := entry.Script.Serialize()
+	found := false
+	for _, out := range broadcasts[0].TxOut {
+		if bytes.Equal(out.PkScript, ser) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Broadcast transaction does not carry the script")
+	}
+	if len(broadcasts[0].TxIn) != 2 {
+		t.Errorf("Expected both payments to be spent, got %d inputs", len(broadcasts[0].TxIn))
+	}
+
+	ps, err := env.listener.PaymentStatus(entry.Address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.State != PaymentBroadcast {
+		t.Errorf("Expected persisted state %s, got %s", PaymentBroadcast, ps.State)
+	}
+}
+
+func TestTransactionListener_StatusNeverBlocks(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Nobody reads the status channel.
+	env.listener.statusChan = make(chan PaymentStatus)
+	addr := env.wallet.NewAddress(wallet.EXTERNAL)
+	key, _ := env.wallet.NewForeignKey()
+	done := make(chan struct{})
+	go func() {
+		env.listener.NewEntry(addr, UserEntry{
+			ID:          addr.String(),
+			Script:      &AddFileScript{Cid: testCid(t), Description: "hello world"},
+			Address:     addr,
+			Timestamp:   time.Now(),
+			AmountToPay: 100000,
+		})
+		env.wallet.Notify(paymentTx(t, key, addr, 40000), 0, time.Time{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Listener blocked on the status channel")
+	}
+}
+
+func TestTransactionListener_PaymentConfirmed(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	entry := env.newEntry(t, 100000)
+	key, _ := env.wallet.NewForeignKey()
+	payment := paymentTx(t, key, entry.Address, 100000)
+	env.wallet.Notify(payment, 0, time.Time{})
+	env.waitForState(t, PaymentBroadcast)
+
+	// The wallet reports the payment again when it confirms and a rescan
+	// replays it, even once the request has been cleaned up. It was spent by
+	// the index transaction so it must not be refunded.
+	env.wallet.Notify(payment, 10, time.Now())
+	env.db.Model(&db.PaymentRequest{}).Where("request_id = ?", entry.ID).UpdateColumn("timestamp", time.Now().Add(-finishedRequestRetention*2))
+	env.listener.cleanup()
+	env.wallet.Notify(payment, 10, time.Now())
+
+	if broadcasts := env.wallet.Broadcasts(); len(broadcasts) != 1 {
+		t.Errorf("Expected only the index transaction, got %d transactions", len(broadcasts))
+	}
+	var refunds []db.Refund
+	env.db.Find(&refunds)
+	if len(refunds) != 0 {
+		t.Errorf("Spent payment refunded: %+v", refunds)
+	}
+}
+
+func TestTransactionListener_InsufficientFunds(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// The payment covers the burn but not the fee.
+	addr := env.wallet.NewAddress(wallet.EXTERNAL)
+	entry := UserEntry{
+		ID:          addr.String(),
+		Script:      &AddFileScript{Cid: testCid(t), Description: "hello world"},
+		Address:     addr,
+		Timestamp:   time.Now(),
+		AmountToPay: 100000,
+		Burn:        100000,
+	}
+	if err := env.listener.NewEntry(addr, entry); err != nil {
+		t.Fatal(err)
+	}
+	env.waitForState(t, PaymentPending)
+	key, sender := env.wallet.NewForeignKey()
+	env.wallet.Notify(paymentTx(t, key, addr, 100000), 0, time.Time{})
+	status := env.waitForState(t, PaymentFailed)
+	if status.Error != ErrInsufficientFunds.Error() {
+		t.Errorf("Expected %q, got %q", ErrInsufficientFunds, status.Error)
+	}
+
+	broadcasts := env.wallet.Broadcasts()
+	refundScript, _ := bchutil.PayToAddrScript(sender)
+	if len(broadcasts) != 1 || len(broadcasts[0].TxOut) != 1 || !bytes.Equal(broadcasts[0].TxOut[0].PkScript, refundScript) {
+		t.Errorf("Expected only a refund to the sender, got %d transactions", len(broadcasts))
+	}
+}
+
+func TestTransactionListener_ExpiredRefund(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	entry := env.newEntry(t, 100000)
+	key, sender := env.wallet.NewForeignKey()
+	env.wallet.Notify(paymentTx(t, key, entry.Address, 40000), 0, time.Time{})
+	env.waitForState(t, PaymentPartial)
+
+	env.listener.lock.Lock()
+	e := env.listener.UserEntries[entry.Address.String()]
+	e.Timestamp = time.Now().Add(-entryExpiry * 2)
+	env.listener.UserEntries[entry.Address.String()] = e
+	env.listener.lock.Unlock()
+
+	env.listener.cleanup()
+	env.waitForState(t, PaymentExpired)
+
+	broadcasts := env.wallet.Broadcasts()
+	if len(broadcasts) != 1 {
+		t.Fatalf("Expected 1 refund transaction, got %d", len(broadcasts))
+	}
+	refundScript, _ := bchutil.PayToAddrScript(sender)
+	if len(broadcasts[0].TxOut) != 1 || !bytes.Equal(broadcasts[0].TxOut[0].PkScript, refundScript) {
+		t.Error("Refund not paid to sender")
+	}
+	refund := new(db.Refund)
+	if env.db.Where("request_id = ?", entry.ID).First(refund).RecordNotFound() {
+		t.Fatal("Refund not recorded")
+	}
+	if refund.Reason != "underpaid" || refund.Address != sender.String() {
+		t.Errorf("Refund recorded incorrectly: %+v", refund)
+	}
+}
+
+func TestTransactionListener_LoadEntries(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	entry := env.newEntry(t, 100000)
+
+	tl := NewTransactionListener(env.wallet, env.db, nil)
+	loaded, ok := tl.UserEntries[entry.Address.String()]
+	if !ok {
+		t.Fatal("Payment request not reloaded")
+	}
+	if loaded.ID != entry.ID || loaded.AmountToPay != entry.AmountToPay {
+		t.Errorf("Payment request reloaded incorrectly: %+v", loaded)
+	}
+	if loaded.Script.Command() != AddFileCommand {
+		t.Error("Payment request script not reloaded")
+	}
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"github.com/cpacia/ipfsindex/db"
+)
+
+// orphanCheckDepth is how far below the chain tip confirmed records are
+// checked against the wallet's chain at startup.
+const orphanCheckDepth = 100
+
+// CheckOrphans compares the block hashes recorded for recently confirmed file
+// descriptors, votes and revisions with the blocks now at their heights and
+// marks those whose block was orphaned as unconfirmed. The wallet reports
+// transactions in orphaned blocks as it disconnects them, so this catches the
+// reorgs which happened while we were shut down. Heights the wallet can't
+// look up are skipped. It returns the number of records rolled back.
+func (l *TransactionListener) CheckOrphans() int {
+	tip, _ := l.wallet.ChainTip()
+	from := uint32(0)
+	if tip > orphanCheckDepth {
+		from = tip - orphanCheckDepth
+	}
+	models := []interface{}{&db.FileDescriptor{}, &db.Vote{}, &db.Revision{}}
+	heights := make(map[uint32]bool)
+	for _, m := range models {
+		var hs []uint32
+		l.db.Model(m).Where("height > ? AND block_hash != ''", from).Pluck("DISTINCT height", &hs)
+		for _, h := range hs {
+			heights[h] = true
+		}
+	}
+
+	orphaned := "height = ? AND block_hash != '' AND block_hash != ?"
+	n := 0
+	for height := range heights {
+		hash, err := l.wallet.BlockHash(height)
+		if err != nil {
+			continue
+		}
+		var fds []db.FileDescriptor
+		l.db.Where(orphaned, height, hash.String()).Find(&fds)
+		for _, fd := range fds {
+			log.Warningf("File descriptor removed from block %s by reorg, tx: %s", fd.BlockHash, fd.Txid)
+			fd.Height, fd.BlockHash = 0, ""
+			l.db.Model(&fd).Updates(map[string]interface{}{"height": 0, "block_hash": ""})
+			l.db.Index(fd.Txid, fd)
+		}
+		var votes []db.Vote
+		l.db.Where(orphaned, height, hash.String()).Find(&votes)
+		for _, v := range votes {
+			log.Warningf("Vote removed from block %s by reorg, tx: %s", v.BlockHash, v.Txid)
+			l.db.Model(&v).Updates(map[string]interface{}{"height": 0, "block_hash": ""})
+			l.updateTally(v.FDTxid)
+		}
+		var revs []db.Revision
+		l.db.Where(orphaned, height, hash.String()).Find(&revs)
+		for _, r := range revs {
+			log.Warningf("%s removed from block %s by reorg, tx: %s", r.Action, r.BlockHash, r.Txid)
+			l.db.Model(&r).Updates(map[string]interface{}{"height": 0, "block_hash": ""})
+			l.applyRevisions(r.FDTxid)
+		}
+		n += len(fds) + len(votes) + len(revs)
+	}
+	return n
+}
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"errors"
+	"github.com/cpacia/ipfsindex/db"
+	"time"
+)
+
+var (
+	ErrRescanRunning     = errors.New("a rescan is already running")
+	ErrRescanNotFound    = errors.New("no rescan found")
+	ErrRescanUnsupported = errors.New("wallet does not support rescanning")
+	ErrRescanFromHeight  = errors.New("wallet can only rescan from a date")
+	ErrRescanStart       = errors.New("must give a height or date to rescan from")
+)
+
+type RescanState string
+
+const (
+	RescanRunning  RescanState = "running"
+	RescanFinished RescanState = "finished"
+	RescanFailed   RescanState = "failed"
+)
+
+// Rescanner is implemented by wallets which can walk the chain again from a
+// point in the past, passing the transactions they find to the transaction
+// listeners as usual. Rescan starts at fromHeight, or at fromDate if
+// fromHeight is zero, and blocks until it reaches the tip, calling progress as
+// it goes.
+type Rescanner interface {
+	Rescan(fromHeight uint32, fromDate time.Time, progress func(height, tip uint32)) error
+}
+
+// ParseRescanDate parses a date given as YYYY-MM-DD or RFC 3339.
+func ParseRescanDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// StartRescan starts rescanning the chain in the background. File descriptors
+// and votes are saved and indexed by ListenBitcoinCash as they are found and
+// the vote tallies are recomputed once the rescan finishes.
+func (l *TransactionListener) StartRescan(fromHeight uint32, fromDate time.Time) (*db.Rescan, error) {
+	if fromHeight == 0 && fromDate.IsZero() {
+		return nil, ErrRescanStart
+	}
+	rescanner, ok := l.wallet.(Rescanner)
+	if !ok {
+		return nil, ErrRescanUnsupported
+	}
+	if !l.claimRescan() {
+		return nil, ErrRescanRunning
+	}
+	r := &db.Rescan{
+		FromHeight: fromHeight,
+		FromDate:   fromDate,
+		State:      string(RescanRunning),
+	}
+	if err := l.db.Create(r).Error; err != nil {
+		l.releaseRescan()
+		return nil, err
+	}
+	go l.runRescan(rescanner, r, fromHeight, fromDate)
+	return r, nil
+}
+
+// ResumeRescan continues a rescan which was interrupted by a shutdown. It
+// returns ErrRescanNotFound if there is nothing to resume.
+func (l *TransactionListener) ResumeRescan() (*db.Rescan, error) {
+	r := new(db.Rescan)
+	if l.db.Where("state = ?", string(RescanRunning)).Order("id desc").First(r).RecordNotFound() {
+		return nil, ErrRescanNotFound
+	}
+	rescanner, ok := l.wallet.(Rescanner)
+	if !ok {
+		return nil, ErrRescanUnsupported
+	}
+	if !l.claimRescan() {
+		return nil, ErrRescanRunning
+	}
+	fromHeight := r.FromHeight
+	if r.Height >= fromHeight && r.Height > 0 {
+		fromHeight = r.Height + 1
+	}
+	log.Infof("Resuming rescan from block %d", fromHeight)
+	go l.runRescan(rescanner, r, fromHeight, r.FromDate)
+	return r, nil
+}
+
+// RescanStatus returns the most recent rescan.
+func (l *TransactionListener) RescanStatus() (*db.Rescan, error) {
+	r := new(db.Rescan)
+	if l.db.Order("id desc").First(r).RecordNotFound() {
+		return nil, ErrRescanNotFound
+	}
+	return r, nil
+}
+
+func (l *TransactionListener) runRescan(rescanner Rescanner, r *db.Rescan, fromHeight uint32, fromDate time.Time) {
+	defer l.releaseRescan()
+	lastSave := time.Now()
+	progress := func(height, tip uint32) {
+		r.Height, r.Tip = height, tip
+		if time.Since(lastSave) > time.Second {
+			l.db.Model(r).UpdateColumns(map[string]interface{}{"height": height, "tip": tip})
+			lastSave = time.Now()
+		}
+	}
+	err := rescanner.Rescan(fromHeight, fromDate, progress)
+	if err == ErrRescanFromHeight && !r.FromDate.IsZero() {
+		// Wallets which can only rescan by date have to start over.
+		err = rescanner.Rescan(0, r.FromDate, progress)
+	}
+	if err == nil {
+		_, err = l.db.RecomputeTallies()
+	}
+	updates := map[string]interface{}{
+		"height": r.Height,
+		"tip":    r.Tip,
+		"state":  string(RescanFinished),
+	}
+	if err != nil {
+		log.Errorf("Rescan failed: %s", err.Error())
+		updates["state"] = string(RescanFailed)
+		updates["error"] = err.Error()
+	} else {
+		log.Infof("Rescan finished at block %d", r.Height)
+	}
+	l.db.Model(r).UpdateColumns(updates)
+}
+
+func (l *TransactionListener) claimRescan() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rescanning {
+		return false
+	}
+	l.rescanning = true
+	return true
+}
+
+func (l *TransactionListener) releaseRescan() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rescanning = false
+}
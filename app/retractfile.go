@@ -0,0 +1,69 @@
+package app
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/cpacia/ipfsindex/db"
+)
+
+const RetractFileCommand Command = 0x04
+
+func init() {
+	RegisterCommand(CommandDef{
+		Command: RetractFileCommand,
+		Name:    "RetractFile",
+		Parse:   parseRetractFile,
+		Handle:  handleRetractFile,
+	})
+}
+
+// RetractFileScript withdraws the file published by Txid. It is only honored
+// if paid for by the publisher of the file, either directly or through a
+// payment request.
+type RetractFileScript struct {
+	Txid    chainhash.Hash
+	Version byte
+	Unknown []DataElement
+}
+
+func (rs *RetractFileScript) Command() Command {
+	return RetractFileCommand
+}
+
+func (rs *RetractFileScript) ID() []byte {
+	return rs.Txid.CloneBytes()
+}
+
+func (rs *RetractFileScript) Parsed() ParsedScript {
+	return ParsedScript{
+		Version: rs.Version,
+		Txid:    rs.Txid,
+		Unknown: rs.Unknown,
+	}
+}
+
+// Serialize serializes the script with the current protocol version.
+func (rs *RetractFileScript) Serialize() ([]byte, error) {
+	builder := newScriptBuilder(RetractFileCommand)
+	txid, err := toBigEndian(&rs.Txid)
+	if err != nil {
+		return []byte{}, err
+	}
+	builder.AddData(append([]byte{byte(Txid)}, txid...))
+	return finishScript(builder, rs.Unknown)
+}
+
+func parseRetractFile(ps ParsedScript) (Script, error) {
+	if ps.Txid.IsEqual(&chainhash.Hash{}) {
+		return nil, ErrInvalidScript
+	}
+	return &RetractFileScript{
+		Txid:    ps.Txid,
+		Version: ps.Version,
+		Unknown: ps.Unknown,
+	}, nil
+}
+
+func handleRetractFile(l *TransactionListener, s ScriptOutput) {
+	rs := s.Script.(*RetractFileScript)
+	handleRevision(l, s, rs.Txid, db.Revision{Action: db.RevisionRetract})
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/cpacia/ipfsindex/db"
+	"time"
+)
+
+var ErrNotPublisher = errors.New("payment not sent by the publisher of the file")
+
+// handleRevision saves a revision of a file if it was paid for by the file's
+// publisher, and applies the file's revisions when the revision confirms or
+// is removed from a block.
+func handleRevision(l *TransactionListener, s ScriptOutput, fdTxid chainhash.Hash, rev db.Revision) {
+	txid := s.Txid.String()
+	ts := time.Now()
+	if s.Tx.Height > 0 {
+		ts = s.Tx.BlockTime
+	}
+	existing := &db.Revision{}
+	if l.db.Where("txid = ?", txid).First(existing).RecordNotFound() {
+		fd := &db.FileDescriptor{}
+		if l.db.Where("txid = ?", fdTxid.String()).First(fd).RecordNotFound() {
+			log.Warningf("Ignoring %s of unknown file %s, tx: %s", rev.Action, fdTxid.String(), txid)
+			return
+		}
+		if fd.Publisher == "" || l.paidBy(s.Txid) != fd.Publisher {
+			log.Warningf("Ignoring %s of file %s not paid for by its publisher, tx: %s", rev.Action, fdTxid.String(), txid)
+			return
+		}
+		rev.FDTxid, rev.Txid, rev.Timestamp = fd.Txid, txid, ts
+		rev.Height, rev.BlockHash, rev.RawScript = confirmedHeight(s.Tx.Height), l.blockHash(s.Tx.Height), s.Output.ScriptPubKey
+		if err := l.db.SaveRevision(&rev); err != nil {
+			log.Errorf("Error saving %s of file %s: %s", rev.Action, fd.Txid, err.Error())
+			return
+		}
+		if s.Tx.Height > 0 {
+			l.applyRevisions(fd.Txid)
+		}
+		log.Debugf("Received %s of file %s, tx: %s", rev.Action, fd.Txid, txid)
+	} else if s.Tx.Height > 0 {
+		l.db.Model(existing).Updates(&db.Revision{Height: uint32(s.Tx.Height), Timestamp: ts, BlockHash: l.blockHash(s.Tx.Height)})
+		l.applyRevisions(existing.FDTxid)
+		log.Debugf("Updated %s with confirmation, tx: %s", existing.Action, txid)
+	} else if existing.Height > 0 {
+		// Updates resets the model, so log the old block first.
+		log.Warningf("%s removed from block %s by reorg, tx: %s", existing.Action, existing.BlockHash, txid)
+		l.db.Model(existing).Updates(map[string]interface{}{"height": 0, "block_hash": ""})
+		l.applyRevisions(existing.FDTxid)
+	}
+}
+
+// checkRevision returns ErrNotPublisher if script revises a file and payer
+// isn't its publisher, since the revision would be ignored.
+func (l *TransactionListener) checkRevision(script Script, payer string) error {
+	var fdTxid chainhash.Hash
+	switch s := script.(type) {
+	case *EditFileScript:
+		fdTxid = s.Txid
+	case *RetractFileScript:
+		fdTxid = s.Txid
+	default:
+		return nil
+	}
+	fd := &db.FileDescriptor{}
+	if l.db.Where("txid = ?", fdTxid.String()).First(fd).RecordNotFound() || fd.Publisher == "" || fd.Publisher != payer {
+		return ErrNotPublisher
+	}
+	return nil
+}
+
+func (l *TransactionListener) applyRevisions(fdTxid string) {
+	if err := l.db.ApplyRevisions(fdTxid); err != nil {
+		log.Errorf("Error applying revisions of %s: %s", fdTxid, err.Error())
+	}
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// RPCError is an error returned by the node in a JSON-RPC response.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+	ID     uint64          `json:"id"`
+}
+
+// rpcClient is a minimal client for the bitcoind JSON-RPC interface.
+type rpcClient struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+	id       uint64
+}
+
+func newRPCClient(url, user, password string) *rpcClient {
+	return &rpcClient{
+		url:      url,
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: time.Minute},
+	}
+}
+
+// call invokes method with params and decodes the result into result, which
+// may be nil if the result is not needed.
+func (c *rpcClient) call(method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(&rpcRequest{
+		JSONRPC: "1.0",
+		ID:      atomic.AddUint64(&c.id, 1),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.user != "" || c.password != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// bitcoind returns errors with a 404 or 500 status but a JSON body, so
+	// only bail out early if the body can't be decoded.
+	rpcResp := new(rpcResponse)
+	if err := json.NewDecoder(resp.Body).Decode(rpcResp); err != nil {
+		return fmt.Errorf("rpc %s: %s", method, resp.Status)
+	}
+	if rpcResp.Error != nil {
+		return rpcResp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(rpcResp.Result, result)
+}
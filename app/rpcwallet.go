@@ -0,0 +1,673 @@
+package app
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/OpenBazaar/wallet-interface"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/bchutil"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval = time.Second * 10
+
+	// maxReorgDepth is the number of recent blocks remembered so that their
+	// transactions can be reported as unconfirmed if the blocks are orphaned.
+	maxReorgDepth = 100
+
+	// maxCachedTxns is the number of transactions passed to the listeners
+	// which are remembered for GetTransaction. Older ones are fetched from the
+	// node.
+	maxCachedTxns = 10000
+
+	rpcStateFile = "rpcwallet.json"
+)
+
+type RPCWalletConfig struct {
+	URL      string
+	User     string
+	Password string
+	Params   *chaincfg.Params
+
+	// RepoPath is where the scan progress and our addresses are saved. If
+	// empty nothing is persisted.
+	RepoPath string
+
+	// StartHeight is the block to start scanning from the first time the
+	// wallet is used. If zero scanning starts at the current tip.
+	StartHeight uint32
+
+	PollInterval  time.Duration
+	ExchangeRates wallet.ExchangeRates
+}
+
+// RPCWallet implements Wallet using the JSON-RPC interface of a full node.
+// Blocks and the mempool are polled for our scripts and for payments to our
+// addresses rather than relying on SPV peers to filter them for us. Addresses
+// and keys come from the node's wallet.
+type RPCWallet struct {
+	rpc           *rpcClient
+	params        *chaincfg.Params
+	statePath     string
+	pollInterval  time.Duration
+	exchangeRates wallet.ExchangeRates
+
+	addresses map[string]bool
+	current   map[wallet.KeyPurpose]btcutil.Address
+	stale     map[wallet.KeyPurpose]bool
+	height    uint32
+	tipHash   chainhash.Hash
+	blocks    []scannedBlock
+	mempool   map[string]bool
+	txns      map[chainhash.Hash]wallet.Txn
+	txnOrder  []chainhash.Hash
+	listeners []func(wallet.TransactionCallback)
+	done      chan struct{}
+	lock      sync.RWMutex
+
+	// scanLock is held while scanning so that a rescan and the poller
+	// never call the listeners at the same time.
+	scanLock sync.Mutex
+}
+
+// scannedBlock is a recently connected block along with the transactions in
+// it which were passed to the listeners.
+type scannedBlock struct {
+	height uint32
+	hash   chainhash.Hash
+	txs    []*wire.MsgTx
+}
+
+type rpcWalletState struct {
+	Height    uint32   `json:"height"`
+	Hash      string   `json:"hash"`
+	Addresses []string `json:"addresses"`
+}
+
+var (
+	_ Wallet    = (*RPCWallet)(nil)
+	_ Rescanner = (*RPCWallet)(nil)
+)
+
+func NewRPCWallet(config RPCWalletConfig) (*RPCWallet, error) {
+	w := &RPCWallet{
+		rpc:           newRPCClient(config.URL, config.User, config.Password),
+		params:        config.Params,
+		pollInterval:  config.PollInterval,
+		exchangeRates: config.ExchangeRates,
+		addresses:     make(map[string]bool),
+		current:       make(map[wallet.KeyPurpose]btcutil.Address),
+		stale:         make(map[wallet.KeyPurpose]bool),
+		mempool:       make(map[string]bool),
+		txns:          make(map[chainhash.Hash]wallet.Txn),
+		done:          make(chan struct{}),
+	}
+	if w.pollInterval == 0 {
+		w.pollInterval = defaultPollInterval
+	}
+	if config.RepoPath != "" {
+		os.MkdirAll(config.RepoPath, os.ModePerm)
+		w.statePath = path.Join(config.RepoPath, rpcStateFile)
+	}
+
+	var tip uint32
+	if err := w.rpc.call("getblockcount", &tip); err != nil {
+		return nil, err
+	}
+	loaded, err := w.loadState()
+	if err != nil {
+		return nil, err
+	}
+	if !loaded {
+		if config.StartHeight > 0 {
+			w.height = config.StartHeight - 1
+		} else {
+			w.height = tip
+		}
+	}
+
+	for _, purpose := range []wallet.KeyPurpose{wallet.EXTERNAL, wallet.INTERNAL} {
+		addr, err := w.newAddress(purpose)
+		if err != nil {
+			return nil, err
+		}
+		w.current[purpose] = addr
+	}
+	return w, nil
+}
+
+func (w *RPCWallet) Params() *chaincfg.Params {
+	return w.params
+}
+
+// CurrentAddress returns the same address for a purpose until it receives a
+// payment, after which a new address is fetched from the node. If the node
+// can't be reached the old address is returned.
+func (w *RPCWallet) CurrentAddress(purpose wallet.KeyPurpose) btcutil.Address {
+	w.lock.RLock()
+	addr, stale := w.current[purpose], w.stale[purpose]
+	w.lock.RUnlock()
+	if !stale {
+		return addr
+	}
+	newAddr, err := w.newAddress(purpose)
+	if err != nil {
+		log.Errorf("Error fetching new address from node: %s", err.Error())
+		return addr
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.current[purpose] = newAddr
+	delete(w.stale, purpose)
+	return newAddr
+}
+
+func (w *RPCWallet) newAddress(purpose wallet.KeyPurpose) (btcutil.Address, error) {
+	method := "getnewaddress"
+	if purpose == wallet.INTERNAL {
+		method = "getrawchangeaddress"
+	}
+	var a string
+	if err := w.rpc.call(method, &a); err != nil {
+		return nil, err
+	}
+	addr, err := w.DecodeAddress(a)
+	if err != nil {
+		return nil, err
+	}
+	w.lock.Lock()
+	w.addresses[addr.String()] = true
+	w.lock.Unlock()
+	return addr, nil
+}
+
+func (w *RPCWallet) DecodeAddress(addr string) (btcutil.Address, error) {
+	return bchutil.DecodeAddress(addr, w.params)
+}
+
+func (w *RPCWallet) ScriptToAddress(script []byte) (btcutil.Address, error) {
+	return bchutil.ExtractPkScriptAddrs(script, w.params)
+}
+
+// GetKey fetches the key for addr from the node. The node's wallet must be
+// unlocked.
+func (w *RPCWallet) GetKey(addr btcutil.Address) (*btcec.PrivateKey, error) {
+	var s string
+	if err := w.rpc.call("dumpprivkey", &s, addr.String()); err != nil {
+		return nil, err
+	}
+	wif, err := btcutil.DecodeWIF(s)
+	if err != nil {
+		return nil, err
+	}
+	return wif.PrivKey, nil
+}
+
+// GetFeePerByte returns the node's fee estimate. The fee level is ignored as
+// Bitcoin Cash nodes only give a single estimate.
+func (w *RPCWallet) GetFeePerByte(feeLevel wallet.FeeLevel) uint64 {
+	var perKB float64
+	if err := w.rpc.call("estimatefee", &perKB); err != nil {
+		log.Errorf("Error estimating fee: %s", err.Error())
+		return 1
+	}
+	fee := uint64(perKB * 100000000 / 1000)
+	if fee < 1 {
+		return 1
+	}
+	return fee
+}
+
+// GetTransaction returns a transaction we have passed to the listeners, or
+// failing that asks the node for it.
+func (w *RPCWallet) GetTransaction(txid chainhash.Hash) (wallet.Txn, error) {
+	w.lock.RLock()
+	txn, ok := w.txns[txid]
+	w.lock.RUnlock()
+	if ok {
+		return txn, nil
+	}
+	resp := struct {
+		Hex           string `json:"hex"`
+		Confirmations uint32 `json:"confirmations"`
+		Time          int64  `json:"time"`
+	}{}
+	if err := w.rpc.call("getrawtransaction", &resp, txid.String(), true); err != nil {
+		return txn, err
+	}
+	b, err := hex.DecodeString(resp.Hex)
+	if err != nil {
+		return txn, err
+	}
+	txn = wallet.Txn{
+		Txid:      txid.String(),
+		Timestamp: time.Now(),
+		Bytes:     b,
+	}
+	if resp.Confirmations > 0 {
+		tip, _ := w.ChainTip()
+		txn.Height = int32(tip) - int32(resp.Confirmations) + 1
+		txn.Timestamp = time.Unix(resp.Time, 0)
+	}
+	return txn, nil
+}
+
+func (w *RPCWallet) Broadcast(tx *wire.MsgTx) error {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return err
+	}
+	return w.rpc.call("sendrawtransaction", nil, hex.EncodeToString(buf.Bytes()))
+}
+
+// ChainTip returns the last block scanned, which may be behind the node.
+func (w *RPCWallet) ChainTip() (uint32, chainhash.Hash) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.height, w.tipHash
+}
+
+// BlockHash returns the hash of the block at height in the node's main chain.
+// Recently scanned blocks are answered from memory so that listeners see the
+// block they were notified of even if the node has since reorged.
+func (w *RPCWallet) BlockHash(height uint32) (chainhash.Hash, error) {
+	w.lock.RLock()
+	for _, b := range w.blocks {
+		if b.height == height {
+			w.lock.RUnlock()
+			return b.hash, nil
+		}
+	}
+	w.lock.RUnlock()
+	var hash string
+	if err := w.rpc.call("getblockhash", &hash, height); err != nil {
+		return chainhash.Hash{}, err
+	}
+	ch, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	return *ch, nil
+}
+
+func (w *RPCWallet) ExchangeRates() wallet.ExchangeRates {
+	return w.exchangeRates
+}
+
+func (w *RPCWallet) AddTransactionListener(listener func(wallet.TransactionCallback)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.listeners = append(w.listeners, listener)
+}
+
+func (w *RPCWallet) Start() {
+	go w.run()
+}
+
+func (w *RPCWallet) Close() {
+	close(w.done)
+}
+
+func (w *RPCWallet) run() {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.poll(); err != nil {
+			log.Errorf("Error polling node: %s", err.Error())
+		}
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// poll rolls back any orphaned blocks, scans the blocks connected since the
+// last poll and then scans the mempool.
+func (w *RPCWallet) poll() error {
+	w.scanLock.Lock()
+	defer w.scanLock.Unlock()
+	var tip uint32
+	if err := w.rpc.call("getblockcount", &tip); err != nil {
+		return err
+	}
+	if err := w.disconnectOrphans(tip); err != nil {
+		return err
+	}
+	for {
+		height, _ := w.ChainTip()
+		if height >= tip {
+			break
+		}
+		if err := w.connectBlock(height + 1); err != nil {
+			return err
+		}
+	}
+	if err := w.scanMempool(); err != nil {
+		return err
+	}
+	return w.saveState()
+}
+
+// disconnectOrphans walks back from our tip until it finds a block which is
+// still in the node's main chain. The transactions in each orphaned block are
+// reported again as unconfirmed.
+func (w *RPCWallet) disconnectOrphans(tip uint32) error {
+	for len(w.blocks) > 0 {
+		last := w.blocks[len(w.blocks)-1]
+		if last.height <= tip {
+			var hash string
+			if err := w.rpc.call("getblockhash", &hash, last.height); err != nil {
+				return err
+			}
+			if hash == last.hash.String() {
+				return nil
+			}
+		}
+		w.lock.Lock()
+		w.blocks = w.blocks[:len(w.blocks)-1]
+		w.height = last.height - 1
+		w.tipHash = chainhash.Hash{}
+		if len(w.blocks) > 0 {
+			w.tipHash = w.blocks[len(w.blocks)-1].hash
+		}
+		w.lock.Unlock()
+		log.Warningf("Block %s at height %d orphaned", last.hash.String(), last.height)
+		for _, tx := range last.txs {
+			w.notify(tx, 0, time.Time{})
+		}
+	}
+	return nil
+}
+
+func (w *RPCWallet) connectBlock(height uint32) error {
+	block, err := w.fetchBlock(height)
+	if err != nil {
+		return err
+	}
+	sb := scannedBlock{height: height, hash: block.BlockHash()}
+	for _, tx := range block.Transactions {
+		if w.relevant(tx) {
+			sb.txs = append(sb.txs, tx)
+		}
+	}
+
+	// The tip is updated before the listeners are called so that they see
+	// this block as the tip, as they would with the SPV wallet.
+	w.lock.Lock()
+	w.height = height
+	w.tipHash = sb.hash
+	w.blocks = append(w.blocks, sb)
+	if len(w.blocks) > maxReorgDepth {
+		w.blocks = w.blocks[len(w.blocks)-maxReorgDepth:]
+	}
+	w.lock.Unlock()
+	for _, tx := range sb.txs {
+		w.notify(tx, int32(height), block.Header.Timestamp)
+	}
+	return nil
+}
+
+func (w *RPCWallet) fetchBlock(height uint32) (*wire.MsgBlock, error) {
+	var hash, blockHex string
+	if err := w.rpc.call("getblockhash", &hash, height); err != nil {
+		return nil, err
+	}
+	if err := w.rpc.call("getblock", &blockHex, hash, false); err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return nil, err
+	}
+	block := new(wire.MsgBlock)
+	if err := block.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Rescan passes the matching transactions in every block from the start up to
+// the last block scanned by the poller when the rescan started to the
+// listeners again. Blocks connected since are left to the poller. Each block
+// is scanned while holding the scan lock so the poller can carry on between
+// blocks without calling the listeners concurrently.
+func (w *RPCWallet) Rescan(fromHeight uint32, fromDate time.Time, progress func(height, tip uint32)) error {
+	if fromHeight == 0 {
+		height, err := w.heightForDate(fromDate)
+		if err != nil {
+			return err
+		}
+		fromHeight = height
+	}
+	end, _ := w.ChainTip()
+	for height := fromHeight; height <= end; height++ {
+		select {
+		case <-w.done:
+			return errors.New("wallet closed")
+		default:
+		}
+		if err := w.rescanBlock(height); err != nil {
+			return err
+		}
+		progress(height, end)
+	}
+	return nil
+}
+
+// rescanBlock passes the matching transactions in the block at height to the
+// listeners again unless a reorg has since moved our tip below it.
+func (w *RPCWallet) rescanBlock(height uint32) error {
+	w.scanLock.Lock()
+	defer w.scanLock.Unlock()
+	if tip, _ := w.ChainTip(); height > tip {
+		return nil
+	}
+	block, err := w.fetchBlock(height)
+	if err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions {
+		if w.relevant(tx) {
+			w.notify(tx, int32(height), block.Header.Timestamp)
+		}
+	}
+	return nil
+}
+
+// heightForDate returns the height of the first block with a timestamp at or
+// after t.
+func (w *RPCWallet) heightForDate(t time.Time) (uint32, error) {
+	lo, hi := uint32(0), uint32(0)
+	if err := w.rpc.call("getblockcount", &hi); err != nil {
+		return 0, err
+	}
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		var hash string
+		if err := w.rpc.call("getblockhash", &hash, mid); err != nil {
+			return 0, err
+		}
+		header := struct {
+			Time int64 `json:"time"`
+		}{}
+		if err := w.rpc.call("getblockheader", &header, hash, true); err != nil {
+			return 0, err
+		}
+		if time.Unix(header.Time, 0).Before(t) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+func (w *RPCWallet) scanMempool() error {
+	var txids []string
+	if err := w.rpc.call("getrawmempool", &txids); err != nil {
+		return err
+	}
+	mempool := make(map[string]bool)
+	for _, txid := range txids {
+		mempool[txid] = true
+		if w.mempool[txid] {
+			continue
+		}
+		var txHex string
+		if err := w.rpc.call("getrawtransaction", &txHex, txid, false); err != nil {
+			// It may have been mined or evicted since we listed the mempool.
+			continue
+		}
+		b, err := hex.DecodeString(txHex)
+		if err != nil {
+			return err
+		}
+		tx := new(wire.MsgTx)
+		if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+			return err
+		}
+		if w.relevant(tx) {
+			w.notify(tx, 0, time.Time{})
+		}
+	}
+	w.mempool = mempool
+	return nil
+}
+
+// relevant returns whether tx carries one of our scripts or pays to one of our
+// addresses. Addresses which receive a payment are retired.
+func (w *RPCWallet) relevant(tx *wire.MsgTx) bool {
+	found := false
+	for _, out := range tx.TxOut {
+		if HasFlag(out.PkScript) {
+			found = true
+			continue
+		}
+		addr, err := w.ScriptToAddress(out.PkScript)
+		if err != nil {
+			continue
+		}
+		w.lock.Lock()
+		if w.addresses[addr.String()] {
+			found = true
+			for purpose, current := range w.current {
+				if current.String() == addr.String() {
+					w.stale[purpose] = true
+				}
+			}
+		}
+		w.lock.Unlock()
+	}
+	return found
+}
+
+func (w *RPCWallet) notify(tx *wire.MsgTx, height int32, blockTime time.Time) {
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+	txid := tx.TxHash()
+	cb := wallet.TransactionCallback{
+		Txid:      txid.CloneBytes(),
+		Height:    height,
+		Timestamp: time.Now(),
+		BlockTime: blockTime,
+	}
+	for i, out := range tx.TxOut {
+		cb.Outputs = append(cb.Outputs, wallet.TransactionOutput{
+			ScriptPubKey: out.PkScript,
+			Value:        out.Value,
+			Index:        uint32(i),
+		})
+	}
+	for _, in := range tx.TxIn {
+		cb.Inputs = append(cb.Inputs, wallet.TransactionInput{
+			OutpointHash:  in.PreviousOutPoint.Hash.CloneBytes(),
+			OutpointIndex: in.PreviousOutPoint.Index,
+		})
+	}
+
+	w.lock.Lock()
+	if _, ok := w.txns[txid]; !ok {
+		w.txnOrder = append(w.txnOrder, txid)
+		if len(w.txnOrder) > maxCachedTxns {
+			delete(w.txns, w.txnOrder[0])
+			w.txnOrder = w.txnOrder[1:]
+		}
+	}
+	w.txns[txid] = wallet.Txn{
+		Txid:      txid.String(),
+		Height:    height,
+		Timestamp: cb.Timestamp,
+		Bytes:     buf.Bytes(),
+	}
+	listeners := append([]func(wallet.TransactionCallback){}, w.listeners...)
+	w.lock.Unlock()
+	for _, l := range listeners {
+		l(cb)
+	}
+}
+
+// loadState restores the scan progress and addresses saved by a previous run.
+// It returns false if there was nothing to load.
+func (w *RPCWallet) loadState() (bool, error) {
+	if w.statePath == "" {
+		return false, nil
+	}
+	b, err := ioutil.ReadFile(w.statePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	state := new(rpcWalletState)
+	if err := json.Unmarshal(b, state); err != nil {
+		return false, err
+	}
+	hash, err := chainhash.NewHashFromStr(state.Hash)
+	if err != nil {
+		return false, errors.New("invalid block hash in " + w.statePath)
+	}
+	w.height = state.Height
+	w.tipHash = *hash
+	if state.Height > 0 && *hash != (chainhash.Hash{}) {
+		// We don't know which of its transactions were reported but we can
+		// at least notice if it was orphaned while we were down.
+		w.blocks = []scannedBlock{{height: state.Height, hash: *hash}}
+	}
+	for _, a := range state.Addresses {
+		w.addresses[a] = true
+	}
+	return true, nil
+}
+
+func (w *RPCWallet) saveState() error {
+	if w.statePath == "" {
+		return nil
+	}
+	w.lock.RLock()
+	state := rpcWalletState{
+		Height: w.height,
+		Hash:   w.tipHash.String(),
+	}
+	for a := range w.addresses {
+		state.Addresses = append(state.Addresses, a)
+	}
+	w.lock.RUnlock()
+	b, err := json.MarshalIndent(&state, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(w.statePath, b, 0644)
+}
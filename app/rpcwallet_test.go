@@ -0,0 +1,430 @@
+package app
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/OpenBazaar/wallet-interface"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/bchutil"
+	"github.com/cpacia/ipfsindex/db"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNode serves the subset of the bitcoind JSON-RPC interface used by
+// RPCWallet.
+type fakeNode struct {
+	params    *chaincfg.Params
+	blocks    []*wire.MsgBlock
+	mempool   []*wire.MsgTx
+	keys      map[string]*btcec.PrivateKey
+	broadcast []*wire.MsgTx
+	nonce     uint32
+	lock      sync.Mutex
+}
+
+func newFakeNode(t *testing.T) (*fakeNode, *httptest.Server) {
+	n := &fakeNode{
+		params: &chaincfg.RegressionNetParams,
+		keys:   make(map[string]*btcec.PrivateKey),
+	}
+	n.mine()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := new(rpcRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Error(err)
+			return
+		}
+		result, rpcErr := n.handle(req.Method, req.Params)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"result": result,
+			"error":  rpcErr,
+			"id":     req.ID,
+		})
+	}))
+	return n, server
+}
+
+func (n *fakeNode) handle(method string, params []interface{}) (interface{}, *RPCError) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	switch method {
+	case "getblockcount":
+		return len(n.blocks) - 1, nil
+	case "getblockhash":
+		height := int(params[0].(float64))
+		if height >= len(n.blocks) {
+			return nil, &RPCError{-8, "Block height out of range"}
+		}
+		return n.blocks[height].BlockHash().String(), nil
+	case "getblockheader":
+		for _, b := range n.blocks {
+			if b.BlockHash().String() == params[0].(string) {
+				return map[string]interface{}{"time": b.Header.Timestamp.Unix()}, nil
+			}
+		}
+		return nil, &RPCError{-5, "Block not found"}
+	case "getblock":
+		for _, b := range n.blocks {
+			if b.BlockHash().String() == params[0].(string) {
+				var buf bytes.Buffer
+				b.Serialize(&buf)
+				return hex.EncodeToString(buf.Bytes()), nil
+			}
+		}
+		return nil, &RPCError{-5, "Block not found"}
+	case "getrawmempool":
+		txids := []string{}
+		for _, tx := range n.mempool {
+			txids = append(txids, tx.TxHash().String())
+		}
+		return txids, nil
+	case "getrawtransaction":
+		for _, tx := range n.mempool {
+			if tx.TxHash().String() == params[0].(string) {
+				var buf bytes.Buffer
+				tx.Serialize(&buf)
+				return hex.EncodeToString(buf.Bytes()), nil
+			}
+		}
+		return nil, &RPCError{-5, "No such mempool transaction"}
+	case "sendrawtransaction":
+		b, _ := hex.DecodeString(params[0].(string))
+		tx := new(wire.MsgTx)
+		tx.Deserialize(bytes.NewReader(b))
+		n.broadcast = append(n.broadcast, tx)
+		n.mempool = append(n.mempool, tx)
+		return tx.TxHash().String(), nil
+	case "getnewaddress", "getrawchangeaddress":
+		key, _ := btcec.NewPrivateKey(btcec.S256())
+		addr, _ := bchutil.NewCashAddressPubKeyHash(btcutil.Hash160(key.PubKey().SerializeCompressed()), n.params)
+		n.keys[addr.String()] = key
+		return addr.String(), nil
+	case "dumpprivkey":
+		key, ok := n.keys[params[0].(string)]
+		if !ok {
+			return nil, &RPCError{-4, "Private key for address is not known"}
+		}
+		wif, _ := btcutil.NewWIF(key, n.params, true)
+		return wif.String(), nil
+	case "estimatefee":
+		return 0.00002, nil
+	}
+	return nil, &RPCError{-32601, "Method not found"}
+}
+
+// mine connects a block containing txs along with any transactions in the
+// mempool.
+func (n *fakeNode) mine(txs ...*wire.MsgTx) *wire.MsgBlock {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	header := wire.BlockHeader{
+		Timestamp: time.Unix(1500000000+int64(len(n.blocks))*600, 0),
+		Nonce:     n.nonce,
+	}
+	n.nonce++
+	if len(n.blocks) > 0 {
+		header.PrevBlock = n.blocks[len(n.blocks)-1].BlockHash()
+	}
+	block := wire.NewMsgBlock(&header)
+	for _, tx := range append(n.mempool, txs...) {
+		block.AddTransaction(tx)
+	}
+	n.mempool = nil
+	n.blocks = append(n.blocks, block)
+	return block
+}
+
+// orphan removes the tip and returns its transactions to the mempool.
+func (n *fakeNode) orphan() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	tip := n.blocks[len(n.blocks)-1]
+	n.blocks = n.blocks[:len(n.blocks)-1]
+	n.mempool = append(n.mempool, tip.Transactions...)
+}
+
+func (n *fakeNode) addToMempool(tx *wire.MsgTx) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.mempool = append(n.mempool, tx)
+}
+
+func newTestRPCWallet(t *testing.T, url, repoPath string) (*RPCWallet, *[]wallet.TransactionCallback) {
+	w, err := NewRPCWallet(RPCWalletConfig{
+		URL:      url,
+		User:     "user",
+		Password: "pass",
+		Params:   &chaincfg.RegressionNetParams,
+		RepoPath: repoPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var callbacks []wallet.TransactionCallback
+	w.AddTransactionListener(func(cb wallet.TransactionCallback) {
+		callbacks = append(callbacks, cb)
+	})
+	return w, &callbacks
+}
+
+func TestRPCWallet_Scan(t *testing.T) {
+	node, server := newFakeNode(t)
+	defer server.Close()
+	w, callbacks := newTestRPCWallet(t, server.URL, "")
+
+	addFile := scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world"})
+	unrelated := wire.NewMsgTx(wire.TxVersion)
+	unrelated.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{0x03}, 0), nil, nil))
+	unrelated.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+
+	node.addToMempool(addFile)
+	node.addToMempool(unrelated)
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*callbacks) != 1 || (*callbacks)[0].Height != 0 {
+		t.Fatalf("Expected one unconfirmed callback, got %d", len(*callbacks))
+	}
+
+	// Polling again must not report the mempool transaction twice.
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*callbacks) != 1 {
+		t.Fatalf("Mempool transaction reported %d times", len(*callbacks))
+	}
+
+	block := node.mine()
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*callbacks) != 2 {
+		t.Fatalf("Expected confirmation callback, got %d callbacks", len(*callbacks))
+	}
+	cb := (*callbacks)[1]
+	txid := addFile.TxHash()
+	if cb.Height != 1 || !cb.BlockTime.Equal(block.Header.Timestamp) || !bytes.Equal(cb.Txid, txid.CloneBytes()) {
+		t.Errorf("Unexpected confirmation callback: height %d, block time %s", cb.Height, cb.BlockTime)
+	}
+	if height, hash := w.ChainTip(); height != 1 || hash != block.BlockHash() {
+		t.Errorf("Unexpected chain tip: %d %s", height, hash.String())
+	}
+
+	// Reorg
+	node.orphan()
+	node.mine()
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	var heights []int32
+	for _, cb := range (*callbacks)[2:] {
+		heights = append(heights, cb.Height)
+	}
+	if len(heights) != 2 || heights[0] != 0 || heights[1] != 1 {
+		t.Errorf("Expected orphaned transaction to be reported unconfirmed then confirmed again, got heights %v", heights)
+	}
+}
+
+func TestRPCWallet_Payment(t *testing.T) {
+	node, server := newFakeNode(t)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "ipfsindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, callbacks := newTestRPCWallet(t, server.URL, dir)
+
+	addr := w.CurrentAddress(wallet.EXTERNAL)
+	if w.CurrentAddress(wallet.EXTERNAL).String() != addr.String() {
+		t.Error("Current address changed before it was used")
+	}
+	if _, err := w.GetKey(addr); err != nil {
+		t.Fatal(err)
+	}
+	script, _ := bchutil.PayToAddrScript(addr)
+	payment := wire.NewMsgTx(wire.TxVersion)
+	payment.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{0x04}, 0), nil, nil))
+	payment.AddTxOut(wire.NewTxOut(100000, script))
+	node.mine(payment)
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*callbacks) != 1 || (*callbacks)[0].Height != 1 {
+		t.Fatalf("Payment not reported")
+	}
+	if w.CurrentAddress(wallet.EXTERNAL).String() == addr.String() {
+		t.Error("Current address not changed after it was used")
+	}
+	if fee := w.GetFeePerByte(wallet.NORMAL); fee != 2 {
+		t.Errorf("Expected fee of 2 sats per byte, got %d", fee)
+	}
+
+	paymentHash := payment.TxHash()
+	utxos := []wallet.Utxo{{Op: *wire.NewOutPoint(&paymentHash, 0), Value: 100000, ScriptPubkey: script}}
+	hash, amount, err := MakeRefund(w, utxos, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.broadcast) != 1 || node.broadcast[0].TxHash() != *hash || amount <= 0 {
+		t.Error("Refund not broadcast through the node")
+	}
+
+	// The scan height and our addresses survive a restart.
+	reloaded, _ := newTestRPCWallet(t, server.URL, dir)
+	if height, _ := reloaded.ChainTip(); height != 1 {
+		t.Errorf("Expected to resume from height 1, got %d", height)
+	}
+	if !reloaded.addresses[addr.String()] {
+		t.Error("Addresses not reloaded")
+	}
+}
+
+func TestRPCWallet_Rescan(t *testing.T) {
+	node, server := newFakeNode(t)
+	defer server.Close()
+	addFile := scriptTx(t, &AddFileScript{Cid: testCid(t), Description: "hello world"})
+	node.mine(addFile)
+	node.mine()
+
+	dir, err := ioutil.TempDir("", "ipfsindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	database, err := db.NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// The wallet starts at the tip so it never sees the descriptor unless
+	// we rescan.
+	w, _ := newTestRPCWallet(t, server.URL, "")
+	tl := NewTransactionListener(w, database, nil)
+	w.AddTransactionListener(tl.ListenBitcoinCash)
+
+	if _, err := tl.StartRescan(0, time.Time{}); err != ErrRescanStart {
+		t.Errorf("Expected ErrRescanStart, got %v", err)
+	}
+	if _, err := tl.StartRescan(1, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	var r *db.Rescan
+	for i := 0; i < 50; i++ {
+		r, err = tl.RescanStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.State != string(RescanRunning) {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if r.State != string(RescanFinished) || r.Height != 2 {
+		t.Fatalf("Expected rescan to finish at block 2, got state %s at block %d", r.State, r.Height)
+	}
+	fd := new(db.FileDescriptor)
+	if database.Where("txid = ?", addFile.TxHash().String()).First(fd).RecordNotFound() {
+		t.Fatal("Rescan did not save the file descriptor")
+	}
+	// The block hash is recorded even though block 1 isn't the tip.
+	if fd.Height != 1 || fd.BlockHash != node.blocks[1].BlockHash().String() {
+		t.Errorf("Expected file descriptor in block 1, got height %d and block %s", fd.Height, fd.BlockHash)
+	}
+	if ids, _, _ := database.Query("hello", 10, 0); len(ids) != 1 {
+		t.Error("Rescan did not index the file descriptor")
+	}
+}
+
+func TestRPCWallet_TxnCache(t *testing.T) {
+	_, server := newFakeNode(t)
+	defer server.Close()
+	w, _ := newTestRPCWallet(t, server.URL, "")
+
+	var first chainhash.Hash
+	for i := 0; i <= maxCachedTxns; i++ {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{0x03}, uint32(i)), nil, nil))
+		if i == 0 {
+			first = tx.TxHash()
+			// Seeing a transaction again doesn't make room for it twice.
+			w.notify(tx, 0, time.Time{})
+		}
+		w.notify(tx, 1, time.Time{})
+	}
+	if len(w.txns) != maxCachedTxns || len(w.txnOrder) != maxCachedTxns {
+		t.Errorf("Expected %d cached transactions, got %d", maxCachedTxns, len(w.txns))
+	}
+	if _, ok := w.txns[first]; ok {
+		t.Error("Oldest transaction not evicted")
+	}
+}
+
+func TestRPCWallet_RescanWhilePolling(t *testing.T) {
+	node, server := newFakeNode(t)
+	defer server.Close()
+	for i := 0; i < 5; i++ {
+		node.mine(scriptTx(t, &AddFileScript{Cid: testCid(t), Description: fmt.Sprintf("file %d", i)}))
+	}
+	w, _ := newTestRPCWallet(t, server.URL, "")
+
+	// The listener notices if it's ever called concurrently.
+	var active, overlaps int32
+	w.AddTransactionListener(func(cb wallet.TransactionCallback) {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	})
+	done := make(chan error)
+	go func() {
+		done <- w.Rescan(1, time.Time{}, func(height, tip uint32) {})
+	}()
+	for i := 0; i < 5; i++ {
+		node.mine(scriptTx(t, &AddFileScript{Cid: testCid(t), Description: fmt.Sprintf("new file %d", i)}))
+		if err := w.poll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if overlaps != 0 {
+		t.Errorf("Listener called concurrently %d times", overlaps)
+	}
+}
+
+func TestRPCWallet_HeightForDate(t *testing.T) {
+	node, server := newFakeNode(t)
+	defer server.Close()
+	for i := 0; i < 9; i++ {
+		node.mine()
+	}
+	w, _ := newTestRPCWallet(t, server.URL, "")
+	height, err := w.heightForDate(node.blocks[4].Header.Timestamp.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 4 {
+		t.Errorf("Expected height 4, got %d", height)
+	}
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -16,28 +17,38 @@ var (
 	ErrInvalidPushData = errors.New("invalid pushdata")
 )
 
+// Scripts are OP_RETURN outputs beginning with a push of the flag byte, the
+// protocol version and the command, followed by a push for each data element
+// holding its DataType and value:
+//
+//	OP_RETURN OP_DATA_3 FlagByte <version> <command> <type><value>...
+//
+// Scripts published before the version was added have a two byte header
+// without it and are version 0.
+//
+// Scripts of any version are parsed by the same rules. A script with an
+// unknown command is rejected since there is no telling what it means, but
+// unknown data types are skipped and kept in the parsed script so newer
+// versions can extend a command. The raw script is stored with every record,
+// so nothing is lost when newer clients publish data this version can't read.
+//
+// Bumping ProtocolVersion is a breaking change for deployed SPV nodes. Bloom
+// filters match whole pushes, so their filters only match the header pushes
+// of the versions they know about and they never receive scripts with a newer
+// version header to skip the unknown fields of. New data types should be
+// added under the current version instead.
 const (
-	FlagByte      = 0x9F
-	MinScriptSize = 1 + 1 + 2 + 1 + 32
-	MaxScriptSize = 220
-	HashSize      = 32
+	FlagByte        = 0x9F
+	ProtocolVersion = 0x01
+	MinScriptSize   = 1 + 1 + 2 + 1 + 32
+	MaxScriptSize   = 220
+	HashSize        = 32
 )
 
+// Command is the kind of a script. Each command is defined in its own file
+// and registered with RegisterCommand.
 type Command byte
 
-func (c *Command) String() string {
-	if *c == AddFileCommand {
-		return "AddFile"
-	} else {
-		return "Vote"
-	}
-}
-
-const (
-	AddFileCommand Command = 0x01
-	VoteCommand    Command = 0x02
-)
-
 type DataType byte
 
 const (
@@ -47,8 +58,20 @@ const (
 	Vote        DataType = 0x03
 	Comment     DataType = 0x04
 	Category    DataType = 0x05
+	Size        DataType = 0x06
+	MimeType    DataType = 0x07
+	Filename    DataType = 0x08
+	Language    DataType = 0x09
+	License     DataType = 0x0A
+	Tag         DataType = 0x0B
 )
 
+// DataElement is a data element of a type this version doesn't know.
+type DataElement struct {
+	Type DataType
+	Data []byte
+}
+
 type Script interface {
 	Command() Command
 	ID() []byte
@@ -56,79 +79,20 @@ type Script interface {
 	Serialize() ([]byte, error)
 }
 
-type AddFileScript struct {
-	Cid         cid.Cid
-	Description string
-	Category    string
-}
-
-func (as *AddFileScript) Command() Command {
-	return AddFileCommand
-}
-
-func (as *AddFileScript) ID() []byte {
-	return as.Cid.Bytes()
-}
-
-func (as *AddFileScript) Parsed() ParsedScript {
-	return ParsedScript{
-		Description: as.Description,
-		Cid:         as.Cid,
-		Category:    as.Category,
-	}
-}
-
-func (as *AddFileScript) Serialize() ([]byte, error) {
+// newScriptBuilder starts a script with the header for cmd.
+func newScriptBuilder(cmd Command) *txscript.ScriptBuilder {
 	builder := txscript.NewScriptBuilder()
 	builder.AddOp(txscript.OP_RETURN)
-	builder.AddData([]byte{FlagByte, byte(AddFileCommand)})
-	builder.AddData(append([]byte{byte(Cid)}, as.Cid.Bytes()...))
-	if as.Description != "" {
-		builder.AddData(append([]byte{byte(Description)}, []byte(as.Description)...))
-	}
-	if as.Category != "" {
-		builder.AddData(append([]byte{byte(Category)}, []byte(as.Category)...))
-	}
-	return builder.Script()
-}
-
-type VoteScript struct {
-	Txid    chainhash.Hash
-	Comment string
-	Upvote  bool
-}
-
-func (vs *VoteScript) Command() Command {
-	return VoteCommand
+	builder.AddData([]byte{FlagByte, ProtocolVersion, byte(cmd)})
+	return builder
 }
 
-func (vs *VoteScript) ID() []byte {
-	return vs.Txid.CloneBytes()
-}
-
-func (vs *VoteScript) Parsed() ParsedScript {
-	return ParsedScript{
-		Txid:    vs.Txid,
-		Comment: vs.Comment,
-		Upvote:  vs.Upvote,
+// finishScript appends the unknown data elements and checks the length of the
+// script.
+func finishScript(builder *txscript.ScriptBuilder, unknown []DataElement) ([]byte, error) {
+	for _, e := range unknown {
+		builder.AddData(append([]byte{byte(e.Type)}, e.Data...))
 	}
-}
-
-func (vs *VoteScript) Serialize() ([]byte, error) {
-	builder := txscript.NewScriptBuilder()
-	builder.AddOp(txscript.OP_RETURN)
-	builder.AddData([]byte{FlagByte, byte(VoteCommand)})
-	txid, err := toBigEndian(&vs.Txid)
-	if err != nil {
-		return []byte{}, err
-	}
-	builder.AddData(append([]byte{byte(Txid)}, txid...))
-	v := txscript.OP_0
-	if vs.Upvote {
-		v = txscript.OP_1
-	}
-	builder.AddData([]byte{byte(Vote), byte(v)})
-	builder.AddData(append([]byte{byte(Comment)}, []byte(vs.Comment)...))
 	script, err := builder.Script()
 	if err != nil {
 		return []byte{}, err
@@ -139,6 +103,14 @@ func (vs *VoteScript) Serialize() ([]byte, error) {
 	return script, nil
 }
 
+// HasFlag returns whether script is an OP_RETURN output carrying our flag
+// byte in a header of any version. It is a cheap check for deciding whether a
+// transaction is worth parsing.
+func HasFlag(script []byte) bool {
+	return len(script) > 3 && script[0] == txscript.OP_RETURN && (script[1] == txscript.OP_DATA_2 || script[1] == txscript.OP_DATA_3) && script[2] == FlagByte
+}
+
+// ParseScript parses a script of any protocol version.
 func ParseScript(script []byte) (Script, error) {
 	buf := bytes.NewBuffer(script)
 	if buf.Len() < MinScriptSize || buf.Len() > MaxScriptSize {
@@ -148,7 +120,8 @@ func ParseScript(script []byte) (Script, error) {
 		return nil, ErrInvalidScript
 	}
 
-	if ok, err := evalByte(buf, txscript.OP_DATA_2); !ok || err != nil {
+	header, err := buf.ReadByte()
+	if err != nil || (header != txscript.OP_DATA_2 && header != txscript.OP_DATA_3) {
 		return nil, ErrInvalidScript
 	}
 
@@ -156,46 +129,45 @@ func ParseScript(script []byte) (Script, error) {
 		return nil, ErrInvalidScript
 	}
 
+	var version byte
+	if header == txscript.OP_DATA_3 {
+		if version, err = buf.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+
 	b, err := buf.ReadByte()
 	if err != nil {
 		return nil, err
 	}
 
-	var s Script
-	switch Command(b) {
-	case AddFileCommand:
-		ps, err := parseDataElements(buf)
-		if err != nil {
-			return nil, err
-		}
-		s = &AddFileScript{
-			Cid:         ps.Cid,
-			Description: ps.Description,
-			Category:    ps.Category,
-		}
-	case VoteCommand:
-		ps, err := parseDataElements(buf)
-		if err != nil {
-			return nil, err
-		}
-		s = &VoteScript{
-			Txid:    ps.Txid,
-			Comment: ps.Comment,
-			Upvote:  ps.Upvote,
-		}
-	default:
+	def, ok := commands[Command(b)]
+	if !ok {
 		return nil, ErrUnknownCommand
 	}
-	return s, nil
+	ps, err := parseDataElements(buf)
+	if err != nil {
+		return nil, err
+	}
+	ps.Version = version
+	return def.Parse(ps)
 }
 
 type ParsedScript struct {
+	Version     byte
 	Cid         cid.Cid
 	Description string
 	Txid        chainhash.Hash
 	Upvote      bool
 	Comment     string
 	Category    string
+	Size        uint64
+	MimeType    string
+	Filename    string
+	Language    string
+	License     string
+	Tags        []string
+	Unknown     []DataElement
 }
 
 func parseDataElements(buf *bytes.Buffer) (ParsedScript, error) {
@@ -205,6 +177,11 @@ func parseDataElements(buf *bytes.Buffer) (ParsedScript, error) {
 		if err != nil {
 			return ps, err
 		}
+		// Every element starts with its type. Elements come from arbitrary
+		// transactions so their length can't be trusted.
+		if len(data) < 1 {
+			return ps, ErrInvalidScript
+		}
 		switch DataType(data[0]) {
 		case Cid:
 			c, err := cid.Cast(data[1:])
@@ -221,11 +198,36 @@ func parseDataElements(buf *bytes.Buffer) (ParsedScript, error) {
 			}
 			ps.Txid = *ch
 		case Vote:
+			if len(data) != 2 {
+				return ps, ErrInvalidScript
+			}
 			ps.Upvote = byte(data[1]) > 0x00
 		case Comment:
 			ps.Comment = string(data[1:])
 		case Category:
 			ps.Category = string(data[1:])
+		case Size:
+			size, err := decodeUint(data[1:])
+			if err != nil {
+				return ps, err
+			}
+			ps.Size = size
+		case MimeType:
+			ps.MimeType = string(data[1:])
+		case Filename:
+			ps.Filename = string(data[1:])
+		case Language:
+			ps.Language = string(data[1:])
+		case License:
+			ps.License = string(data[1:])
+		case Tag:
+			// Tags may be repeated.
+			ps.Tags = append(ps.Tags, string(data[1:]))
+		default:
+			// Copy the data since it belongs to the caller's script.
+			e := DataElement{Type: DataType(data[0]), Data: make([]byte, len(data)-1)}
+			copy(e.Data, data[1:])
+			ps.Unknown = append(ps.Unknown, e)
 		}
 	}
 	if buf.Len() != 0 {
@@ -272,8 +274,34 @@ func toBigEndian(txid *chainhash.Hash) ([]byte, error) {
 }
 
 func fromBigEndian(hash []byte) (*chainhash.Hash, error) {
-	for i := 0; i < HashSize/2; i++ {
-		hash[i], hash[HashSize-1-i] = hash[HashSize-1-i], hash[i]
+	if len(hash) != HashSize {
+		return nil, ErrInvalidLength
+	}
+	// Reverse a copy so the caller's script is left untouched.
+	reversed := make([]byte, HashSize)
+	for i := range hash {
+		reversed[HashSize-1-i] = hash[i]
+	}
+	return chainhash.NewHash(reversed)
+}
+
+// encodeUint encodes n big endian without leading zero bytes.
+func encodeUint(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func decodeUint(b []byte) (uint64, error) {
+	if len(b) < 1 || len(b) > 8 {
+		return 0, ErrInvalidLength
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
 	}
-	return chainhash.NewHash(hash)
+	return n, nil
 }
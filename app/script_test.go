@@ -46,6 +46,34 @@ var testScripts = []TestScript{
 		"0934aaa9e475375cea77c01853d6c411e6c4446c81da76797f696fd70e143cc3",
 		nil,
 	},
+	{
+		"6a039F0101230012200709a33d6f07812bc1d7cbddbbc2f95f4444f5d0cf5deb05a441c4b21fc6b2390c0168656c6c6f20776f726c6406054d75736963",
+		ParsedScript{
+			Version:     1,
+			Description: "hello world",
+			Category:    "Music",
+		},
+		"12200709a33d6f07812bc1d7cbddbbc2f95f4444f5d0cf5deb05a441c4b21fc6b239",
+		"",
+		nil,
+	},
+	{
+		// A later version with a data element of an unknown type.
+		"6a039F070221020934aaa9e475375cea77c01853d6c411e6c4446c81da76797f696fd70e143cc30203510E04676f6f6462796520776f726c64047e78797a",
+		ParsedScript{
+			Version: 7,
+			Comment: "goodbye world",
+			Upvote:  true,
+			Unknown: []DataElement{{Type: 0x7e, Data: []byte("xyz")}},
+		},
+		"",
+		"0934aaa9e475375cea77c01853d6c411e6c4446c81da76797f696fd70e143cc3",
+		nil,
+	},
+	{
+		script:        "6a039F017F2212200709a33d6f07812bc1d7cbddbbc2f95f4444f5d0cf5deb05a441c4b21fc6b239010b68656c6c6f20776f726c64",
+		expectedError: ErrUnknownCommand,
+	},
 	{
 		script:        "6b029F022212200709a33d6f07812bc1d7cbddbbc2f95f4444f5d0cf5deb05a441c4b21fc6b239010b68656c6c6f20776f726c64",
 		expectedError: ErrInvalidScript,
@@ -59,7 +87,7 @@ var testScripts = []TestScript{
 		expectedError: ErrInvalidLength,
 	},
 	{
-		script:        "6a029F032212200709a33d6f07812bc1d7cbddbbc2f95f4444f5d0cf5deb05a441c4b21fc6b239010b68656c6c6f20776f726c64",
+		script:        "6a029F7F2212200709a33d6f07812bc1d7cbddbbc2f95f4444f5d0cf5deb05a441c4b21fc6b239010b68656c6c6f20776f726c64",
 		expectedError: ErrUnknownCommand,
 	},
 	{
@@ -123,6 +151,17 @@ func TestParseScript(t *testing.T) {
 			if returnedScript.Parsed().Category != test.data.Category {
 				t.Errorf("Test script %d parsed incorrectly", i)
 			}
+			if r1.Version != r2.Version || len(r1.Unknown) != len(r2.Unknown) {
+				t.Errorf("Test script %d parsed incorrectly", i)
+			}
+			for j := range r1.Unknown {
+				if r1.Unknown[j].Type != r2.Unknown[j].Type || !bytes.Equal(r1.Unknown[j].Data, r2.Unknown[j].Data) {
+					t.Errorf("Test script %d parsed incorrectly", i)
+				}
+			}
+			if !HasFlag(script) {
+				t.Errorf("Test script %d not flagged", i)
+			}
 		}
 	}
 }
@@ -137,7 +176,7 @@ func TestVoteScript_Serialize(t *testing.T) {
 		Upvote:  true,
 		Comment: "goodbye world",
 	}
-	check, err := hex.DecodeString("6a029F0221020934aaa9e475375cea77c01853d6c411e6c4446c81da76797f696fd70e143cc30203510E04676f6f6462796520776f726c64")
+	check, err := hex.DecodeString("6a039F010221020934aaa9e475375cea77c01853d6c411e6c4446c81da76797f696fd70e143cc30203510E04676f6f6462796520776f726c64")
 	if err != nil {
 		t.Error(err)
 	}
@@ -150,6 +189,25 @@ func TestVoteScript_Serialize(t *testing.T) {
 	}
 }
 
+func TestScript_RoundTrip(t *testing.T) {
+	// Unknown data elements survive parsing and serializing again.
+	script, err := hex.DecodeString("6a039F010221020934aaa9e475375cea77c01853d6c411e6c4446c81da76797f696fd70e143cc30203510E04676f6f6462796520776f726c64047e78797a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseScript(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser, err := parsed.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ser, script) {
+		t.Errorf("Expected %x, got %x", script, ser)
+	}
+}
+
 func TestAddFileScript_Serialize(t *testing.T) {
 	id, err := cid.Decode("QmNp85zy9RLrQ5oQD4hPyS39ezrrXpcaa7R4Y9kxdWQLLQ")
 	if err != nil {
@@ -159,7 +217,7 @@ func TestAddFileScript_Serialize(t *testing.T) {
 		Cid:         *id,
 		Description: "hello world",
 	}
-	check, err := hex.DecodeString("6a029F01230012200709a33d6f07812bc1d7cbddbbc2f95f4444f5d0cf5deb05a441c4b21fc6b2390c0168656c6c6f20776f726c64")
+	check, err := hex.DecodeString("6a039F0101230012200709a33d6f07812bc1d7cbddbbc2f95f4444f5d0cf5deb05a441c4b21fc6b2390c0168656c6c6f20776f726c64")
 	if err != nil {
 		t.Error(err)
 	}
@@ -172,6 +230,78 @@ func TestAddFileScript_Serialize(t *testing.T) {
 	}
 }
 
+func TestAddFileScript_Metadata(t *testing.T) {
+	id, err := cid.Decode("QmNp85zy9RLrQ5oQD4hPyS39ezrrXpcaa7R4Y9kxdWQLLQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := &AddFileScript{
+		Cid:         *id,
+		Description: "hello world",
+		Size:        1500000,
+		MimeType:    "video/mp4",
+		Filename:    "hello.mp4",
+		Language:    "en",
+		License:     "CC-BY-4.0",
+		Tags:        []string{"retro", "sci-fi"},
+	}
+	ser, err := script.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The size is pushed without leading zero bytes.
+	if !bytes.Contains(ser, []byte{0x04, byte(Size), 0x16, 0xe3, 0x60}) {
+		t.Errorf("Size not serialized compactly: %x", ser)
+	}
+	parsed, err := ParseScript(ser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, ok := parsed.(*AddFileScript)
+	if !ok {
+		t.Fatalf("Expected an AddFileScript, got %T", parsed)
+	}
+	as.Version = 0
+	if as.Size != script.Size || as.MimeType != script.MimeType || as.Filename != script.Filename ||
+		as.Language != script.Language || as.License != script.License || len(as.Unknown) != 0 ||
+		len(as.Tags) != 2 || as.Tags[0] != "retro" || as.Tags[1] != "sci-fi" {
+		t.Errorf("Expected %+v, got %+v", script, as)
+	}
+
+	// Sizes longer than eight bytes are invalid.
+	invalid, err := hex.DecodeString("6a039F0101230012200709a33d6f07812bc1d7cbddbbc2f95f4444f5d0cf5deb05a441c4b21fc6b2390a06010203040506070809")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseScript(invalid); err != ErrInvalidLength {
+		t.Errorf("Expected %s, got %v", ErrInvalidLength, err)
+	}
+}
+
+func TestParseScript_MalformedElements(t *testing.T) {
+	// A vote header followed by a txid element.
+	header := append([]byte{0x6a, 0x02, FlagByte, byte(VoteCommand), 0x21, byte(Txid)}, make([]byte, HashSize)...)
+	tests := []struct {
+		name     string
+		elements []byte
+		err      error
+	}{
+		{"empty push", []byte{0x4c, 0x00, 0x02, byte(Vote), 0x01}, ErrInvalidScript},
+		{"empty trailing push", []byte{0x02, byte(Vote), 0x01, 0x4c, 0x00}, ErrInvalidPushData},
+		{"vote without a value", []byte{0x01, byte(Vote), 0x02, byte(Comment), 'a'}, ErrInvalidScript},
+		{"vote with extra bytes", []byte{0x03, byte(Vote), 0x01, 0x01}, ErrInvalidScript},
+		{"truncated push", []byte{0x05, byte(Comment), 'a', 'b'}, ErrInvalidPushData},
+		{"truncated pushdata1", []byte{0x4c, 0x05, byte(Comment), 'a'}, ErrInvalidPushData},
+		{"missing pushdata1 length", []byte{0x02, byte(Vote), 0x01, 0x4c}, ErrInvalidScript},
+	}
+	for _, test := range tests {
+		script := append(append([]byte{}, header...), test.elements...)
+		if _, err := ParseScript(script); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
 func Test(t *testing.T) {
 	h := "6a029f0123001220627a32cf4b279ccf1c6d636485ba7483870eba69fa554cbfafc906f4c463b2c24c5a01536e6f77666c616b6520746f204176616c616e6368653a2041204e6f76656c204d657461737461626c6520436f6e73656e7375732050726f746f636f6c2046616d696c7920666f722043727970746f63757272656e63696573100541636164656d696320506170657273"
 
@@ -182,4 +312,4 @@ func Test(t *testing.T) {
 		t.Error(err)
 	}
 
-}
\ No newline at end of file
+}
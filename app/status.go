@@ -0,0 +1,82 @@
+package app
+
+import (
+	"errors"
+	"github.com/cpacia/ipfsindex/db"
+)
+
+var ErrPaymentNotFound = errors.New("payment request not found")
+
+type PaymentState string
+
+const (
+	PaymentPending      PaymentState = "pending"
+	PaymentPartial      PaymentState = "partial"
+	PaymentBroadcasting PaymentState = "broadcasting"
+	PaymentBroadcast    PaymentState = "broadcast"
+	PaymentFailed       PaymentState = "failed"
+	PaymentExpired      PaymentState = "expired"
+)
+
+var finishedStates = []string{string(PaymentBroadcast), string(PaymentFailed), string(PaymentExpired)}
+
+// Final returns whether no further transitions can happen from this state.
+func (s PaymentState) Final() bool {
+	return s == PaymentBroadcast || s == PaymentFailed || s == PaymentExpired
+}
+
+// PaymentStatus is the state of a payment request as shown to the user. An
+// event carrying the new status is sent to the listener's status channel on
+// every state transition.
+type PaymentStatus struct {
+	Address     string       `json:"address"`
+	State       PaymentState `json:"state"`
+	AmountToPay uint64       `json:"amountToPay"`
+	AmountPaid  uint64       `json:"amountPaid"`
+	Txid        string       `json:"txid,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// PaymentStatus returns the status of the most recent payment request for the
+// given address.
+func (l *TransactionListener) PaymentStatus(address string) (*PaymentStatus, error) {
+	req := new(db.PaymentRequest)
+	if l.db.Where("address = ?", address).Order("timestamp desc").First(req).RecordNotFound() {
+		return nil, ErrPaymentNotFound
+	}
+	return &PaymentStatus{
+		Address:     req.Address,
+		State:       PaymentState(req.State),
+		AmountToPay: req.AmountToPay,
+		AmountPaid:  req.AmountPaid,
+		Txid:        req.Txid,
+		Error:       req.Error,
+	}, nil
+}
+
+// setState persists the new state of a request and notifies the status
+// channel. It is called from the wallet's callbacks, so the event is dropped
+// rather than waiting on a full channel. Clients can still query the status.
+func (l *TransactionListener) setState(e UserEntry, state PaymentState, txid, errMsg string) {
+	l.db.Model(&db.PaymentRequest{}).Where("request_id = ?", e.ID).UpdateColumns(map[string]interface{}{
+		"state": string(state),
+		"txid":  txid,
+		"error": errMsg,
+	})
+	if l.statusChan == nil {
+		return
+	}
+	status := PaymentStatus{
+		Address:     e.Address.String(),
+		State:       state,
+		AmountToPay: e.AmountToPay,
+		AmountPaid:  e.AmountPaid,
+		Txid:        txid,
+		Error:       errMsg,
+	}
+	select {
+	case l.statusChan <- status:
+	default:
+		log.Warningf("Status channel full, dropped %s status for req:%s", state, e.ID)
+	}
+}
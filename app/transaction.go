@@ -14,38 +14,52 @@ import (
 	"github.com/cpacia/bchutil"
 )
 
-func MakeTransaction(w *bitcoincash.SPVWallet, utxos []wallet.Utxo, ipfsScript Script) (*chainhash.Hash, error) {
+var (
+	ErrDustRefund        = errors.New("refund amount is dust after fees")
+	ErrInsufficientFunds = errors.New("inputs do not cover the fee, burn and refunds")
+)
+
+// BuildTransaction signs a transaction spending utxos to an output carrying
+// ipfsScript, burning burn satoshis in it. Any refund outputs are paid before
+// the remainder is sent to our own change address. It returns
+// ErrInsufficientFunds if the utxos don't cover the fee, the burn and the
+// refunds.
+func BuildTransaction(w Wallet, utxos []wallet.Utxo, ipfsScript Script, burn int64, refunds ...*wire.TxOut) (*wire.MsgTx, error) {
 	var val int64
 	var inputs []*wire.TxIn
-	additionalPrevScripts := make(map[wire.OutPoint][]byte)
 	for _, u := range utxos {
 		val += u.Value
 		in := wire.NewTxIn(&u.Op, []byte{}, [][]byte{})
 		inputs = append(inputs, in)
-		additionalPrevScripts[u.Op] = u.ScriptPubkey
 	}
 	serializedIPFSScript, err := ipfsScript.Serialize()
 	if err != nil {
 		return nil, err
 	}
-	ipfsOutput := wire.NewTxOut(0, serializedIPFSScript)
+	ipfsOutput := wire.NewTxOut(burn, serializedIPFSScript)
+	outputs := append([]*wire.TxOut{ipfsOutput}, refunds...)
 
-	estimatedSize := bitcoincash.EstimateSerializeSize(len(utxos), []*wire.TxOut{ipfsOutput}, true, bitcoincash.P2PKH)
+	estimatedSize := bitcoincash.EstimateSerializeSize(len(utxos), outputs, true, bitcoincash.P2PKH)
 	estimatedSize += len(serializedIPFSScript)
 
 	// Calculate the fee
 	feePerByte := int(w.GetFeePerByte(wallet.ECONOMIC))
 	fee := estimatedSize * feePerByte
 
-	outVal := val - int64(fee)
+	outVal := val - int64(fee) - burn
+	for _, r := range refunds {
+		outVal -= r.Value
+	}
+	// The caller refunds the inputs rather than broadcasting a transaction
+	// spending more than it has.
 	if outVal < 0 {
-		outVal = 0
+		return nil, ErrInsufficientFunds
 	}
 
 	tx := &wire.MsgTx{
 		Version:  wire.TxVersion,
 		TxIn:     inputs,
-		TxOut:    []*wire.TxOut{ipfsOutput},
+		TxOut:    outputs,
 		LockTime: 0,
 	}
 
@@ -56,6 +70,82 @@ func MakeTransaction(w *bitcoincash.SPVWallet, utxos []wallet.Utxo, ipfsScript S
 		changeOut := wire.NewTxOut(outVal, changeScript)
 		tx.TxOut = append(tx.TxOut, changeOut)
 	}
+	if err := signTransaction(w, tx, utxos); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// MakeRefund spends utxos back to addr less the transaction fee. It returns
+// the txid and the amount refunded.
+func MakeRefund(w Wallet, utxos []wallet.Utxo, addr btc.Address) (*chainhash.Hash, int64, error) {
+	var val int64
+	var inputs []*wire.TxIn
+	for _, u := range utxos {
+		val += u.Value
+		inputs = append(inputs, wire.NewTxIn(&u.Op, []byte{}, [][]byte{}))
+	}
+	refundScript, err := bchutil.PayToAddrScript(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	refundOutput := wire.NewTxOut(0, refundScript)
+
+	estimatedSize := bitcoincash.EstimateSerializeSize(len(utxos), []*wire.TxOut{refundOutput}, false, bitcoincash.P2PKH)
+	fee := int64(estimatedSize) * int64(w.GetFeePerByte(wallet.ECONOMIC))
+	refundOutput.Value = val - fee
+	if refundOutput.Value < 0 || txrules.IsDustAmount(btc.Amount(refundOutput.Value), len(refundScript), txrules.DefaultRelayFeePerKb) {
+		return nil, 0, ErrDustRefund
+	}
+
+	tx := &wire.MsgTx{
+		Version:  wire.TxVersion,
+		TxIn:     inputs,
+		TxOut:    []*wire.TxOut{refundOutput},
+		LockTime: 0,
+	}
+	hash, err := signAndBroadcast(w, tx, utxos)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hash, refundOutput.Value, nil
+}
+
+// RefundOutput builds an output returning amount to addr less the fee for the
+// output itself. It returns ErrDustRefund if the remainder is not worth sending.
+func RefundOutput(w Wallet, addr btc.Address, amount int64) (*wire.TxOut, error) {
+	script, err := bchutil.PayToAddrScript(addr)
+	if err != nil {
+		return nil, err
+	}
+	out := wire.NewTxOut(0, script)
+	out.Value = amount - int64(out.SerializeSize())*int64(w.GetFeePerByte(wallet.ECONOMIC))
+	if out.Value < 0 || txrules.IsDustAmount(btc.Amount(out.Value), len(script), txrules.DefaultRelayFeePerKb) {
+		return nil, ErrDustRefund
+	}
+	return out, nil
+}
+
+func signAndBroadcast(w Wallet, tx *wire.MsgTx, utxos []wallet.Utxo) (*chainhash.Hash, error) {
+	if err := signTransaction(w, tx, utxos); err != nil {
+		return nil, err
+	}
+	if err := w.Broadcast(tx); err != nil {
+		return nil, err
+	}
+	txid := tx.TxHash()
+	return &txid, nil
+}
+
+// signTransaction sorts the inputs and outputs of tx and signs its inputs,
+// which spend utxos.
+func signTransaction(w Wallet, tx *wire.MsgTx, utxos []wallet.Utxo) error {
+	additionalPrevScripts := make(map[wire.OutPoint][]byte)
+	inputValues := make(map[wire.OutPoint]int64)
+	for _, u := range utxos {
+		additionalPrevScripts[u.Op] = u.ScriptPubkey
+		inputValues[u.Op] = u.Value
+	}
 
 	// BIP 69 sorting
 	txsort.InPlaceSort(tx)
@@ -78,16 +168,12 @@ func MakeTransaction(w *bitcoincash.SPVWallet, utxos []wallet.Utxo, ipfsScript S
 		prevOutScript := additionalPrevScripts[txIn.PreviousOutPoint]
 		script, err := bchutil.SignTxOutput(w.Params(),
 			tx, i, prevOutScript, txscript.SigHashAll, getKey,
-			getScript, txIn.SignatureScript, utxos[i].Value)
+			getScript, txIn.SignatureScript, inputValues[txIn.PreviousOutPoint])
 		if err != nil {
 			log.Error(err)
-			return nil, errors.New("Failed to sign transaction")
+			return errors.New("Failed to sign transaction")
 		}
 		txIn.SignatureScript = script
 	}
-
-	// broadcast
-	w.Broadcast(tx)
-	txid := tx.TxHash()
-	return &txid, nil
+	return nil
 }
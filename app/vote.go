@@ -0,0 +1,117 @@
+package app
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/cpacia/ipfsindex/db"
+	"strings"
+	"time"
+)
+
+const VoteCommand Command = 0x02
+
+func init() {
+	RegisterCommand(CommandDef{
+		Command: VoteCommand,
+		Name:    "Vote",
+		Parse:   parseVote,
+		Handle:  handleVote,
+	})
+}
+
+// VoteScript votes on a file. Version and Unknown are set when parsing and
+// Unknown is serialized after the known data elements.
+type VoteScript struct {
+	Txid    chainhash.Hash
+	Comment string
+	Upvote  bool
+	Version byte
+	Unknown []DataElement
+}
+
+func (vs *VoteScript) Command() Command {
+	return VoteCommand
+}
+
+func (vs *VoteScript) ID() []byte {
+	return vs.Txid.CloneBytes()
+}
+
+func (vs *VoteScript) Parsed() ParsedScript {
+	return ParsedScript{
+		Version: vs.Version,
+		Txid:    vs.Txid,
+		Comment: vs.Comment,
+		Upvote:  vs.Upvote,
+		Unknown: vs.Unknown,
+	}
+}
+
+// Serialize serializes the script with the current protocol version.
+func (vs *VoteScript) Serialize() ([]byte, error) {
+	builder := newScriptBuilder(VoteCommand)
+	txid, err := toBigEndian(&vs.Txid)
+	if err != nil {
+		return []byte{}, err
+	}
+	builder.AddData(append([]byte{byte(Txid)}, txid...))
+	v := txscript.OP_0
+	if vs.Upvote {
+		v = txscript.OP_1
+	}
+	builder.AddData([]byte{byte(Vote), byte(v)})
+	builder.AddData(append([]byte{byte(Comment)}, []byte(vs.Comment)...))
+	return finishScript(builder, vs.Unknown)
+}
+
+func parseVote(ps ParsedScript) (Script, error) {
+	return &VoteScript{
+		Txid:    ps.Txid,
+		Comment: ps.Comment,
+		Upvote:  ps.Upvote,
+		Version: ps.Version,
+		Unknown: ps.Unknown,
+	}, nil
+}
+
+// handleVote saves a new vote, recording who funded it, and updates the
+// tally of the file voted on when the vote confirms or is removed from a
+// block.
+func handleVote(l *TransactionListener, s ScriptOutput) {
+	vs := s.Script.(*VoteScript)
+	txid := s.Txid.String()
+	ts := time.Now()
+	if s.Tx.Height > 0 {
+		ts = s.Tx.BlockTime
+	}
+	v := &db.Vote{}
+	if l.db.Where("txid = ?", txid).First(v).RecordNotFound() {
+		inputs := l.inputAddresses(s.Txid)
+		l.db.Save(&db.Vote{
+			FDTxid:         vs.Txid.String(),
+			Txid:           txid,
+			Comment:        vs.Comment,
+			Timestamp:      ts,
+			Height:         confirmedHeight(s.Tx.Height),
+			BlockHash:      l.blockHash(s.Tx.Height),
+			Upvote:         vs.Upvote,
+			Weight:         s.Output.Value,
+			InputAddresses: strings.Join(inputs, ","),
+			Voter:          l.paidBy(s.Txid),
+			RawScript:      s.Output.ScriptPubKey,
+		})
+		if s.Tx.Height > 0 {
+			l.updateTally(vs.Txid.String())
+		}
+		log.Debugf("Received new vote, tx: %s", txid)
+	} else if s.Tx.Height > 0 {
+		l.db.Model(v).Updates(&db.Vote{Height: uint32(s.Tx.Height), Timestamp: ts, BlockHash: l.blockHash(s.Tx.Height)})
+		l.updateTally(v.FDTxid)
+		log.Debugf("Updated vote with confirmation, tx: %s", txid)
+	} else if v.Height > 0 {
+		// Updates resets the model, so log the old block first.
+		log.Warningf("Vote removed from block %s by reorg, tx: %s", v.BlockHash, txid)
+		l.db.Model(v).Updates(map[string]interface{}{"height": 0, "block_hash": ""})
+		l.updateTally(v.FDTxid)
+	}
+}
@@ -2,7 +2,13 @@ package app
 
 import (
 	"crypto/rand"
+	"errors"
+	"github.com/OpenBazaar/wallet-interface"
+	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
 	"github.com/cpacia/BitcoinCash-Wallet"
 	"github.com/cpacia/BitcoinCash-Wallet/db"
 	"github.com/mitchellh/go-homedir"
@@ -14,6 +20,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -23,24 +30,121 @@ var fileLogFormat = logging.MustStringFormatter(
 	`%{time:15:04:05.000} [%{shortfunc}] [%{level}] %{message}`,
 )
 
-func NewWallet(params *chaincfg.Params, repoPath string, trustedPeer net.Addr) (*bitcoincash.SPVWallet, error) {
+// Wallet is the subset of wallet functionality used to index scripts and to
+// accept and spend user payments. It is implemented by the SPV wallet.
+type Wallet interface {
+	Params() *chaincfg.Params
+	CurrentAddress(purpose wallet.KeyPurpose) btcutil.Address
+	DecodeAddress(addr string) (btcutil.Address, error)
+	ScriptToAddress(script []byte) (btcutil.Address, error)
+	GetKey(addr btcutil.Address) (*btcec.PrivateKey, error)
+	GetFeePerByte(feeLevel wallet.FeeLevel) uint64
+	GetTransaction(txid chainhash.Hash) (wallet.Txn, error)
+	Broadcast(tx *wire.MsgTx) error
+	ChainTip() (uint32, chainhash.Hash)
+	BlockHash(height uint32) (chainhash.Hash, error)
+	ExchangeRates() wallet.ExchangeRates
+	AddTransactionListener(func(wallet.TransactionCallback))
+	Start()
+	Close()
+}
+
+// SPVWallet adds rescanning and block lookups to the SPV wallet.
+type SPVWallet struct {
+	*bitcoincash.SPVWallet
+
+	// blocks maps the heights of recent blocks which carried our
+	// transactions to their hashes. The wallet only looks headers up by
+	// hash, so they are recorded as the blocks are connected.
+	blocks map[uint32]chainhash.Hash
+	lock   sync.RWMutex
+}
+
+// maxCachedBlocks is the number of block hashes the SPV wallet remembers below
+// the highest one recorded.
+const maxCachedBlocks = 1000
+
+var (
+	_ Wallet    = (*SPVWallet)(nil)
+	_ Rescanner = (*SPVWallet)(nil)
+)
+
+// ErrBlockNotFound is returned by BlockHash for heights the wallet doesn't
+// know the main chain block of.
+var ErrBlockNotFound = errors.New("block not found")
+
+// AddTransactionListener records the block each confirmed transaction is
+// reported in before calling listener. The wallet reports transactions as
+// their block is connected, so the block is the chain tip at that moment.
+func (w *SPVWallet) AddTransactionListener(listener func(wallet.TransactionCallback)) {
+	w.SPVWallet.AddTransactionListener(func(cb wallet.TransactionCallback) {
+		w.recordBlock(cb.Height)
+		listener(cb)
+	})
+}
+
+func (w *SPVWallet) recordBlock(height int32) {
+	tipHeight, tipHash := w.ChainTip()
+	if height <= 0 || uint32(height) != tipHeight {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.blocks[tipHeight] = tipHash
+	if len(w.blocks) > maxCachedBlocks {
+		for h := range w.blocks {
+			if h+maxCachedBlocks <= tipHeight {
+				delete(w.blocks, h)
+			}
+		}
+	}
+}
+
+// BlockHash returns the hash of the chain tip or of a recent block which
+// carried one of our transactions. Other blocks return ErrBlockNotFound.
+func (w *SPVWallet) BlockHash(height uint32) (chainhash.Hash, error) {
+	tipHeight, tipHash := w.ChainTip()
+	if height == tipHeight {
+		return tipHash, nil
+	}
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	hash, ok := w.blocks[height]
+	if !ok || height > tipHeight {
+		return chainhash.Hash{}, ErrBlockNotFound
+	}
+	return hash, nil
+}
+
+// Rescan rolls the header chain back to fromDate and waits for the wallet to
+// download the filtered blocks back up to the current tip. The wallet only
+// indexes headers by date so rescanning from a height isn't supported.
+func (w *SPVWallet) Rescan(fromHeight uint32, fromDate time.Time, progress func(height, tip uint32)) error {
+	if fromDate.IsZero() {
+		return ErrRescanFromHeight
+	}
+	tip, _ := w.ChainTip()
+	w.ReSyncBlockchain(fromDate)
+	for {
+		height, _ := w.ChainTip()
+		progress(height, tip)
+		if height >= tip {
+			return nil
+		}
+		time.Sleep(time.Second * 5)
+	}
+}
+
+func NewWallet(params *chaincfg.Params, repoPath string, trustedPeer net.Addr) (Wallet, error) {
 	config := bitcoincash.NewDefaultConfig()
 	config.Params = params
 	if trustedPeer != nil {
 		config.TrustedPeer = trustedPeer
 	}
 
-	config.RepoPath = repoPath
-	if params.Name == chaincfg.TestNet3Params.Name {
-		config.RepoPath = path.Join(config.RepoPath, "testnet")
-	} else if params.Name == chaincfg.RegressionNetParams.Name {
-		config.RepoPath = path.Join(config.RepoPath, "regtest")
-	}
+	config.RepoPath = NetworkRepoPath(params, repoPath)
 
-	config.AdditionalFilters = [][]byte{
-		{FlagByte, byte(AddFileCommand)},
-		{FlagByte, byte(VoteCommand)},
-	}
+	config.AdditionalFilters = BloomFilters()
 
 	os.Mkdir(config.RepoPath, os.ModePerm) // Make sure directory exists
 
@@ -86,7 +190,18 @@ func NewWallet(params *chaincfg.Params, repoPath string, trustedPeer net.Addr) (
 	if err != nil {
 		return nil, err
 	}
-	return wallet, nil
+	return &SPVWallet{SPVWallet: wallet, blocks: make(map[uint32]chainhash.Hash)}, nil
+}
+
+// NetworkRepoPath returns the directory under repoPath where the wallet data
+// for the given network is kept.
+func NetworkRepoPath(params *chaincfg.Params, repoPath string) string {
+	if params.Name == chaincfg.TestNet3Params.Name {
+		return path.Join(repoPath, "testnet")
+	} else if params.Name == chaincfg.RegressionNetParams.Name {
+		return path.Join(repoPath, "regtest")
+	}
+	return repoPath
 }
 
 func GetRepoPath() (string, error) {
@@ -1,11 +1,13 @@
 package db
 
 import (
+	"fmt"
 	"github.com/blevesearch/bleve"
 	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"os"
 	"path"
 	"time"
-	"os"
 )
 
 type FileDescriptor struct {
@@ -18,7 +20,39 @@ type FileDescriptor struct {
 	Upvotes     int64     `json:"upvotes"`
 	Downvotes   int64     `json:"downvotes"`
 	Net         int64     `json:"net"`
+	Comments    int64     `json:"comments"`
+	Hot         float64   `json:"hot" gorm:"index"`
 	Height      uint32    `json:"height"`
+	BlockHash   string    `json:"blockHash"`
+
+	// Upvoters and Downvoters are the number of distinct voters whose latest
+	// vote was up or down.
+	Upvoters   int64 `json:"upvoters"`
+	Downvoters int64 `json:"downvoters"`
+
+	// The weighted tallies sum the weights of the votes rather than counting
+	// them.
+	WeightedUpvotes   int64 `json:"weightedUpvotes"`
+	WeightedDownvotes int64 `json:"weightedDownvotes"`
+	WeightedNet       int64 `json:"weightedNet"`
+
+	// RawScript is the script the file was published with, which may hold
+	// data this version can't parse.
+	RawScript []byte `json:"rawScript"`
+
+	// Publisher is the address which paid for the file, directly or through
+	// a payment request. Only the publisher can edit or retract it. A
+	// retracted file is left out of the search index and the trending list.
+	Publisher string `json:"publisher"`
+	Retracted bool   `json:"retracted" gorm:"index;not null;default:false"`
+
+	// Optional metadata published with the file. Size is in bytes and zero
+	// if unknown.
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Filename string `json:"filename"`
+	Language string `json:"language"`
+	License  string `json:"license"`
 }
 
 type Vote struct {
@@ -29,11 +63,99 @@ type Vote struct {
 	Timestamp time.Time `json:"timestamp"`
 	Upvote    bool      `json:"upvote"`
 	Height    uint32    `json:"height"`
+	BlockHash string    `json:"blockHash"`
+
+	// Weight is the number of satoshis burned by the vote's output.
+	Weight int64 `json:"weight"`
+
+	// InputAddresses are the comma separated addresses which funded the vote
+	// and Voter identifies who cast it. Voter is the address which paid for
+	// votes cast through the site and the first input address otherwise.
+	InputAddresses string `json:"inputAddresses"`
+	Voter          string `json:"voter" gorm:"index"`
+
+	// RawScript is the script the vote was cast with, which may hold data
+	// this version can't parse.
+	RawScript []byte `json:"rawScript"`
 }
 
+// PaymentRequest is a request for a user to pay for a script to be broadcast.
+// It is persisted so that payments arriving across restarts are not lost and
+// so that its status can be queried after it has finished.
+type PaymentRequest struct {
+	gorm.Model
+	RequestID   string    `json:"requestId" gorm:"unique;not null"`
+	Address     string    `json:"address" gorm:"index;not null"`
+	Script      []byte    `json:"script"`
+	AmountToPay uint64    `json:"amountToPay"`
+	AmountPaid  uint64    `json:"amountPaid"`
+	Burn        uint64    `json:"burn"`
+	Timestamp   time.Time `json:"timestamp"`
+	State       string    `json:"state" gorm:"index"`
+	Txid        string    `json:"txid"`
+	Error       string    `json:"error"`
+
+	// Sender is the address which paid for the request. The script
+	// broadcast for it is attributed to the sender rather than to our own
+	// payment address funding it.
+	Sender string `json:"sender"`
+}
+
+// PaymentOutpoint is an output paying to the address of a PaymentRequest.
+// Sender is the address which funded it and is where refunds are sent.
+// SpentBy is the txid of the index transaction or refund which spent it.
+// Outpoints are kept once spent so that a payment seen again, when it
+// confirms or during a rescan, isn't mistaken for a new one.
+type PaymentOutpoint struct {
+	gorm.Model
+	RequestID    string `json:"requestId" gorm:"index;not null"`
+	Outpoint     string `json:"outpoint" gorm:"unique;not null"`
+	Txid         string `json:"txid"`
+	Index        uint32 `json:"index"`
+	Value        int64  `json:"value"`
+	ScriptPubKey []byte `json:"scriptPubKey"`
+	Height       int32  `json:"height"`
+	Sender       string `json:"sender"`
+	SpentBy      string `json:"spentBy"`
+}
+
+// Refund is a payment returned to the address which funded a request.
+type Refund struct {
+	gorm.Model
+	RequestID string `json:"requestId" gorm:"index;not null"`
+	Address   string `json:"address"`
+	Amount    int64  `json:"amount"`
+	Txid      string `json:"txid"`
+	Reason    string `json:"reason"`
+}
+
+// Rescan records the progress of a historical rescan so that it can be
+// resumed after a restart. Height is the last block scanned.
+type Rescan struct {
+	gorm.Model
+	FromHeight uint32    `json:"fromHeight"`
+	FromDate   time.Time `json:"fromDate"`
+	Height     uint32    `json:"height"`
+	Tip        uint32    `json:"tip"`
+	State      string    `json:"state" gorm:"index"`
+	Error      string    `json:"error"`
+}
+
+const reindexBatchSize = 1000
+
 type Database struct {
 	*gorm.DB
-	search bleve.Index
+	search   bleve.Index
+	repoPath string
+
+	// WeightedVotes ranks files by their weighted net score rather than by
+	// the number of votes. The hot scores have to be recomputed with
+	// RecomputeTallies when it is changed.
+	WeightedVotes bool
+
+	// TallyPolicy decides which votes are counted. The tallies have to be
+	// recomputed with RecomputeTallies when it is changed.
+	TallyPolicy TallyPolicy
 }
 
 func NewDatabase(repoPath string) (*Database, error) {
@@ -42,43 +164,253 @@ func NewDatabase(repoPath string) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.AutoMigrate(&FileDescriptor{}, &Vote{})
+	db.AutoMigrate(&FileDescriptor{}, &Vote{}, &PaymentRequest{}, &PaymentOutpoint{}, &Refund{}, &Rescan{}, &Revision{}, &Tag{})
+	if err := backfillHot(db); err != nil {
+		return nil, err
+	}
 
 	index, err := bleve.Open(path.Join(repoPath, "index.bleve"))
 	if err == bleve.ErrorIndexPathDoesNotExist {
-		mapping := bleve.NewIndexMapping()
-		index, err = bleve.New(path.Join(repoPath, "index.bleve"), mapping)
-		if err != nil {
-			return nil, err
-		}
+		index, err = newIndex(path.Join(repoPath, "index.bleve"))
+	}
+	if err != nil {
+		return nil, err
 	}
 	database := &Database{
-		DB:     db,
-		search: index,
+		DB:       db,
+		search:   index,
+		repoPath: repoPath,
+	}
+	version, err := index.GetInternal(mappingVersionKey)
+	if err != nil {
+		return nil, err
+	}
+	if string(version) != mappingVersion {
+		if _, err := database.Reindex(); err != nil {
+			return nil, err
+		}
 	}
 	return database, nil
 }
 
+func newIndex(indexPath string) (bleve.Index, error) {
+	m, err := newIndexMapping()
+	if err != nil {
+		return nil, err
+	}
+	index, err := bleve.New(indexPath, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := index.SetInternal(mappingVersionKey, []byte(mappingVersion)); err != nil {
+		index.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+// Index indexes a file descriptor, or removes it from the index if it has been
+// retracted.
 func (db *Database) Index(txid string, fd FileDescriptor) {
-	db.search.Index(txid, fd)
+	if fd.Retracted {
+		db.Unindex(txid)
+		return
+	}
+	tags, _ := db.Tags(txid)
+	db.search.Index(txid, searchDocument(fd, tags))
+}
+
+// Unindex removes a file descriptor from the search index.
+func (db *Database) Unindex(txid string) {
+	db.search.Delete(txid)
 }
 
-func (db *Database) Query(searchTerm string, limit int, offset int) ([]string, error) {
+// Query returns the IDs of the confirmed documents matching searchTerm along
+// with the total number of matches. The syntax of searchTerm is described by
+// ParseQuery.
+func (db *Database) Query(searchTerm string, limit int, offset int) ([]string, uint64, error) {
+	results, err := db.Search(SearchOptions{Query: searchTerm, ConfirmedOnly: true, Limit: limit, Offset: offset})
+	if err != nil {
+		return nil, 0, err
+	}
 	var ids []string
-	query := bleve.NewMatchQuery(searchTerm)
-	search := bleve.NewSearchRequest(query)
-	search.Size = limit
-	search.From = offset
-	searchResults, err := db.search.Search(search)
+	for _, hit := range results.Hits {
+		ids = append(ids, hit.ID)
+	}
+	return ids, results.Total, nil
+}
+
+// UpdateTally recomputes the vote tallies of the file descriptor with the
+// given txid from the confirmed votes cast on it, counted according to the
+// tally policy. Since the tallies are derived rather than incremented it is
+// safe to call any number of times.
+func (db *Database) UpdateTally(fdTxid string) error {
+	var votes []Vote
+	if err := db.Where("fd_txid = ? AND height > 0", fdTxid).Order("height asc, id asc").Find(&votes).Error; err != nil {
+		return err
+	}
+	fd := new(FileDescriptor)
+	if db.Where("txid = ?", fdTxid).First(fd).RecordNotFound() {
+		return nil
+	}
+	t := tallyVotes(votes, db.TallyPolicy)
+	fd.Upvotes, fd.Downvotes, fd.Net, fd.Comments = t.upvotes, t.downvotes, t.net, t.comments
+	fd.Upvoters, fd.Downvoters = t.upvoters, t.downvoters
+	fd.WeightedUpvotes, fd.WeightedDownvotes = t.weightedUpvotes, t.weightedDownvotes
+	fd.WeightedNet = t.weightedUpvotes - t.weightedDownvotes
+	fd.Hot = HotScore(db.NetScore(*fd), fd.Timestamp)
+	err := db.Model(fd).UpdateColumns(map[string]interface{}{
+		"upvotes":            fd.Upvotes,
+		"downvotes":          fd.Downvotes,
+		"net":                fd.Net,
+		"comments":           fd.Comments,
+		"upvoters":           fd.Upvoters,
+		"downvoters":         fd.Downvoters,
+		"weighted_upvotes":   fd.WeightedUpvotes,
+		"weighted_downvotes": fd.WeightedDownvotes,
+		"weighted_net":       fd.WeightedNet,
+		"hot":                fd.Hot,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	// The net score and comment count are indexed so the document has to be
+	// updated too.
+	db.Index(fd.Txid, *fd)
+	return nil
+}
+
+// NetScore returns the score a file descriptor is ranked by: its weighted net
+// score if votes are weighted and its net score otherwise.
+func (db *Database) NetScore(fd FileDescriptor) int64 {
+	if db.WeightedVotes {
+		return fd.WeightedNet
+	}
+	return fd.Net
+}
+
+// RecomputeTallies recomputes the vote tallies of every file descriptor from
+// scratch and returns the number of descriptors updated.
+func (db *Database) RecomputeTallies() (int, error) {
+	var txids []string
+	if err := db.Model(&FileDescriptor{}).Pluck("txid", &txids).Error; err != nil {
+		return 0, err
+	}
+	for _, txid := range txids {
+		if err := db.UpdateTally(txid); err != nil {
+			return 0, err
+		}
+	}
+	return len(txids), nil
+}
+
+// Reindex rebuilds the search index from the file descriptors in the
+// database which haven't been retracted. The new index is built alongside the
+// old one, which is only replaced once the new one holds a document for every
+// descriptor. It returns the number of descriptors indexed.
+func (db *Database) Reindex() (int, error) {
+	indexPath := path.Join(db.repoPath, "index.bleve")
+	newPath := indexPath + ".new"
+	os.RemoveAll(newPath)
+	index, err := newIndex(newPath)
 	if err != nil {
-		return ids, err
+		return 0, err
 	}
-	for _, r := range searchResults.Hits {
-		ids = append(ids, r.ID)
+
+	tags, err := db.allTags()
+	if err != nil {
+		index.Close()
+		return 0, err
+	}
+	rows, err := db.Model(&FileDescriptor{}).Where("retracted = ?", false).Rows()
+	if err != nil {
+		index.Close()
+		return 0, err
+	}
+	count := 0
+	batch := index.NewBatch()
+	for rows.Next() {
+		var fd FileDescriptor
+		if err := db.ScanRows(rows, &fd); err != nil {
+			rows.Close()
+			index.Close()
+			return 0, err
+		}
+		if err := batch.Index(fd.Txid, searchDocument(fd, tags[fd.Txid])); err != nil {
+			rows.Close()
+			index.Close()
+			return 0, err
+		}
+		count++
+		if batch.Size() >= reindexBatchSize {
+			if err := index.Batch(batch); err != nil {
+				rows.Close()
+				index.Close()
+				return 0, err
+			}
+			batch = index.NewBatch()
+		}
+	}
+	rows.Close()
+	if err := index.Batch(batch); err != nil {
+		index.Close()
+		return 0, err
+	}
+
+	docs, err := index.DocCount()
+	index.Close()
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	if err := db.Model(&FileDescriptor{}).Where("retracted = ?", false).Count(&total).Error; err != nil {
+		return 0, err
+	}
+	if docs != uint64(total) {
+		return 0, fmt.Errorf("reindex produced %d documents for %d file descriptors", docs, total)
+	}
+
+	if err := db.swapIndex(indexPath, newPath); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// swapIndex replaces the open search index at indexPath with the one built at
+// newPath. If the swap fails the old index is put back and reopened so that
+// searches keep working.
+func (db *Database) swapIndex(indexPath, newPath string) error {
+	oldPath := indexPath + ".old"
+	os.RemoveAll(oldPath)
+	db.search.Close()
+	restore := func(err error) error {
+		index, openErr := bleve.Open(indexPath)
+		if openErr != nil {
+			return fmt.Errorf("%s, and reopening the old index failed: %s", err, openErr)
+		}
+		db.search = index
+		return err
+	}
+	if err := os.Rename(indexPath, oldPath); err != nil {
+		return restore(err)
+	}
+	if err := os.Rename(newPath, indexPath); err != nil {
+		os.Rename(oldPath, indexPath)
+		return restore(err)
+	}
+	index, err := bleve.Open(indexPath)
+	if err != nil {
+		os.RemoveAll(indexPath)
+		os.Rename(oldPath, indexPath)
+		return restore(err)
 	}
-	return ids, nil
+	db.search = index
+	os.RemoveAll(oldPath)
+	return nil
 }
 
 func (db *Database) Close() {
-	db.Close()
+	db.search.Close()
+	db.DB.Close()
 }
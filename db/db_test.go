@@ -0,0 +1,817 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDatabase(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "ipfsindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database, func() {
+		database.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDatabase_Reindex(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	database.Save(&FileDescriptor{Txid: "aa", Description: "hello world", Height: 100})
+	database.Save(&FileDescriptor{Txid: "bb", Description: "hello moon", Height: 101})
+	database.Save(&FileDescriptor{Txid: "cc", Description: "hello unconfirmed"})
+	// A stale document for a descriptor which no longer exists.
+	database.Index("dd", FileDescriptor{Description: "hello stale"})
+
+	n, err := database.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 descriptors reindexed, got %d", n)
+	}
+	ids, total, err := database.Query("hello", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Errorf("Expected 2 results after reindexing, got %v", ids)
+	}
+	for _, id := range ids {
+		if id != "aa" && id != "bb" {
+			t.Errorf("Unexpected result %s", id)
+		}
+	}
+
+	// The rebuilt index is still usable.
+	database.Index("ee", FileDescriptor{Description: "hello mars", Height: 102})
+	if _, total, _ := database.Query("mars", 10, 0); total != 1 {
+		t.Error("Index not writable after reindexing")
+	}
+}
+
+func TestDatabase_SwapIndexFailure(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	database.Save(&FileDescriptor{Txid: "aa", Description: "hello world", Height: 100})
+	database.Index("aa", FileDescriptor{Description: "hello world", Height: 100})
+
+	// The new index is missing so the swap fails after closing the old one.
+	indexPath := path.Join(database.repoPath, "index.bleve")
+	if err := database.swapIndex(indexPath, indexPath+".missing"); err == nil {
+		t.Fatal("Expected swapping in a missing index to fail")
+	}
+	if _, total, err := database.Query("hello", 10, 0); err != nil || total != 1 {
+		t.Errorf("Old index not restored, got %d results: %v", total, err)
+	}
+	database.Index("bb", FileDescriptor{Description: "hello mars", Height: 101})
+	if _, total, _ := database.Query("mars", 10, 0); total != 1 {
+		t.Error("Restored index not writable")
+	}
+}
+
+func TestDatabase_Query(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	files := []FileDescriptor{
+		{Txid: "aa", Description: "hello world", Category: "Music", Cid: "QmAAA", Net: 5, Timestamp: time.Date(2018, 1, 15, 12, 0, 0, 0, time.UTC),
+			Size: 5 << 20, MimeType: "audio/mpeg", Filename: "hello_world.mp3", Language: "en", License: "CC-BY-4.0"},
+		{Txid: "bb", Description: "hello moon", Category: "Books", Cid: "QmBBB", Net: -2, Timestamp: time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC),
+			Size: 2 << 10, MimeType: "text/plain", Filename: "moon.txt", Language: "fr"},
+		{Txid: "cc", Description: "goodbye world", Category: "Science Fiction", Cid: "QmCCC", Timestamp: time.Date(2018, 6, 30, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, fd := range files {
+		fd.Height = 100
+		database.Save(&fd)
+		database.Index(fd.Txid, fd)
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"hello", "aa bb"},
+		{"hello world", "aa"},
+		{"hello AND world", "aa"},
+		{"hello OR goodbye", "aa bb cc"},
+		{`"goodbye world"`, "cc"},
+		{`"world goodbye"`, ""},
+		{"music", "aa"},
+		{"category:music", "aa"},
+		{`category:"science fiction"`, "cc"},
+		{"category:science", ""},
+		{"description:music", ""},
+		{"cid:QmBBB", "bb"},
+		{"cid:qmbbb", ""},
+		{"hello -category:Books", "aa"},
+		{"hello NOT moon", "aa"},
+		{"NOT hello", "cc"},
+		{"net:>0", "aa"},
+		{"net:<=0", "bb cc"},
+		{"net:-2..0", "bb cc"},
+		{"net:5", "aa"},
+		{"date:2018-03-01", "bb"},
+		{"date:<2018-03-01", "aa"},
+		{"date:2018-01-01..2018-03-01", "aa bb"},
+		{"date:>2018-03-01", "cc"},
+		{"(hello OR goodbye) AND net:>=0", "aa cc"},
+		{"world (moon OR net:>1)", "aa"},
+		{"filename:moon", "bb"},
+		{"moon.txt", ""},
+		{"mimetype:audio", "aa"},
+		{"mimetype:Text/Plain", "bb"},
+		{"mimetype:text/html", ""},
+		{"language:EN", "aa"},
+		{"license:cc-by-4.0", "aa"},
+		{"size:>1MB", "aa"},
+		{"size:1kb..4kb", "bb"},
+		{"size:2048", "bb"},
+		{"size:<1", "cc"},
+	}
+	for _, test := range tests {
+		ids, total, err := database.Query(test.query, 10, 0)
+		if err != nil {
+			t.Errorf("Query %q failed: %s", test.query, err)
+			continue
+		}
+		sort.Strings(ids)
+		if strings.Join(ids, " ") != test.expected || int(total) != len(ids) {
+			t.Errorf("Query %q returned %v, expected %q", test.query, ids, test.expected)
+		}
+	}
+
+	for _, query := range []string{`"unterminated`, "(hello", "hello )", "OR hello", "net:abc", "net:>", "size:big", "size:-1MB", "date:soon", `category:""`} {
+		if _, _, err := database.Query(query, 10, 0); err == nil {
+			t.Errorf("Expected query %q to fail", query)
+		} else if _, ok := err.(*QueryError); !ok {
+			t.Errorf("Expected a QueryError for %q, got %s", query, err)
+		}
+	}
+}
+
+func TestDatabase_Search(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	now := time.Now()
+	files := []FileDescriptor{
+		{Txid: "aa", Description: "hello world", Category: "Music", Timestamp: now.Add(-time.Hour)},
+		{Txid: "bb", Description: "hello moon", Category: "Music", Timestamp: now.AddDate(0, 0, -3)},
+		{Txid: "cc", Description: "hello sun", Category: "Books", Timestamp: now.AddDate(-2, 0, 0)},
+		{Txid: "dd", Description: "goodbye", Category: "Books", Timestamp: now},
+	}
+	for _, fd := range files {
+		database.Index(fd.Txid, fd)
+	}
+
+	results, err := database.Search(SearchOptions{Query: "hello", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Total != 3 {
+		t.Errorf("Expected 3 results, got %d", results.Total)
+	}
+	expected := []FacetCount{{"Music", 2}, {"Books", 1}}
+	if len(results.Categories) != len(expected) {
+		t.Fatalf("Unexpected category facets %v", results.Categories)
+	}
+	for i := range expected {
+		if results.Categories[i] != expected[i] {
+			t.Errorf("Unexpected category facets %v", results.Categories)
+		}
+	}
+	counts := []int{1, 1, 0, 0, 1}
+	if len(results.Dates) != len(counts) {
+		t.Fatalf("Unexpected date facets %v", results.Dates)
+	}
+	for i, c := range counts {
+		if results.Dates[i].Count != c {
+			t.Errorf("Expected %d results in %s, got %d", c, results.Dates[i].Name, results.Dates[i].Count)
+		}
+	}
+
+	// Each date facet drills down to its own results.
+	for i, d := range results.Dates {
+		drilled, err := database.Search(SearchOptions{Query: "hello", Date: d.Range, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(drilled.Total) != counts[i] {
+			t.Errorf("Expected %d results drilling down into %s, got %d", counts[i], d.Name, drilled.Total)
+		}
+	}
+
+	drilled, err := database.Search(SearchOptions{Query: "hello", Category: "Books", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drilled.Hits) != 1 || drilled.Hits[0].ID != "cc" {
+		t.Errorf("Expected only cc in Books, got %v", drilled.Hits)
+	}
+	if len(drilled.Categories) != 1 || drilled.Categories[0] != (FacetCount{"Books", 1}) {
+		t.Errorf("Unexpected category facets after drilling down %v", drilled.Categories)
+	}
+}
+
+func TestDatabase_SearchHighlight(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	database.Index("aa", FileDescriptor{Description: "<b>hello</b> world & friends", Category: "Music"})
+	database.Index("bb", FileDescriptor{Description: "goodbye", Category: "Hello"})
+
+	results, err := database.Search(SearchOptions{Query: "hello", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Hits) != 2 {
+		t.Fatalf("Expected 2 hits, got %v", results.Hits)
+	}
+	for _, hit := range results.Hits {
+		if hit.Score <= 0 {
+			t.Errorf("Expected a positive score for %s, got %f", hit.ID, hit.Score)
+		}
+		if hit.ID != "aa" {
+			if strings.Contains(hit.Highlight, "<mark>") {
+				t.Errorf("Unexpected highlight for %s: %s", hit.ID, hit.Highlight)
+			}
+			continue
+		}
+		expected := "&lt;b&gt;<mark>hello</mark>&lt;/b&gt; world &amp; friends"
+		if hit.Highlight != expected {
+			t.Errorf("Expected highlight %q, got %q", expected, hit.Highlight)
+		}
+	}
+}
+
+func TestDatabase_SearchModes(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	database.Index("aa", FileDescriptor{Description: "hello world", Category: "Music"})
+	database.Index("bb", FileDescriptor{Description: "funny movies", Category: "Video Clips"})
+
+	tests := []struct {
+		query     string
+		mode      SearchMode
+		fuzziness int
+		expected  string
+	}{
+		{"helo", ExactMode, 0, ""},
+		{"helo", FuzzyMode, 0, "aa"},
+		{"hallo wrld", FuzzyMode, 1, "aa"},
+		{"hxllx", FuzzyMode, 1, ""},
+		{"hxllx", FuzzyMode, 2, "aa"},
+		{"musik", FuzzyMode, 0, "aa"},
+		{`"hello wrld"`, FuzzyMode, 0, ""},
+		{"hel", PrefixMode, 0, "aa"},
+		{"Mov", PrefixMode, 0, "bb"},
+		{"movie", PrefixMode, 0, "bb"},
+		{"category:vid", PrefixMode, 0, "bb"},
+		{"hel -wor", PrefixMode, 0, ""},
+	}
+	for _, test := range tests {
+		results, err := database.Search(SearchOptions{Query: test.query, Mode: test.mode, Fuzziness: test.fuzziness, Limit: 10})
+		if err != nil {
+			t.Errorf("Query %q failed: %s", test.query, err)
+			continue
+		}
+		var ids []string
+		for _, hit := range results.Hits {
+			ids = append(ids, hit.ID)
+		}
+		if strings.Join(ids, " ") != test.expected {
+			t.Errorf("%s query %q returned %v, expected %q", test.mode, test.query, ids, test.expected)
+		}
+	}
+
+	for _, opts := range []SearchOptions{{Query: "hello", Mode: "loose"}, {Query: "hello", Mode: FuzzyMode, Fuzziness: 3}} {
+		if _, err := database.Search(opts); err == nil {
+			t.Errorf("Expected %+v to fail", opts)
+		} else if _, ok := err.(*QueryError); !ok {
+			t.Errorf("Expected a QueryError for %+v, got %s", opts, err)
+		}
+	}
+}
+
+func TestDatabase_SearchSuggestion(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	database.Index("aa", FileDescriptor{Description: "hello world", Category: "Music"})
+	database.Index("bb", FileDescriptor{Description: "help wanted", Category: "Music"})
+	database.Index("cc", FileDescriptor{Description: "hello again", Category: "Music"})
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"hello", ""},
+		{"helo wrld", "hello world"},
+		{"(helpp OR wnated) -musik", "(help OR wanted) -musik"},
+		{"musc", "music"},
+		{"category:musc", ""},
+		{"zzzzzz", ""},
+	}
+	for _, test := range tests {
+		results, err := database.Search(SearchOptions{Query: test.query, Limit: 10})
+		if err != nil {
+			t.Errorf("Query %q failed: %s", test.query, err)
+			continue
+		}
+		if results.Suggestion != test.expected {
+			t.Errorf("Expected suggestion %q for %q, got %q", test.expected, test.query, results.Suggestion)
+		}
+	}
+}
+
+func TestDatabase_Complete(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	database.Index("aa", FileDescriptor{Description: "funny movies", Category: "Video Clips"})
+	database.Index("bb", FileDescriptor{Description: "more movies", Category: "Movies"})
+	database.Index("cc", FileDescriptor{Description: "moon landing", Category: "Movies"})
+
+	tests := []struct {
+		partial  string
+		limit    int
+		expected []string
+	}{
+		{"mo", 10, []string{"movies", "moon"}},
+		{"mo", 1, []string{"movies"}},
+		{"funny MOV", 10, []string{"funny movies"}},
+		{"vid", 10, []string{"video clips"}},
+		{"funny ", 10, nil},
+		{"", 10, nil},
+		{"xyz", 10, nil},
+	}
+	for _, test := range tests {
+		completions, err := database.Complete(test.partial, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(completions, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Expected completions %v for %q, got %v", test.expected, test.partial, completions)
+		}
+	}
+}
+
+func TestDatabase_SearchSortAndFilter(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	files := []FileDescriptor{
+		{Txid: "aa", Description: "hello one", Category: "Music", Net: 1, Comments: 5, Height: 100, Timestamp: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Txid: "bb", Description: "hello two", Category: "Books", Net: 7, Comments: 0, Height: 100, Timestamp: time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{Txid: "cc", Description: "hello three", Category: "Music", Net: -3, Comments: 2, Height: 100, Timestamp: time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Txid: "dd", Description: "hello four", Category: "Music", Net: 0, Comments: 1, Timestamp: time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, fd := range files {
+		database.Index(fd.Txid, fd)
+	}
+
+	minNet := int64(0)
+	tests := []struct {
+		opts     SearchOptions
+		expected string
+	}{
+		{SearchOptions{Sort: SortNet}, "bb aa dd cc"},
+		{SearchOptions{Sort: SortNewest}, "dd cc bb aa"},
+		{SearchOptions{Sort: SortOldest}, "aa bb cc dd"},
+		{SearchOptions{Sort: SortComments}, "aa cc dd bb"},
+		{SearchOptions{Sort: SortNet, ConfirmedOnly: true}, "bb aa cc"},
+		{SearchOptions{Sort: SortNet, MinNet: &minNet}, "bb aa dd"},
+		{SearchOptions{Sort: SortOldest, From: "2018-02-01", To: "2018-03-01"}, "bb cc"},
+		{SearchOptions{Sort: SortOldest, From: "2018-03-01"}, "cc dd"},
+		{SearchOptions{Sort: SortNewest, Category: "Music", MinNet: &minNet, ConfirmedOnly: true}, "aa"},
+		// Sorting happens before paging.
+		{SearchOptions{Sort: SortNet, Offset: 1, Limit: 2}, "aa dd"},
+	}
+	for _, test := range tests {
+		test.opts.Query = "hello"
+		if test.opts.Limit == 0 {
+			test.opts.Limit = 10
+		}
+		results, err := database.Search(test.opts)
+		if err != nil {
+			t.Errorf("Search %+v failed: %s", test.opts, err)
+			continue
+		}
+		var ids []string
+		for _, hit := range results.Hits {
+			ids = append(ids, hit.ID)
+		}
+		if strings.Join(ids, " ") != test.expected {
+			t.Errorf("Search %+v returned %v, expected %q", test.opts, ids, test.expected)
+		}
+	}
+
+	// The minimum applies to the score the results are ranked by.
+	database.Index("ee", FileDescriptor{Txid: "ee", Description: "hello five", Net: 2, WeightedNet: -500, Height: 100})
+	database.Index("ff", FileDescriptor{Txid: "ff", Description: "hello six", Net: -2, WeightedNet: 500, Height: 100})
+	minNet = 0
+	weighted := func(sort SearchSort) string {
+		results, err := database.Search(SearchOptions{Query: "five OR six", Sort: sort, MinNet: &minNet, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, hit := range results.Hits {
+			ids = append(ids, hit.ID)
+		}
+		return strings.Join(ids, " ")
+	}
+	if ids := weighted(SortWeighted); ids != "ff" {
+		t.Errorf("Expected the weighted minimum when sorting by weighted score, got %q", ids)
+	}
+	if ids := weighted(SortRelevance); ids != "ee" {
+		t.Errorf("Expected the net minimum without weighted votes, got %q", ids)
+	}
+	database.WeightedVotes = true
+	if ids := weighted(SortRelevance); ids != "ff" {
+		t.Errorf("Expected the weighted minimum with weighted votes, got %q", ids)
+	}
+	if ids := weighted(SortNet); ids != "ee" {
+		t.Errorf("Expected the net minimum when sorting by net score, got %q", ids)
+	}
+
+	for _, opts := range []SearchOptions{{Query: "hello", Sort: "random"}, {Query: "hello", From: "yesterday"}} {
+		if _, err := database.Search(opts); err == nil {
+			t.Errorf("Expected %+v to fail", opts)
+		} else if _, ok := err.(*QueryError); !ok {
+			t.Errorf("Expected a QueryError for %+v, got %s", opts, err)
+		}
+	}
+}
+
+func TestDatabase_UpdateTally(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	database.Save(&FileDescriptor{Txid: "aa", Description: "hello", Height: 100})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v1", Upvote: true, Comment: "great", Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v2", Upvote: true, Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v3", Upvote: false, Comment: "meh", Height: 102})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v4", Upvote: true, Comment: "pending"})
+
+	if err := database.UpdateTally("aa"); err != nil {
+		t.Fatal(err)
+	}
+	fd := new(FileDescriptor)
+	database.Where("txid = ?", "aa").First(fd)
+	if fd.Upvotes != 2 || fd.Downvotes != 1 || fd.Net != 1 || fd.Comments != 2 {
+		t.Errorf("Unexpected tally %+v", fd)
+	}
+	results, err := database.Search(SearchOptions{Query: "hello", Sort: SortComments, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Total != 1 {
+		t.Error("Tallied file descriptor not indexed")
+	}
+}
+
+func TestDatabase_TallyAfterDelete(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	database.Save(&FileDescriptor{Txid: "aa", Description: "hello", Height: 100})
+	tally := func() *FileDescriptor {
+		if err := database.UpdateTally("aa"); err != nil {
+			t.Fatal(err)
+		}
+		fd := new(FileDescriptor)
+		database.Where("txid = ?", "aa").First(fd)
+		return fd
+	}
+
+	up := &Vote{FDTxid: "aa", Txid: "v1", Upvote: true, Comment: "nice", Height: 101}
+	database.Save(up)
+	database.Save(&Vote{FDTxid: "aa", Txid: "v2", Upvote: false, Height: 101})
+	if fd := tally(); fd.Upvotes != 1 || fd.Downvotes != 1 || fd.Net != 0 || fd.Comments != 1 {
+		t.Errorf("Unexpected tally after insert %+v", fd)
+	}
+
+	// The tally is derived from the votes left in the table.
+	database.Delete(up)
+	if fd := tally(); fd.Upvotes != 0 || fd.Downvotes != 1 || fd.Net != -1 || fd.Comments != 0 {
+		t.Errorf("Unexpected tally after delete %+v", fd)
+	}
+}
+
+func TestDatabase_RecomputeTallies(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	ts := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	database.Save(&FileDescriptor{Txid: "aa", Description: "hello", Timestamp: ts, Height: 100})
+	database.Save(&FileDescriptor{Txid: "bb", Description: "hello", Timestamp: ts, Height: 100})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v1", Upvote: true, Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v2", Upvote: true, Height: 101})
+
+	// Counters which drifted from the votes table, as an older version which
+	// incremented them in place could leave them.
+	database.Model(&FileDescriptor{}).Where("txid = ?", "aa").UpdateColumns(map[string]interface{}{"upvotes": 7, "net": 7})
+	database.Model(&FileDescriptor{}).Where("txid = ?", "bb").UpdateColumns(map[string]interface{}{"downvotes": 3, "net": -3})
+
+	n, err := database.RecomputeTallies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 descriptors recounted, got %d", n)
+	}
+	fd := new(FileDescriptor)
+	database.Where("txid = ?", "aa").First(fd)
+	if fd.Upvotes != 2 || fd.Net != 2 || fd.Hot != HotScore(2, ts) {
+		t.Errorf("Drifted tally not fixed %+v", fd)
+	}
+	fd = new(FileDescriptor)
+	database.Where("txid = ?", "bb").First(fd)
+	if fd.Downvotes != 0 || fd.Net != 0 {
+		t.Errorf("Drifted tally not fixed %+v", fd)
+	}
+}
+
+func TestDatabase_WeightedTally(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	ts := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	database.Save(&FileDescriptor{Txid: "aa", Description: "hello", Timestamp: ts, Height: 100})
+	database.Save(&FileDescriptor{Txid: "bb", Description: "hello", Timestamp: ts, Height: 100})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v1", Upvote: true, Weight: 5000, Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v2", Upvote: false, Weight: 1000, Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v3", Upvote: false, Weight: 1000, Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v4", Upvote: true, Weight: 9000})
+	database.Save(&Vote{FDTxid: "bb", Txid: "v5", Upvote: true, Height: 101})
+	database.Save(&Vote{FDTxid: "bb", Txid: "v6", Upvote: true, Height: 101})
+
+	if _, err := database.RecomputeTallies(); err != nil {
+		t.Fatal(err)
+	}
+	fd := new(FileDescriptor)
+	database.Where("txid = ?", "aa").First(fd)
+	if fd.Net != -1 || fd.WeightedUpvotes != 5000 || fd.WeightedDownvotes != 2000 || fd.WeightedNet != 3000 {
+		t.Errorf("Unexpected weighted tally %+v", fd)
+	}
+	if fd.Hot != HotScore(-1, ts) {
+		t.Errorf("Expected hot score by net votes %f, got %f", HotScore(-1, ts), fd.Hot)
+	}
+	results, err := database.Search(SearchOptions{Query: "hello", Sort: SortWeighted, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Hits) != 2 || results.Hits[0].ID != "aa" {
+		t.Errorf("Expected aa first by weighted score, got %+v", results.Hits)
+	}
+
+	database.WeightedVotes = true
+	if _, err := database.RecomputeTallies(); err != nil {
+		t.Fatal(err)
+	}
+	database.Where("txid = ?", "aa").First(fd)
+	if fd.Hot != HotScore(3000, ts) {
+		t.Errorf("Expected hot score by weighted net %f, got %f", HotScore(3000, ts), fd.Hot)
+	}
+}
+
+func TestDatabase_TallyPolicy(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	database.Save(&FileDescriptor{Txid: "aa", Description: "hello", Height: 100})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v1", Voter: "alice", Upvote: true, Weight: 100, Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v2", Voter: "alice", Upvote: true, Weight: 100, Height: 102})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v3", Voter: "bob", Upvote: true, Weight: 100, Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v4", Voter: "bob", Upvote: false, Weight: 400, Height: 103})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v5", Upvote: true, Weight: 100, Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v6", Upvote: true, Weight: 100, Height: 101})
+
+	tests := []struct {
+		policy               TallyPolicy
+		net, weightedNet     int64
+		upvoters, downvoters int64
+		upvotes, downvotes   int64
+	}{
+		{TallyAll, 4, 100, 3, 1, 5, 1},
+		{TallyLatestPerVoter, 2, -100, 3, 1, 5, 1},
+	}
+	for _, test := range tests {
+		database.TallyPolicy = test.policy
+		if err := database.UpdateTally("aa"); err != nil {
+			t.Fatal(err)
+		}
+		fd := new(FileDescriptor)
+		database.Where("txid = ?", "aa").First(fd)
+		if fd.Net != test.net || fd.WeightedNet != test.weightedNet {
+			t.Errorf("%s: expected net %d and weighted net %d, got %d and %d", test.policy, test.net, test.weightedNet, fd.Net, fd.WeightedNet)
+		}
+		// Votes without a known voter each count as a voter of their own.
+		if fd.Upvoters != test.upvoters || fd.Downvoters != test.downvoters || fd.Upvotes != test.upvotes || fd.Downvotes != test.downvotes {
+			t.Errorf("%s: unexpected vote counts %+v", test.policy, fd)
+		}
+	}
+}
+
+func TestDatabase_Revisions(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	fd := &FileDescriptor{Txid: "aa", Description: "hello", Category: "Music", Height: 100}
+	database.Save(fd)
+	database.Index(fd.Txid, *fd)
+	load := func() *FileDescriptor {
+		fd := new(FileDescriptor)
+		database.Where("txid = ?", "aa").First(fd)
+		return fd
+	}
+	found := func(q string) bool {
+		ids, _, err := database.Query(q, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(ids) == 1
+	}
+
+	edit := &Revision{FDTxid: "aa", Txid: "e1", Action: RevisionEdit, Description: "mars"}
+	if err := database.SaveRevision(edit); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.ApplyRevisions("aa"); err != nil {
+		t.Fatal(err)
+	}
+	if fd := load(); fd.Description != "hello" {
+		t.Errorf("Unconfirmed edit applied: %s", fd.Description)
+	}
+
+	database.Model(edit).UpdateColumn("height", 101)
+	if err := database.ApplyRevisions("aa"); err != nil {
+		t.Fatal(err)
+	}
+	if fd := load(); fd.Description != "mars" || fd.Category != "Music" {
+		t.Errorf("Edit not applied: %+v", fd)
+	}
+	if !found("mars") || found("hello") {
+		t.Error("Edited description not indexed")
+	}
+
+	retract := &Revision{FDTxid: "aa", Txid: "r1", Action: RevisionRetract, Height: 102}
+	if err := database.SaveRevision(retract); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.ApplyRevisions("aa"); err != nil {
+		t.Fatal(err)
+	}
+	if fd := load(); !fd.Retracted || found("mars") {
+		t.Error("Retracted file still indexed")
+	}
+	if n, err := database.Reindex(); err != nil || n != 0 {
+		t.Errorf("Expected retracted file to be left out of the index, got %d, %v", n, err)
+	}
+
+	// Reorg the edit and retraction.
+	database.Model(&Revision{}).Where("action != ?", RevisionPublish).UpdateColumn("height", 0)
+	if err := database.ApplyRevisions("aa"); err != nil {
+		t.Fatal(err)
+	}
+	if fd := load(); fd.Retracted || fd.Description != "hello" || !found("hello") {
+		t.Errorf("Reorged revisions not rolled back: %+v", fd)
+	}
+
+	revisions, err := database.Revisions("aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || revisions[0].Action != RevisionPublish || revisions[0].Description != "hello" {
+		t.Errorf("Unexpected revisions %+v", revisions)
+	}
+}
+
+func TestDatabase_Tags(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	files := []struct {
+		fd   FileDescriptor
+		tags []string
+	}{
+		{FileDescriptor{Txid: "aa", Description: "hello world", Height: 100}, []string{"Science Fiction", "retro", "science-fiction", " "}},
+		{FileDescriptor{Txid: "bb", Description: "hello moon", Height: 100}, []string{"retro"}},
+		{FileDescriptor{Txid: "cc", Description: "hello mars", Height: 100, Retracted: true}, []string{"retro", "space"}},
+	}
+	for _, f := range files {
+		database.Save(&f.fd)
+		if err := database.SaveTags(f.fd.Txid, f.tags); err != nil {
+			t.Fatal(err)
+		}
+		database.Index(f.fd.Txid, f.fd)
+	}
+
+	tags, err := database.Tags("aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, " ") != "retro science-fiction" {
+		t.Errorf("Tags not normalized: %v", tags)
+	}
+
+	// Retracted files aren't counted.
+	cloud, err := database.TagCloud(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cloud) != 2 || cloud[0] != (TagCount{"retro", 2}) || cloud[1] != (TagCount{"science-fiction", 1}) {
+		t.Errorf("Unexpected tag cloud %+v", cloud)
+	}
+
+	for query, expected := range map[string]string{
+		"tag:retro":                  "aa bb",
+		`tag:"Science Fiction"`:      "aa",
+		"hello -tag:science-fiction": "bb",
+		"tag:space":                  "",
+	} {
+		ids, _, err := database.Query(query, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ids)
+		if strings.Join(ids, " ") != expected {
+			t.Errorf("Query %q returned %v, expected %q", query, ids, expected)
+		}
+	}
+
+	results, err := database.Search(SearchOptions{Query: "hello", Tag: "Retro", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Total != 2 || len(results.Tags) != 2 || results.Tags[0] != (FacetCount{"retro", 2}) {
+		t.Errorf("Unexpected results %d with tag facets %+v", results.Total, results.Tags)
+	}
+
+	// Tags survive rebuilding the index.
+	if _, err := database.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _, _ := database.Query("tag:science-fiction", 10, 0); len(ids) != 1 {
+		t.Errorf("Tags lost when reindexing: %v", ids)
+	}
+}
+
+func TestHotScore(t *testing.T) {
+	day := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	if HotScore(5, day.Add(time.Hour)) <= HotScore(5, day) {
+		t.Error("Newer files should rank above older files with the same score")
+	}
+	if HotScore(10, day) <= HotScore(1, day) || HotScore(-10, day) >= HotScore(0, day) {
+		t.Error("Files should rank by net score at the same age")
+	}
+	later := day.Add(hotDecay * time.Second)
+	if d := HotScore(100, day) - HotScore(10, later); d > 1e-9 || d < -1e-9 {
+		t.Errorf("Ten times the votes should offset %d seconds of age, got difference %f", hotDecay, d)
+	}
+}
+
+func TestDatabase_Hot(t *testing.T) {
+	database, done := newTestDatabase(t)
+	defer done()
+
+	ts := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	database.Save(&FileDescriptor{Txid: "aa", Description: "hello", Timestamp: ts, Height: 100})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v1", Upvote: true, Height: 101})
+	database.Save(&Vote{FDTxid: "aa", Txid: "v2", Upvote: true, Height: 101})
+	if err := database.UpdateTally("aa"); err != nil {
+		t.Fatal(err)
+	}
+	fd := new(FileDescriptor)
+	database.Where("txid = ?", "aa").First(fd)
+	if fd.Hot != HotScore(2, ts) {
+		t.Errorf("Expected hot score %f after tallying, got %f", HotScore(2, ts), fd.Hot)
+	}
+
+	// Descriptors saved without a hot score are backfilled when the database
+	// is opened.
+	database.Model(fd).UpdateColumn("hot", 0)
+	if err := backfillHot(database.DB); err != nil {
+		t.Fatal(err)
+	}
+	database.Where("txid = ?", "aa").First(fd)
+	if fd.Hot != HotScore(2, ts) {
+		t.Errorf("Expected backfilled hot score %f, got %f", HotScore(2, ts), fd.Hot)
+	}
+}
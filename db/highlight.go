@@ -0,0 +1,44 @@
+package db
+
+import (
+	"fmt"
+	"github.com/blevesearch/bleve/registry"
+	"github.com/blevesearch/bleve/search/highlight"
+	"github.com/blevesearch/bleve/search/highlight/fragmenter/simple"
+	simpleHighlighter "github.com/blevesearch/bleve/search/highlight/highlighter/simple"
+	"html"
+)
+
+// markHighlighter highlights descriptions as HTML with the matched terms
+// wrapped in <mark>. Descriptions are user supplied so, unlike bleve's own
+// html highlighter, every part of the fragment is escaped.
+const markHighlighter = "ipfsindexMark"
+
+func init() {
+	registry.RegisterHighlighter(markHighlighter, func(config map[string]interface{}, cache *registry.Cache) (highlight.Highlighter, error) {
+		fragmenter, err := cache.FragmenterNamed(simple.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error building fragmenter: %v", err)
+		}
+		return simpleHighlighter.NewHighlighter(fragmenter, markFormatter{}, " … "), nil
+	})
+}
+
+type markFormatter struct{}
+
+func (markFormatter) Format(f *highlight.Fragment, locations highlight.TermLocations) string {
+	rv := ""
+	curr := f.Start
+	for _, l := range locations {
+		if l == nil || !l.ArrayPositions.Equals(f.ArrayPositions) || l.Start < curr {
+			continue
+		}
+		if l.End > f.End {
+			break
+		}
+		rv += html.EscapeString(string(f.Orig[curr:l.Start]))
+		rv += "<mark>" + html.EscapeString(string(f.Orig[l.Start:l.End])) + "</mark>"
+		curr = l.End
+	}
+	return rv + html.EscapeString(string(f.Orig[curr:f.End]))
+}
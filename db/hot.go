@@ -0,0 +1,43 @@
+package db
+
+import (
+	"github.com/jinzhu/gorm"
+	"math"
+	"time"
+)
+
+// hotEpoch and hotDecay tune HotScore. A file needs ten times the net score to
+// rank level with a file published hotDecay seconds later.
+var hotEpoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const hotDecay = 45000
+
+// HotScore ranks a file by its net score, discounted by its age. The score
+// depends only on when the file was published, not on the current time, so it
+// can be stored and only needs recomputing when the votes or timestamp
+// change.
+func HotScore(net int64, timestamp time.Time) float64 {
+	order := math.Log10(math.Max(math.Abs(float64(net)), 1))
+	sign := 0.0
+	if net > 0 {
+		sign = 1
+	} else if net < 0 {
+		sign = -1
+	}
+	return sign*order + timestamp.Sub(hotEpoch).Seconds()/hotDecay
+}
+
+// backfillHot computes the hot score of file descriptors saved before it was
+// introduced.
+func backfillHot(db *gorm.DB) error {
+	var fds []FileDescriptor
+	if err := db.Where("hot = 0").Find(&fds).Error; err != nil {
+		return err
+	}
+	for _, fd := range fds {
+		if err := db.Model(&fd).UpdateColumn("hot", HotScore(fd.Net, fd.Timestamp)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/analysis/lang/en"
+	"github.com/blevesearch/bleve/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/analysis/tokenizer/regexp"
+	"github.com/blevesearch/bleve/analysis/tokenizer/single"
+	"github.com/blevesearch/bleve/mapping"
+	"time"
+)
+
+// mappingVersion must be bumped whenever the index mapping or the search
+// document changes. An index built with a different version is rebuilt when
+// the database is opened.
+const mappingVersion = "7"
+
+var mappingVersionKey = []byte("mappingVersion")
+
+// caseInsensitiveKeyword indexes the whole field as a single lower cased
+// token so that categories match exactly but regardless of case.
+const caseInsensitiveKeyword = "caseInsensitiveKeyword"
+
+// filenameWords indexes the lower cased runs of letters and digits of a
+// filename, so that hello_world.mp3 matches hello, world and mp3.
+const filenameWords = "filenameWords"
+
+const categoryFacetField = "categoryFacet"
+
+// descriptionTermsField indexes the description without stemming. Fuzzy and
+// prefix queries and spelling suggestions work on the words as written.
+const descriptionTermsField = "descriptionTerms"
+
+// searchDoc is the representation of a file descriptor in the search index.
+type searchDoc struct {
+	Description string    `json:"description"`
+	Category    string    `json:"category"`
+	Cid         string    `json:"cid"`
+	Net         float64   `json:"net"`
+	WeightedNet float64   `json:"weightedNet"`
+	Comments    float64   `json:"comments"`
+	Confirmed   bool      `json:"confirmed"`
+	Timestamp   time.Time `json:"timestamp"`
+	Size        float64   `json:"size"`
+	MimeType    string    `json:"mimeType"`
+	Filename    string    `json:"filename"`
+	Language    string    `json:"language"`
+	License     string    `json:"license"`
+	Tags        []string  `json:"tags"`
+}
+
+func searchDocument(fd FileDescriptor, tags []string) searchDoc {
+	return searchDoc{
+		Description: fd.Description,
+		Category:    fd.Category,
+		Cid:         fd.Cid,
+		Net:         float64(fd.Net),
+		WeightedNet: float64(fd.WeightedNet),
+		Comments:    float64(fd.Comments),
+		Confirmed:   fd.Height > 0,
+		Timestamp:   fd.Timestamp,
+		Size:        float64(fd.Size),
+		MimeType:    fd.MimeType,
+		Filename:    fd.Filename,
+		Language:    fd.Language,
+		License:     fd.License,
+		Tags:        tags,
+	}
+}
+
+func newIndexMapping() (mapping.IndexMapping, error) {
+	im := bleve.NewIndexMapping()
+	err := im.AddCustomAnalyzer(caseInsensitiveKeyword, map[string]interface{}{
+		"type":          custom.Name,
+		"tokenizer":     single.Name,
+		"token_filters": []string{lowercase.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = im.AddCustomTokenizer(filenameWords, map[string]interface{}{
+		"type":   regexp.Name,
+		"regexp": `[\p{L}\p{N}]+`,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = im.AddCustomAnalyzer(filenameWords, map[string]interface{}{
+		"type":          custom.Name,
+		"tokenizer":     filenameWords,
+		"token_filters": []string{lowercase.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	description := bleve.NewTextFieldMapping()
+	description.Analyzer = en.AnalyzerName
+
+	descriptionTerms := bleve.NewTextFieldMapping()
+	descriptionTerms.Name = descriptionTermsField
+	descriptionTerms.Analyzer = standard.Name
+	descriptionTerms.IncludeInAll = false
+
+	category := bleve.NewTextFieldMapping()
+	category.Analyzer = caseInsensitiveKeyword
+
+	// The category is indexed a second time as is so that facets report it
+	// the way it was published.
+	categoryFacet := bleve.NewTextFieldMapping()
+	categoryFacet.Name = categoryFacetField
+	categoryFacet.Analyzer = keyword.Name
+	categoryFacet.IncludeInAll = false
+
+	cid := bleve.NewTextFieldMapping()
+	cid.Analyzer = keyword.Name
+
+	// The file metadata and tags are only searched by field, so they are left
+	// out of the composite field.
+	filename := bleve.NewTextFieldMapping()
+	filename.Analyzer = filenameWords
+	filename.IncludeInAll = false
+
+	metadata := bleve.NewTextFieldMapping()
+	metadata.Analyzer = caseInsensitiveKeyword
+	metadata.IncludeInAll = false
+
+	doc := bleve.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("description", description, descriptionTerms)
+	doc.AddFieldMappingsAt("category", category, categoryFacet)
+	doc.AddFieldMappingsAt("cid", cid)
+	doc.AddFieldMappingsAt("net", bleve.NewNumericFieldMapping())
+	doc.AddFieldMappingsAt("weightedNet", bleve.NewNumericFieldMapping())
+	doc.AddFieldMappingsAt("comments", bleve.NewNumericFieldMapping())
+	doc.AddFieldMappingsAt("confirmed", bleve.NewBooleanFieldMapping())
+	doc.AddFieldMappingsAt("timestamp", bleve.NewDateTimeFieldMapping())
+	doc.AddFieldMappingsAt("size", bleve.NewNumericFieldMapping())
+	doc.AddFieldMappingsAt("mimeType", metadata)
+	doc.AddFieldMappingsAt("filename", filename)
+	doc.AddFieldMappingsAt("language", metadata)
+	doc.AddFieldMappingsAt("license", metadata)
+	doc.AddFieldMappingsAt("tags", metadata)
+
+	im.DefaultMapping = doc
+	im.DefaultField = "description"
+	return im, nil
+}
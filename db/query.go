@@ -0,0 +1,485 @@
+package db
+
+import (
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SearchMode controls how the words of a query are matched.
+type SearchMode string
+
+const (
+	// ExactMode matches words after stemming, so movie matches movies.
+	ExactMode SearchMode = "exact"
+	// FuzzyMode matches words within an edit distance, tolerating typos.
+	FuzzyMode SearchMode = "fuzzy"
+	// PrefixMode matches words beginning with the query words.
+	PrefixMode SearchMode = "prefix"
+)
+
+const (
+	DefaultFuzziness = 1
+	MaxFuzziness     = 2
+)
+
+// QueryError is returned for search queries which can't be parsed.
+type QueryError struct {
+	msg string
+}
+
+func (e *QueryError) Error() string {
+	return "invalid query: " + e.msg
+}
+
+// ParseQuery parses a search query into a bleve query.
+//
+// Bare words match the description or category and quoted words match a
+// phrase in the description. A word may be restricted to a field with
+// field:value, where field is description, category, cid, tag, filename,
+// mimetype, language or license. A mimetype without a subtype, such as
+// mimetype:video, matches any subtype. The net score, size and date can be
+// restricted with net:5, net:>=5, net:<0 or net:1..10, size:<10MB or
+// size:1GB..2GB and date:2018-01-01, date:>2018-01-01 or
+// date:2018-01-01..2018-06-30.
+//
+// Terms are combined with AND unless separated by OR and can be negated with
+// NOT or a leading -. Parentheses group terms.
+func ParseQuery(s string) (query.Query, error) {
+	return parseQuery(s, ExactMode, 0)
+}
+
+// parseQuery parses a query matching words in the given mode. Phrases, cids,
+// scores and dates are always matched exactly.
+func parseQuery(s string, mode SearchMode, fuzziness int) (query.Query, error) {
+	switch mode {
+	case "":
+		mode = ExactMode
+	case ExactMode, PrefixMode:
+	case FuzzyMode:
+		if fuzziness == 0 {
+			fuzziness = DefaultFuzziness
+		}
+		if fuzziness < 0 || fuzziness > MaxFuzziness {
+			return nil, &QueryError{"fuzziness must be between 1 and " + strconv.Itoa(MaxFuzziness)}
+		}
+	default:
+		return nil, &QueryError{"unknown search mode " + string(mode)}
+	}
+	tokens, err := tokenizeQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return bleve.NewMatchNoneQuery(), nil
+	}
+	p := &queryParser{tokens: tokens, mode: mode, fuzziness: fuzziness}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, &QueryError{"unexpected " + p.tokens[p.pos]}
+	}
+	return q, nil
+}
+
+func tokenizeQuery(s string) ([]string, error) {
+	var tokens []string
+	var current []rune
+	inQuote := false
+	flush := func() {
+		if len(current) > 0 {
+			tokens = append(tokens, string(current))
+			current = nil
+		}
+	}
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			current = append(current, r)
+		case inQuote:
+			current = append(current, r)
+		case unicode.IsSpace(r):
+			flush()
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			current = append(current, r)
+		}
+	}
+	if inQuote {
+		return nil, &QueryError{"unterminated quote"}
+	}
+	flush()
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens    []string
+	pos       int
+	mode      SearchMode
+	fuzziness int
+}
+
+func (p *queryParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *queryParser) parseOr() (query.Query, error) {
+	q, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	queries := []query.Query{q}
+	for p.peek() == "OR" {
+		p.next()
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return bleve.NewDisjunctionQuery(queries...), nil
+}
+
+func (p *queryParser) parseAnd() (query.Query, error) {
+	q, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	queries := []query.Query{q}
+	for {
+		t := p.peek()
+		if t == "" || t == ")" || t == "OR" {
+			break
+		}
+		if t == "AND" {
+			p.next()
+		}
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return bleve.NewConjunctionQuery(queries...), nil
+}
+
+func (p *queryParser) parseUnary() (query.Query, error) {
+	t := p.peek()
+	if t == "NOT" {
+		p.next()
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not(q), nil
+	}
+	if len(t) > 1 && t[0] == '-' {
+		p.next()
+		q, err := p.parseTerm(t[1:])
+		if err != nil {
+			return nil, err
+		}
+		return not(q), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (query.Query, error) {
+	t := p.next()
+	switch t {
+	case "":
+		return nil, &QueryError{"unexpected end of query"}
+	case "(":
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, &QueryError{"missing )"}
+		}
+		return q, nil
+	case ")", "AND", "OR":
+		return nil, &QueryError{"unexpected " + t}
+	}
+	return p.parseTerm(t)
+}
+
+func not(q query.Query) query.Query {
+	b := bleve.NewBooleanQuery()
+	b.AddMust(bleve.NewMatchAllQuery())
+	b.AddMustNot(q)
+	return b
+}
+
+func (p *queryParser) parseTerm(t string) (query.Query, error) {
+	field, value := "", t
+	if i := strings.Index(t, ":"); i > 0 && !strings.HasPrefix(t, `"`) {
+		switch strings.ToLower(t[:i]) {
+		case "description", "category", "cid", "tag", "filename", "mimetype", "language", "license", "net", "size", "date":
+			field, value = strings.ToLower(t[:i]), t[i+1:]
+		}
+	}
+	phrase := len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`)
+	if phrase {
+		value = value[1 : len(value)-1]
+	}
+	if strings.TrimSpace(value) == "" {
+		return nil, &QueryError{"empty term " + t}
+	}
+
+	switch field {
+	case "":
+		if phrase {
+			return matchPhrase("description", value), nil
+		}
+		return bleve.NewDisjunctionQuery(p.words("description", value), p.words("category", value)), nil
+	case "description":
+		if phrase {
+			return matchPhrase(field, value), nil
+		}
+		return p.words(field, value), nil
+	case "category":
+		return p.words(field, value), nil
+	case "cid":
+		q := bleve.NewTermQuery(value)
+		q.SetField(field)
+		return q, nil
+	case "tag":
+		return tagQuery(value), nil
+	case "filename":
+		if phrase {
+			return matchPhrase(field, value), nil
+		}
+		return p.words(field, value), nil
+	case "mimetype":
+		value = strings.ToLower(value)
+		if !strings.Contains(value, "/") {
+			q := bleve.NewPrefixQuery(value + "/")
+			q.SetField("mimeType")
+			return q, nil
+		}
+		q := bleve.NewTermQuery(value)
+		q.SetField("mimeType")
+		return q, nil
+	case "language", "license":
+		q := bleve.NewTermQuery(strings.ToLower(value))
+		q.SetField(field)
+		return q, nil
+	case "net":
+		return numericRange("net", "net score", value, parseNet)
+	case "size":
+		return numericRange("size", "size", value, parseSize)
+	default:
+		return dateRange(value)
+	}
+}
+
+// words matches value against the description, category or filename in the
+// parser's mode.
+func (p *queryParser) words(field, value string) query.Query {
+	if field == "description" && p.mode != ExactMode {
+		field = descriptionTermsField
+	}
+	switch p.mode {
+	case FuzzyMode:
+		q := bleve.NewMatchQuery(value)
+		q.SetField(field)
+		q.SetFuzziness(p.fuzziness)
+		return q
+	case PrefixMode:
+		q := bleve.NewPrefixQuery(strings.ToLower(value))
+		q.SetField(field)
+		return q
+	}
+	return match(field, value)
+}
+
+// tagQuery matches files carrying a tag, which is normalized like the tags
+// of the files.
+func tagQuery(tag string) query.Query {
+	q := bleve.NewTermQuery(NormalizeTag(tag))
+	q.SetField("tags")
+	return q
+}
+
+func match(field, value string) query.Query {
+	q := bleve.NewMatchQuery(value)
+	q.SetField(field)
+	return q
+}
+
+func matchPhrase(field, value string) query.Query {
+	q := bleve.NewMatchPhraseQuery(value)
+	q.SetField(field)
+	return q
+}
+
+type bound struct {
+	value     string
+	inclusive bool
+}
+
+// parseRange parses >x, >=x, <x, <=x, x..y, x.., ..y or x. Either bound may
+// be nil but not both.
+func parseRange(s string) (min, max *bound, err error) {
+	switch {
+	case strings.HasPrefix(s, ">="):
+		min = &bound{s[2:], true}
+	case strings.HasPrefix(s, ">"):
+		min = &bound{s[1:], false}
+	case strings.HasPrefix(s, "<="):
+		max = &bound{s[2:], true}
+	case strings.HasPrefix(s, "<"):
+		max = &bound{s[1:], false}
+	case strings.Contains(s, ".."):
+		parts := strings.SplitN(s, "..", 2)
+		if parts[0] != "" {
+			min = &bound{parts[0], true}
+		}
+		if parts[1] != "" {
+			max = &bound{parts[1], true}
+		}
+	default:
+		min, max = &bound{s, true}, &bound{s, true}
+	}
+	if (min == nil && max == nil) || (min != nil && min.value == "") || (max != nil && max.value == "") {
+		return nil, nil, &QueryError{"invalid range " + s}
+	}
+	return min, max, nil
+}
+
+// numericRange builds a range over a numeric field whose bounds are parsed by
+// parse. name describes the field in errors.
+func numericRange(field, name, s string, parse func(string) (float64, error)) (query.Query, error) {
+	min, max, err := parseRange(s)
+	if err != nil {
+		return nil, err
+	}
+	var minVal, maxVal *float64
+	var minIncl, maxIncl bool
+	if min != nil {
+		v, err := parse(min.value)
+		if err != nil {
+			return nil, &QueryError{"invalid " + name + " " + min.value}
+		}
+		minVal, minIncl = &v, min.inclusive
+	}
+	if max != nil {
+		v, err := parse(max.value)
+		if err != nil {
+			return nil, &QueryError{"invalid " + name + " " + max.value}
+		}
+		maxVal, maxIncl = &v, max.inclusive
+	}
+	q := bleve.NewNumericRangeInclusiveQuery(minVal, maxVal, &minIncl, &maxIncl)
+	q.SetField(field)
+	return q, nil
+}
+
+func parseNet(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+// sizeUnits are the suffixes a size may be given with, largest first so that
+// B is only matched when no other suffix is.
+var sizeUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a number of bytes, optionally followed by a unit such as
+// KB or GB.
+func parseSize(s string) (float64, error) {
+	multiplier := 1.0
+	upper := strings.ToUpper(s)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(upper, u.suffix) {
+			s, multiplier = s[:len(s)-len(u.suffix)], u.bytes
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		return 0, strconv.ErrRange
+	}
+	return v * multiplier, nil
+}
+
+// dateRange builds a range over the timestamp. Bounds given as whole days
+// cover the whole day, so date:2018-01-01 matches anything on that day.
+func dateRange(s string) (query.Query, error) {
+	min, max, err := parseRange(s)
+	if err != nil {
+		return nil, err
+	}
+	var start, end time.Time
+	startIncl, endIncl := true, false
+	if min != nil {
+		t, day, err := parseDate(min.value)
+		if err != nil {
+			return nil, err
+		}
+		start, startIncl = t, min.inclusive
+		if day && !min.inclusive {
+			start, startIncl = t.AddDate(0, 0, 1), true
+		}
+	}
+	if max != nil {
+		t, day, err := parseDate(max.value)
+		if err != nil {
+			return nil, err
+		}
+		end, endIncl = t, max.inclusive
+		if day && max.inclusive {
+			end, endIncl = t.AddDate(0, 0, 1), false
+		}
+	}
+	q := bleve.NewDateRangeInclusiveQuery(start, end, &startIncl, &endIncl)
+	q.SetField("timestamp")
+	return q, nil
+}
+
+// parseDate parses YYYY-MM-DD or RFC 3339. It returns whether only the day
+// was given.
+func parseDate(s string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, false, &QueryError{"invalid date " + s}
+	}
+	return t, false, nil
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Revision actions.
+const (
+	RevisionPublish = "publish"
+	RevisionEdit    = "edit"
+	RevisionRetract = "retract"
+)
+
+// Revision is a change to a file descriptor made by its publisher. The first
+// revision of a changed file is a publish revision recording the file as it
+// was originally published. Empty fields of an edit are left unchanged.
+type Revision struct {
+	gorm.Model
+	FDTxid      string    `json:"fdTxid" gorm:"index;not null"`
+	Txid        string    `json:"txid" gorm:"unique;not null"`
+	Action      string    `json:"action"`
+	Description string    `json:"description"`
+	Category    string    `json:"category"`
+	Timestamp   time.Time `json:"timestamp"`
+	Height      uint32    `json:"height"`
+	BlockHash   string    `json:"blockHash"`
+	RawScript   []byte    `json:"rawScript"`
+}
+
+// SaveRevision saves a new revision of a file descriptor, first recording the
+// descriptor as it was published if this is its first revision. The revision
+// only takes effect once it is confirmed and ApplyRevisions is called.
+func (db *Database) SaveRevision(rev *Revision) error {
+	if db.Where("fd_txid = ? AND action = ?", rev.FDTxid, RevisionPublish).First(&Revision{}).RecordNotFound() {
+		fd := new(FileDescriptor)
+		if err := db.Where("txid = ?", rev.FDTxid).First(fd).Error; err != nil {
+			return err
+		}
+		err := db.Create(&Revision{
+			FDTxid:      fd.Txid,
+			Txid:        fd.Txid,
+			Action:      RevisionPublish,
+			Description: fd.Description,
+			Category:    fd.Category,
+			Timestamp:   fd.Timestamp,
+			Height:      fd.Height,
+			BlockHash:   fd.BlockHash,
+			RawScript:   fd.RawScript,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.Create(rev).Error
+}
+
+// ApplyRevisions recomputes the description, category and retraction of a file
+// descriptor from the file as published and its confirmed revisions, in the
+// order they were confirmed. Like UpdateTally it is safe to call any number of
+// times.
+func (db *Database) ApplyRevisions(fdTxid string) error {
+	publish := new(Revision)
+	if db.Where("fd_txid = ? AND action = ?", fdTxid, RevisionPublish).First(publish).RecordNotFound() {
+		return nil
+	}
+	var revisions []Revision
+	if err := db.Where("fd_txid = ? AND action != ? AND height > 0", fdTxid, RevisionPublish).Order("height asc, id asc").Find(&revisions).Error; err != nil {
+		return err
+	}
+	fd := new(FileDescriptor)
+	if db.Where("txid = ?", fdTxid).First(fd).RecordNotFound() {
+		return nil
+	}
+	fd.Description, fd.Category, fd.Retracted = publish.Description, publish.Category, false
+	for _, r := range revisions {
+		switch r.Action {
+		case RevisionEdit:
+			if r.Description != "" {
+				fd.Description = r.Description
+			}
+			if r.Category != "" {
+				fd.Category = r.Category
+			}
+		case RevisionRetract:
+			fd.Retracted = true
+		}
+	}
+	err := db.Model(fd).UpdateColumns(map[string]interface{}{
+		"description": fd.Description,
+		"category":    fd.Category,
+		"retracted":   fd.Retracted,
+	}).Error
+	if err != nil {
+		return err
+	}
+	db.Index(fd.Txid, *fd)
+	return nil
+}
+
+// Revisions returns the revisions of a file descriptor, oldest first. It is
+// empty if the file has never been changed.
+func (db *Database) Revisions(fdTxid string) ([]Revision, error) {
+	var revisions []Revision
+	err := db.Where("fd_txid = ?", fdTxid).Order("id asc").Find(&revisions).Error
+	return revisions, err
+}
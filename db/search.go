@@ -0,0 +1,254 @@
+package db
+
+import (
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+	"strings"
+	"time"
+)
+
+// maxCategoryFacets and maxTagFacets are the number of categories and tags
+// counted for a search.
+const (
+	maxCategoryFacets = 20
+	maxTagFacets      = 20
+)
+
+// SearchSort is the order of search results.
+type SearchSort string
+
+const (
+	SortRelevance SearchSort = "relevance"
+	SortNet       SearchSort = "net"
+	SortWeighted  SearchSort = "weighted"
+	SortNewest    SearchSort = "newest"
+	SortOldest    SearchSort = "oldest"
+	SortComments  SearchSort = "comments"
+)
+
+// sortOrders maps each sort to bleve sort fields. Ties are broken by
+// relevance.
+var sortOrders = map[SearchSort][]string{
+	SortRelevance: {"-_score"},
+	SortNet:       {"-net", "-_score"},
+	SortWeighted:  {"-weightedNet", "-_score"},
+	SortNewest:    {"-timestamp", "-_score"},
+	SortOldest:    {"timestamp", "-_score"},
+	SortComments:  {"-comments", "-_score"},
+}
+
+// SearchOptions describes a search. Mode defaults to ExactMode and Fuzziness,
+// the edit distance allowed in FuzzyMode, to DefaultFuzziness. Results are
+// sorted by relevance unless Sort says otherwise.
+//
+// The remaining fields filter the results. Category, Tag and Date drill down
+// into the results of Query and are usually taken from the facets of a
+// previous search. Date is a range in the syntax of date: queries and From
+// and To are inclusive dates in the same syntax. MinNet, if set, is the lowest
+// score returned. It applies to the weighted net score when sorting by it, or
+// when votes are weighted unless sorting by the net score, and to the net
+// score otherwise.
+type SearchOptions struct {
+	Query         string
+	Mode          SearchMode
+	Fuzziness     int
+	Sort          SearchSort
+	Category      string
+	Tag           string
+	Date          string
+	From          string
+	To            string
+	MinNet        *int64
+	ConfirmedOnly bool
+	Limit         int
+	Offset        int
+}
+
+// FacetCount is the number of results in a category.
+type FacetCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// DateFacet is the number of results published within a period. Range can be
+// passed back as SearchOptions.Date to drill down into the period.
+type DateFacet struct {
+	Name  string `json:"name"`
+	Range string `json:"range"`
+	Count int    `json:"count"`
+}
+
+// SearchHit is a single search result. Highlight is the description as HTML
+// with any matched terms wrapped in <mark>, or empty if no fragment of the
+// description could be highlighted.
+type SearchHit struct {
+	ID        string
+	Score     float64
+	Highlight string
+}
+
+// SearchResults holds a page of results along with the facets of all results.
+// If nothing matched, Suggestion may hold the query with misspelled words
+// corrected.
+type SearchResults struct {
+	Hits       []SearchHit
+	Total      uint64
+	Categories []FacetCount
+	Tags       []FacetCount
+	Dates      []DateFacet
+	Suggestion string
+}
+
+type dateBucket struct {
+	name       string
+	start, end time.Time
+}
+
+// dateBuckets splits time into contiguous periods ending at now, newest first.
+// The first and last periods are open ended.
+func dateBuckets(now time.Time) []dateBucket {
+	now = now.UTC().Truncate(time.Second)
+	day := now.AddDate(0, 0, -1)
+	week := now.AddDate(0, 0, -7)
+	month := now.AddDate(0, -1, 0)
+	year := now.AddDate(-1, 0, 0)
+	return []dateBucket{
+		{"Past day", day, time.Time{}},
+		{"Past week", week, day},
+		{"Past month", month, week},
+		{"Past year", year, month},
+		{"Older", time.Time{}, year},
+	}
+}
+
+func (b dateBucket) rangeString() string {
+	switch {
+	case b.end.IsZero():
+		return ">=" + b.start.Format(time.RFC3339)
+	case b.start.IsZero():
+		return "<" + b.end.Format(time.RFC3339)
+	}
+	return b.start.Format(time.RFC3339) + ".." + b.end.Format(time.RFC3339)
+}
+
+// minNetField returns the field the MinNet filter applies to when sorting by
+// sort.
+func (db *Database) minNetField(sort SearchSort) string {
+	if sort == SortWeighted || (db.WeightedVotes && sort != SortNet) {
+		return "weightedNet"
+	}
+	return "net"
+}
+
+// Search runs a search query and counts the results by category and date.
+func (db *Database) Search(opts SearchOptions) (*SearchResults, error) {
+	q, err := parseQuery(opts.Query, opts.Mode, opts.Fuzziness)
+	if err != nil {
+		return nil, err
+	}
+	sortOrder := sortOrders[SortRelevance]
+	if opts.Sort != "" {
+		var ok bool
+		if sortOrder, ok = sortOrders[opts.Sort]; !ok {
+			return nil, &QueryError{"unknown sort " + string(opts.Sort)}
+		}
+	}
+	filters := []query.Query{q}
+	if opts.Category != "" {
+		category := bleve.NewTermQuery(opts.Category)
+		category.SetField(categoryFacetField)
+		filters = append(filters, category)
+	}
+	if opts.Tag != "" {
+		filters = append(filters, tagQuery(opts.Tag))
+	}
+	if opts.Date != "" {
+		date, err := dateRange(opts.Date)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, date)
+	}
+	if opts.From != "" || opts.To != "" {
+		date, err := dateRange(opts.From + ".." + opts.To)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, date)
+	}
+	if opts.MinNet != nil {
+		min, inclusive := float64(*opts.MinNet), true
+		net := bleve.NewNumericRangeInclusiveQuery(&min, nil, &inclusive, nil)
+		net.SetField(db.minNetField(opts.Sort))
+		filters = append(filters, net)
+	}
+	if opts.ConfirmedOnly {
+		confirmed := bleve.NewBoolFieldQuery(true)
+		confirmed.SetField("confirmed")
+		filters = append(filters, confirmed)
+	}
+	if len(filters) > 1 {
+		q = bleve.NewConjunctionQuery(filters...)
+	}
+
+	buckets := dateBuckets(time.Now())
+	search := bleve.NewSearchRequest(q)
+	search.Size = opts.Limit
+	search.From = opts.Offset
+	search.SortBy(sortOrder)
+	// Only the field which was searched has the locations of the matches.
+	highlightField := "description"
+	if opts.Mode != "" && opts.Mode != ExactMode {
+		highlightField = descriptionTermsField
+	}
+	search.Highlight = bleve.NewHighlightWithStyle(markHighlighter)
+	search.Highlight.AddField(highlightField)
+	search.AddFacet("categories", bleve.NewFacetRequest(categoryFacetField, maxCategoryFacets))
+	search.AddFacet("tags", bleve.NewFacetRequest("tags", maxTagFacets))
+	dates := bleve.NewFacetRequest("timestamp", len(buckets))
+	for _, b := range buckets {
+		dates.AddDateTimeRange(b.name, b.start, b.end)
+	}
+	search.AddFacet("dates", dates)
+
+	searchResults, err := db.search.Search(search)
+	if err != nil {
+		return nil, err
+	}
+	results := &SearchResults{Total: searchResults.Total}
+	for _, r := range searchResults.Hits {
+		hit := SearchHit{ID: r.ID, Score: r.Score}
+		if fragments := r.Fragments[highlightField]; len(fragments) > 0 {
+			hit.Highlight = strings.Join(fragments, " … ")
+		}
+		results.Hits = append(results.Hits, hit)
+	}
+	if f, ok := searchResults.Facets["categories"]; ok {
+		for _, t := range f.Terms {
+			results.Categories = append(results.Categories, FacetCount{Name: t.Term, Count: t.Count})
+		}
+	}
+	if f, ok := searchResults.Facets["tags"]; ok {
+		for _, t := range f.Terms {
+			results.Tags = append(results.Tags, FacetCount{Name: t.Term, Count: t.Count})
+		}
+	}
+	// Report the periods in order, including the empty ones, rather than by
+	// count as bleve does.
+	counts := make(map[string]int)
+	if f, ok := searchResults.Facets["dates"]; ok {
+		for _, r := range f.DateRanges {
+			counts[r.Name] = r.Count
+		}
+	}
+	for _, b := range buckets {
+		results.Dates = append(results.Dates, DateFacet{Name: b.name, Range: b.rangeString(), Count: counts[b.name]})
+	}
+	if results.Total == 0 {
+		results.Suggestion, err = db.suggest(opts.Query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"github.com/blevesearch/bleve/index"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// suggest corrects the misspelled words of a query which returned no results.
+// Each bare word not found in the index is replaced by the most common indexed
+// word within MaxFuzziness edits of it. It returns an empty string if there is
+// nothing to correct.
+func (db *Database) suggest(s string) (string, error) {
+	tokens, err := tokenizeQuery(s)
+	if err != nil {
+		return "", err
+	}
+	var dict map[string]uint64
+	changed := false
+	for i, t := range tokens {
+		if !isPlainWord(t) {
+			continue
+		}
+		if dict == nil {
+			if dict, err = db.dictionary("", descriptionTermsField, "category"); err != nil {
+				return "", err
+			}
+		}
+		word := strings.ToLower(t)
+		if _, ok := dict[word]; ok {
+			continue
+		}
+		if c := closestWord(word, dict); c != "" {
+			tokens[i] = c
+			changed = true
+		}
+	}
+	if !changed {
+		return "", nil
+	}
+	suggestion := strings.Join(tokens, " ")
+	suggestion = strings.Replace(suggestion, "( ", "(", -1)
+	return strings.Replace(suggestion, " )", ")", -1), nil
+}
+
+// dictionary returns the number of documents containing each term in fields,
+// optionally restricted to the terms beginning with prefix.
+func (db *Database) dictionary(prefix string, fields ...string) (map[string]uint64, error) {
+	dict := make(map[string]uint64)
+	for _, field := range fields {
+		var fd index.FieldDict
+		var err error
+		if prefix == "" {
+			fd, err = db.search.FieldDict(field)
+		} else {
+			fd, err = db.search.FieldDictPrefix(field, []byte(prefix))
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry, err := fd.Next()
+		for err == nil && entry != nil {
+			dict[entry.Term] += entry.Count
+			entry, err = fd.Next()
+		}
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
+
+// Complete returns up to limit completions of the last word of a partially
+// typed query, drawn from the words of the indexed descriptions and categories
+// with the most common first.
+func (db *Database) Complete(partial string, limit int) ([]string, error) {
+	head, word := "", partial
+	if i := strings.LastIndexFunc(partial, unicode.IsSpace); i >= 0 {
+		_, size := utf8.DecodeRuneInString(partial[i:])
+		head, word = partial[:i+size], partial[i+size:]
+	}
+	word = strings.ToLower(word)
+	if word == "" || limit <= 0 {
+		return nil, nil
+	}
+	dict, err := db.dictionary(word, descriptionTermsField, "category")
+	if err != nil {
+		return nil, err
+	}
+	terms := make([]string, 0, len(dict))
+	for term := range dict {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if dict[terms[i]] != dict[terms[j]] {
+			return dict[terms[i]] > dict[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > limit {
+		terms = terms[:limit]
+	}
+	completions := make([]string, len(terms))
+	for i, term := range terms {
+		completions[i] = head + term
+	}
+	return completions, nil
+}
+
+func isPlainWord(t string) bool {
+	switch t {
+	case "", "AND", "OR", "NOT":
+		return false
+	}
+	for _, r := range t {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// closestWord returns the most common word in dict within MaxFuzziness edits of
+// word, preferring fewer edits.
+func closestWord(word string, dict map[string]uint64) string {
+	maxDistance := MaxFuzziness
+	if n := len([]rune(word)); n <= 4 {
+		// Short words are within two edits of far too much.
+		maxDistance = 1
+	}
+	best, bestDistance, bestCount := "", maxDistance+1, uint64(0)
+	for term, count := range dict {
+		d := levenshtein(word, term)
+		if d < bestDistance || (d == bestDistance && (count > bestCount || (count == bestCount && term < best))) {
+			best, bestDistance, bestCount = term, d, count
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
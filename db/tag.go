@@ -0,0 +1,77 @@
+package db
+
+import (
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// Tag is a free-form label published with a file. A file may have any number
+// of tags, each stored once in its normalized form.
+type Tag struct {
+	gorm.Model
+	FDTxid string `json:"fdTxid" gorm:"unique_index:idx_tag_file;not null"`
+	Name   string `json:"name" gorm:"index;unique_index:idx_tag_file;not null"`
+}
+
+// TagCount is the number of files carrying a tag.
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NormalizeTag lower cases a tag and joins its words with hyphens so that
+// "Science Fiction" and "science-fiction" are the same tag. It returns an
+// empty string for a tag without any words.
+func NormalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+}
+
+// SaveTags records the tags of a file descriptor. Tags are normalized and
+// empty or repeated tags are skipped.
+func (db *Database) SaveTags(fdTxid string, tags []string) error {
+	for _, t := range tags {
+		name := NormalizeTag(t)
+		if name == "" {
+			continue
+		}
+		if err := db.FirstOrCreate(&Tag{}, Tag{FDTxid: fdTxid, Name: name}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tags returns the tags of a file descriptor in alphabetical order.
+func (db *Database) Tags(fdTxid string) ([]string, error) {
+	var tags []string
+	err := db.Model(&Tag{}).Where("fd_txid = ?", fdTxid).Order("name asc").Pluck("name", &tags).Error
+	return tags, err
+}
+
+// TagCloud returns the most used tags along with the number of files carrying
+// them, most used first. Retracted files aren't counted.
+func (db *Database) TagCloud(limit int) ([]TagCount, error) {
+	var counts []TagCount
+	err := db.Table("tags").
+		Select("tags.name AS name, count(*) AS count").
+		Joins("JOIN file_descriptors ON file_descriptors.txid = tags.fd_txid").
+		Where("tags.deleted_at IS NULL AND file_descriptors.deleted_at IS NULL AND file_descriptors.retracted = ?", false).
+		Group("tags.name").
+		Order("count desc, name asc").
+		Limit(limit).
+		Scan(&counts).Error
+	return counts, err
+}
+
+// allTags returns the tags of every file descriptor keyed by txid.
+func (db *Database) allTags() (map[string][]string, error) {
+	var tags []Tag
+	if err := db.Order("name asc").Find(&tags).Error; err != nil {
+		return nil, err
+	}
+	byTxid := make(map[string][]string)
+	for _, t := range tags {
+		byTxid[t.FDTxid] = append(byTxid[t.FDTxid], t.Name)
+	}
+	return byTxid, nil
+}
@@ -0,0 +1,69 @@
+package db
+
+// TallyPolicy decides which of the votes cast on a file are counted towards
+// its net and weighted scores.
+type TallyPolicy string
+
+const (
+	// TallyAll counts every vote.
+	TallyAll TallyPolicy = "all"
+	// TallyLatestPerVoter counts only the latest vote of each voter on a
+	// file, so a voter can change their vote but not vote twice.
+	TallyLatestPerVoter TallyPolicy = "latest"
+)
+
+// tally holds the counts derived from the votes cast on a file. Upvotes,
+// downvotes and comments count every vote while upvoters and downvoters count
+// the voters whose latest vote was up or down. The rest follow the policy.
+type tally struct {
+	upvotes, downvotes, comments            int64
+	upvoters, downvoters                    int64
+	net, weightedUpvotes, weightedDownvotes int64
+}
+
+// tallyVotes tallies votes, which must be in the order they were cast.
+func tallyVotes(votes []Vote, policy TallyPolicy) tally {
+	var t tally
+	latest := make(map[string]Vote)
+	for _, v := range votes {
+		if v.Upvote {
+			t.upvotes++
+		} else {
+			t.downvotes++
+		}
+		if v.Comment != "" {
+			t.comments++
+		}
+		// A vote whose funder couldn't be determined is its own voter.
+		key := v.Voter
+		if key == "" {
+			key = "txid:" + v.Txid
+		}
+		latest[key] = v
+	}
+	for _, v := range latest {
+		if v.Upvote {
+			t.upvoters++
+		} else {
+			t.downvoters++
+		}
+	}
+
+	counted := votes
+	if policy == TallyLatestPerVoter {
+		counted = make([]Vote, 0, len(latest))
+		for _, v := range latest {
+			counted = append(counted, v)
+		}
+	}
+	for _, v := range counted {
+		if v.Upvote {
+			t.net++
+			t.weightedUpvotes += v.Weight
+		} else {
+			t.net--
+			t.weightedDownvotes += v.Weight
+		}
+	}
+	return t
+}
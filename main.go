@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/cpacia/ipfsindex/app"
 	"github.com/cpacia/ipfsindex/db"
@@ -11,16 +12,48 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"time"
 )
 
 var parser = flags.NewParser(nil, flags.Default)
 
-type Start struct {
+// WalletOptions are the flags for choosing the network and wallet backend.
+type WalletOptions struct {
 	Testnet     bool   `short:"t" long:"testnet" description:"use the test network"`
 	Regtest     bool   `short:"r" long:"regtest" description:"run in regression test mode"`
-	Port        int    `short:"p" long:"port" description:"the web server port" default:"8080"`
-	Hostname    string `short:"h" long:"hostname" description:"the hostname for the server" default:"localhost"`
 	TrustedPeer string `short:"i" long:"trustedpeer" description:"specify a single trusted peer to connect to"`
+
+	RPCURL         string `long:"rpcurl" description:"use the JSON-RPC interface of a full node at this URL instead of the SPV wallet"`
+	RPCUser        string `long:"rpcuser" description:"the username for the full node's JSON-RPC interface"`
+	RPCPassword    string `long:"rpcpassword" description:"the password for the full node's JSON-RPC interface"`
+	RPCStartHeight uint32 `long:"rpcstartheight" description:"the block height to start scanning from the first time the full node is used (default: the current tip)"`
+}
+
+// TallyOptions are the flags for how votes are tallied.
+type TallyOptions struct {
+	WeightedVotes bool   `long:"weightedvotes" description:"rank files by the satoshis burned by their votes rather than the number of votes. Run recount after changing it."`
+	TallyPolicy   string `long:"tallypolicy" description:"which votes to count: all of them or only the latest vote of each voter on a file. Run recount after changing it." choice:"all" choice:"latest" default:"all"`
+}
+
+type Start struct {
+	WalletOptions
+	TallyOptions
+	Port       int    `short:"p" long:"port" description:"the web server port" default:"8080"`
+	Hostname   string `short:"h" long:"hostname" description:"the hostname for the server" default:"localhost"`
+	AdminToken string `long:"admintoken" description:"enable the admin API, authenticated with this bearer token"`
+}
+
+type Recount struct {
+	TallyOptions
+}
+
+type Reindex struct{}
+
+type Rescan struct {
+	WalletOptions
+	TallyOptions
+	Height uint32 `long:"height" description:"the block height to rescan from"`
+	Date   string `long:"date" description:"the date to rescan from, as YYYY-MM-DD"`
 }
 
 var stdoutLogFormat = logging.MustStringFormatter(
@@ -30,6 +63,9 @@ var stdoutLogFormat = logging.MustStringFormatter(
 var log = logging.MustGetLogger("main")
 
 var start Start
+var recount Recount
+var rescan Rescan
+var reindex Reindex
 
 var server *web.Server
 
@@ -48,18 +84,76 @@ func main() {
 		"start the server",
 		"The start command starts the web server and wallet",
 		&start)
+	parser.AddCommand("recount",
+		"recompute vote tallies",
+		"The recount command recomputes the vote counts, net and weighted scores and hot score of every file from the votes table",
+		&recount)
+	parser.AddCommand("reindex",
+		"rebuild the search index",
+		"The reindex command rebuilds the search index from the files in the database. The server must not be running.",
+		&reindex)
+	parser.AddCommand("rescan",
+		"rescan the blockchain",
+		"The rescan command walks the blockchain again from the given height or date, saving and indexing every file and vote found. An interrupted rescan is resumed if no height or date is given.",
+		&rescan)
 	if _, err := parser.Parse(); err != nil {
 		os.Exit(1)
 	}
 }
 
 func (x *Start) Execute(args []string) error {
+	setupLogging()
+
+	repoPath, err := app.GetRepoPath()
+	if err != nil {
+		return err
+	}
+
+	database, err := db.NewDatabase(repoPath)
+	if err != nil {
+		return err
+	}
+	database.WeightedVotes = x.WeightedVotes
+	database.TallyPolicy = db.TallyPolicy(x.TallyPolicy)
+
+	wallet, err := x.newWallet(repoPath)
+	if err != nil {
+		return err
+	}
+
+	// Status events are dropped rather than block the listener, so leave
+	// room for a burst of them.
+	statusChan := make(chan app.PaymentStatus, 100)
+	tl := app.NewTransactionListener(wallet, database, statusChan)
+	wallet.AddTransactionListener(tl.ListenBitcoinCash)
+
+	conf := web.Config{
+		Wallet:     wallet,
+		Listener:   tl,
+		Db:         database,
+		Port:       x.Port,
+		Hostname:   x.Hostname,
+		StatusChan: statusChan,
+		AdminToken: x.AdminToken,
+	}
+
+	webServer, err := web.NewServer(conf)
+	if err != nil {
+		return err
+	}
+	webServer.Start()
+	return nil
+}
+
+func setupLogging() {
 	backendStdout := logging.NewLogBackend(os.Stdout, "", 0)
 	backendStdoutFormatter := logging.NewBackendFormatter(backendStdout, stdoutLogFormat)
 	logging.SetBackend(backendStdoutFormatter)
+}
 
+func (x *WalletOptions) newWallet(repoPath string) (app.Wallet, error) {
 	if x.Testnet && x.Regtest {
-		return errors.New("Invalid combination of testnet and regtest")
+		return nil, errors.New("Invalid combination of testnet and regtest")
 	}
 	var trustedPeer net.Addr
 	var err error
@@ -67,47 +161,132 @@ func (x *Start) Execute(args []string) error {
 	if x.Testnet {
 		params = &chaincfg.TestNet3Params
 	} else if x.Regtest {
-		if x.TrustedPeer == "" {
-			return errors.New("Must specify a  trusted peer if using regtest")
+		if x.TrustedPeer == "" && x.RPCURL == "" {
+			return nil, errors.New("Must specify a  trusted peer if using regtest")
 		}
 		params = &chaincfg.RegressionNetParams
-		trustedPeer, err = net.ResolveTCPAddr("ip4", x.TrustedPeer)
-		if err != nil {
-			return err
+		if x.TrustedPeer != "" {
+			trustedPeer, err = net.ResolveTCPAddr("ip4", x.TrustedPeer)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
+	if x.RPCURL != "" {
+		return app.NewRPCWallet(app.RPCWalletConfig{
+			URL:           x.RPCURL,
+			User:          x.RPCUser,
+			Password:      x.RPCPassword,
+			Params:        params,
+			RepoPath:      app.NetworkRepoPath(params, repoPath),
+			StartHeight:   x.RPCStartHeight,
+			ExchangeRates: app.NewBitcoinCashPriceFetcher(nil),
+		})
+	}
+	return app.NewWallet(params, repoPath, trustedPeer)
+}
+
+func (x *Recount) Execute(args []string) error {
 	repoPath, err := app.GetRepoPath()
 	if err != nil {
 		return err
 	}
+	database, err := db.NewDatabase(repoPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	database.WeightedVotes = x.WeightedVotes
+	database.TallyPolicy = db.TallyPolicy(x.TallyPolicy)
+	n, err := database.RecomputeTallies()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recomputed vote tallies for %d files\n", n)
+	return nil
+}
 
+func (x *Reindex) Execute(args []string) error {
+	repoPath, err := app.GetRepoPath()
+	if err != nil {
+		return err
+	}
 	database, err := db.NewDatabase(repoPath)
 	if err != nil {
 		return err
 	}
+	defer database.Close()
+	start := time.Now()
+	n, err := database.Reindex()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reindexed %d files in %s\n", n, time.Since(start))
+	return nil
+}
 
-	wallet, err := app.NewWallet(params, repoPath, trustedPeer)
+func (x *Rescan) Execute(args []string) error {
+	setupLogging()
+
+	var fromDate time.Time
+	if x.Date != "" {
+		var err error
+		fromDate, err = app.ParseRescanDate(x.Date)
+		if err != nil {
+			return err
+		}
+	}
+	repoPath, err := app.GetRepoPath()
+	if err != nil {
+		return err
+	}
+	database, err := db.NewDatabase(repoPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	database.WeightedVotes = x.WeightedVotes
+	database.TallyPolicy = db.TallyPolicy(x.TallyPolicy)
+	wallet, err := x.newWallet(repoPath)
 	if err != nil {
 		return err
 	}
+	defer wallet.Close()
 
-	addrChan := make(chan [2]string)
-	tl := app.NewTransactionListener(wallet, database, addrChan)
+	tl := app.NewTransactionListener(wallet, database, nil)
 	wallet.AddTransactionListener(tl.ListenBitcoinCash)
+	go wallet.Start()
 
-	conf := web.Config{
-		Wallet:   wallet,
-		Listener: tl,
-		Db:       database,
-		Port:     x.Port,
-		Hostname: x.Hostname,
-		AddrChan: addrChan,
+	if x.Height > 0 || !fromDate.IsZero() {
+		_, err = tl.StartRescan(x.Height, fromDate)
+	} else {
+		_, err = tl.ResumeRescan()
 	}
-
-	webServer, err := web.NewServer(conf)
-	if err != nil {
+	if err == app.ErrRescanNotFound {
+		return errors.New("No rescan to resume. Specify a height or date to start a new one.")
+	} else if err != nil {
 		return err
 	}
-	webServer.Start()
+
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	for range ticker.C {
+		r, err := tl.RescanStatus()
+		if err != nil {
+			return err
+		}
+		switch app.RescanState(r.State) {
+		case app.RescanRunning:
+			fmt.Printf("Rescanned to block %d of %d\n", r.Height, r.Tip)
+		case app.RescanFailed:
+			return errors.New(r.Error)
+		case app.RescanFinished:
+			var files, votes int
+			database.Model(&db.FileDescriptor{}).Count(&files)
+			database.Model(&db.Vote{}).Count(&votes)
+			fmt.Printf("Rescan finished at block %d. The index holds %d files and %d votes.\n", r.Height, files, votes)
+			return nil
+		}
+	}
 	return nil
 }
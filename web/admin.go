@@ -0,0 +1,75 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/cpacia/ipfsindex/app"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminOnly requires requests to carry the admin token as a bearer token. The
+// admin API is disabled entirely if no token was configured.
+func (s *Server) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			writeAPIError(w, http.StatusNotFound, "admin API disabled")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) apiStartRescan(w http.ResponseWriter, r *http.Request) {
+	type RescanRequest struct {
+		FromHeight uint32 `json:"fromHeight"`
+		FromDate   string `json:"fromDate"`
+	}
+	req := new(RescanRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	var fromDate time.Time
+	if req.FromDate != "" {
+		var err error
+		fromDate, err = app.ParseRescanDate(req.FromDate)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid date")
+			return
+		}
+	}
+	rescan, err := s.listener.StartRescan(req.FromHeight, fromDate)
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusAccepted, rescan)
+	case app.ErrRescanStart:
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+	case app.ErrRescanRunning:
+		writeAPIError(w, http.StatusConflict, err.Error())
+	case app.ErrRescanUnsupported:
+		writeAPIError(w, http.StatusNotImplemented, err.Error())
+	default:
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to start rescan")
+	}
+}
+
+func (s *Server) apiRescanStatus(w http.ResponseWriter, r *http.Request) {
+	rescan, err := s.listener.RescanStatus()
+	if err == app.ErrRescanNotFound {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to load rescan")
+		return
+	}
+	writeJSON(w, http.StatusOK, rescan)
+}
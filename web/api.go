@@ -0,0 +1,282 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/cpacia/ipfsindex/app"
+	"github.com/cpacia/ipfsindex/db"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 25
+	maxTags            = 200
+)
+
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type FileList struct {
+	Window     string              `json:"window,omitempty"`
+	Tag        string              `json:"tag,omitempty"`
+	Files      []db.FileDescriptor `json:"files"`
+	Pagination Pagination          `json:"pagination"`
+}
+
+type SearchResponse struct {
+	Query         string        `json:"query"`
+	Mode          db.SearchMode `json:"mode,omitempty"`
+	Fuzziness     int           `json:"fuzziness,omitempty"`
+	Sort          db.SearchSort `json:"sort,omitempty"`
+	Category      string        `json:"category,omitempty"`
+	Tag           string        `json:"tag,omitempty"`
+	Date          string        `json:"date,omitempty"`
+	From          string        `json:"from,omitempty"`
+	To            string        `json:"to,omitempty"`
+	MinNet        *int64        `json:"minNet,omitempty"`
+	ConfirmedOnly bool          `json:"confirmedOnly"`
+	Files         []SearchHit   `json:"files"`
+	Facets        Facets        `json:"facets"`
+	Suggestion    string        `json:"suggestion,omitempty"`
+	Pagination    Pagination    `json:"pagination"`
+}
+
+// SearchHit is a file descriptor matching a search along with its relevance
+// score and its description as HTML with the matched terms highlighted.
+type SearchHit struct {
+	db.FileDescriptor
+	Score     float64 `json:"score"`
+	Highlight string  `json:"highlight,omitempty"`
+}
+
+// Facets count all results of a search by category, tag and date. Passing a
+// category name, tag or date range back as the category, tag or date
+// parameter drills down into it.
+type Facets struct {
+	Categories []db.FacetCount `json:"categories"`
+	Tags       []db.FacetCount `json:"tags"`
+	Dates      []db.DateFacet  `json:"dates"`
+}
+
+type SuggestResponse struct {
+	Query       string   `json:"query"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// FileResponse is a file along with its tags and its revisions, which are
+// empty unless the publisher has edited or retracted it.
+type FileResponse struct {
+	File          db.FileDescriptor `json:"file"`
+	Confirmations uint32            `json:"confirmations"`
+	Tags          []string          `json:"tags"`
+	Revisions     []db.Revision     `json:"revisions"`
+}
+
+// TagList is the most used tags, most used first.
+type TagList struct {
+	Tags []db.TagCount `json:"tags"`
+}
+
+type VoteList struct {
+	Votes      []db.Vote  `json:"votes"`
+	Pagination Pagination `json:"pagination"`
+}
+
+func (s *Server) apiSearch(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp, err := s.searchFiles(q)
+	if qerr, ok := err.(*db.QueryError); ok {
+		writeAPIError(w, http.StatusBadRequest, qerr.Error())
+		return
+	} else if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// apiSuggest completes the last word of a partially typed query. It backs the
+// suggestions shown under the search boxes.
+func (s *Server) apiSuggest(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	limit := defaultSuggestions
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			writeAPIError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if limit > maxSuggestions {
+			limit = maxSuggestions
+		}
+	}
+	suggestions, err := s.db.Complete(q, limit)
+	if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "suggest failed")
+		return
+	}
+	if suggestions == nil {
+		suggestions = []string{}
+	}
+	w.Header().Set("Cache-Control", "max-age=60")
+	writeJSON(w, http.StatusOK, &SuggestResponse{Query: q, Suggestions: suggestions})
+}
+
+func (s *Server) apiTrending(w http.ResponseWriter, r *http.Request) {
+	category := r.URL.Query().Get("category")
+	tag := db.NormalizeTag(r.URL.Query().Get("tag"))
+	req, err := parsePageRequest(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	window, err := parseWindow(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	files, pagination, err := s.trendingFiles(category, tag, window, req)
+	if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to load trending files")
+		return
+	}
+	writeJSON(w, http.StatusOK, &FileList{
+		Window:     window.Name,
+		Tag:        tag,
+		Files:      nonNilFiles(files),
+		Pagination: pagination,
+	})
+}
+
+func (s *Server) apiFile(w http.ResponseWriter, r *http.Request) {
+	fd, _, err := s.fileDetails(mux.Vars(r)["txid"])
+	if err == ErrFileNotFound {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to load file")
+		return
+	}
+	revisions, err := s.db.Revisions(fd.Txid)
+	if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to load file")
+		return
+	}
+	if revisions == nil {
+		revisions = []db.Revision{}
+	}
+	tags, err := s.db.Tags(fd.Txid)
+	if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to load file")
+		return
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	writeJSON(w, http.StatusOK, &FileResponse{
+		File:          *fd,
+		Confirmations: s.confirmations(fd.Height),
+		Tags:          tags,
+		Revisions:     revisions,
+	})
+}
+
+// apiTags returns the tag cloud, the most used tags along with the number of
+// files carrying them.
+func (s *Server) apiTags(w http.ResponseWriter, r *http.Request) {
+	limit := tagCloudSize
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			writeAPIError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if limit > maxTags {
+			limit = maxTags
+		}
+	}
+	tags, err := s.db.TagCloud(limit)
+	if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to load tags")
+		return
+	}
+	if tags == nil {
+		tags = []db.TagCount{}
+	}
+	writeJSON(w, http.StatusOK, &TagList{Tags: tags})
+}
+
+func (s *Server) apiVotes(w http.ResponseWriter, r *http.Request) {
+	req, err := parsePageRequest(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	txid := mux.Vars(r)["txid"]
+	if s.db.Where("txid = ?", txid).First(&db.FileDescriptor{}).RecordNotFound() {
+		writeAPIError(w, http.StatusNotFound, ErrFileNotFound.Error())
+		return
+	}
+	votes, pagination, err := s.votesPage(txid, req)
+	if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to load votes")
+		return
+	}
+	writeJSON(w, http.StatusOK, &VoteList{
+		Votes:      votes,
+		Pagination: pagination,
+	})
+}
+
+func (s *Server) apiPayment(w http.ResponseWriter, r *http.Request) {
+	status, err := s.listener.PaymentStatus(mux.Vars(r)["address"])
+	if err == app.ErrPaymentNotFound {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to load payment")
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// nonNilFiles makes sure empty result sets serialize as [] rather than null.
+func nonNilFiles(files []db.FileDescriptor) []db.FileDescriptor {
+	if files == nil {
+		return []db.FileDescriptor{}
+	}
+	return files
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]*APIError{
+		"error": {Code: status, Message: message},
+	})
+}
@@ -0,0 +1,137 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	pageSize    = 20
+	maxPageSize = 100
+)
+
+var (
+	ErrInvalidPage   = errors.New("invalid page")
+	ErrInvalidLimit  = errors.New("invalid limit")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Pagination describes a page of a list. NextCursor is set if there are more
+// results and can be passed back as the cursor parameter to fetch the next
+// page, which stays fast however deep the page is.
+type Pagination struct {
+	Total      int    `json:"total"`
+	Page       int    `json:"page"`
+	PageSize   int    `json:"pageSize"`
+	HasMore    bool   `json:"hasMore"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// pageRequest is a request for a page of a list, either by page number or by
+// the cursor returned with the previous page.
+type pageRequest struct {
+	Page   int
+	Size   int
+	Cursor *cursor
+}
+
+// cursor marks where the previous page ended. Lists ordered by hot score
+// continue after Hot and ID and lists ordered by ID after ID. Search results
+// can only be paged by offset in bleve so they continue from Offset.
+type cursor struct {
+	Page   int     `json:"p"`
+	Offset int     `json:"o,omitempty"`
+	Hot    float64 `json:"h,omitempty"`
+	ID     uint    `json:"i,omitempty"`
+}
+
+func (c cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := new(cursor)
+	if err := json.Unmarshal(b, c); err != nil || c.Page < 2 || c.Offset < 0 {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// parsePageRequest reads the page, cursor and limit parameters. The cursor
+// takes precedence over the page number.
+func parsePageRequest(r *http.Request) (pageRequest, error) {
+	req := pageRequest{Page: 1, Size: pageSize}
+	v := r.URL.Query()
+	if l := v.Get("limit"); l != "" {
+		size, err := strconv.Atoi(l)
+		if err != nil || size < 1 {
+			return req, ErrInvalidLimit
+		}
+		if size > maxPageSize {
+			size = maxPageSize
+		}
+		req.Size = size
+	}
+	if c := v.Get("cursor"); c != "" {
+		cur, err := parseCursor(c)
+		if err != nil {
+			return req, err
+		}
+		req.Page, req.Cursor = cur.Page, cur
+		return req, nil
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		return req, ErrInvalidPage
+	}
+	req.Page = page
+	return req, nil
+}
+
+func parsePage(r *http.Request) (int, error) {
+	pageStr := r.URL.Query().Get("page")
+	if pageStr == "" {
+		return 1, nil
+	}
+	page, err := strconv.Atoi(pageStr)
+	if err != nil {
+		return 0, err
+	}
+	if page < 1 {
+		page = 1
+	}
+	return page, nil
+}
+
+// offset is the number of results before the requested page.
+func (p pageRequest) offset() int {
+	if p.Cursor != nil {
+		return p.Cursor.Offset
+	}
+	return (p.Page - 1) * p.Size
+}
+
+// pagination describes the page served for p. next holds the position of the
+// last result served and is only used if there are more.
+func (p pageRequest) pagination(total int, hasMore bool, next cursor) Pagination {
+	pagination := Pagination{
+		Total:    total,
+		Page:     p.Page,
+		PageSize: p.Size,
+		HasMore:  hasMore,
+	}
+	if hasMore {
+		next.Page = p.Page + 1
+		next.Offset = p.offset() + p.Size
+		pagination.NextCursor = next.String()
+	}
+	return pagination
+}
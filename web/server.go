@@ -5,20 +5,22 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/OpenBazaar/wallet-interface"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcutil"
-	"github.com/cpacia/BitcoinCash-Wallet"
 	"github.com/cpacia/ipfsindex/app"
 	"github.com/cpacia/ipfsindex/db"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/op/go-logging"
 	"github.com/ipfs/go-cid"
+	"github.com/op/go-logging"
 	"html/template"
+	"math"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
@@ -28,9 +30,17 @@ import (
 
 var log = logging.MustGetLogger("web")
 
+var (
+	ErrFileNotFound     = errors.New("file not found")
+	ErrInvalidFuzziness = errors.New("invalid fuzziness")
+	ErrInvalidMinNet    = errors.New("invalid minimum net score")
+	ErrInvalidConfirmed = errors.New("invalid confirmed filter")
+	ErrInvalidWindow    = errors.New("invalid window")
+)
+
 type Server struct {
 	ctx            context.Context
-	wallet         *bitcoincash.SPVWallet
+	wallet         app.Wallet
 	router         *mux.Router
 	fileServer     http.Handler
 	etagFactory    *EtagFactory
@@ -38,7 +48,8 @@ type Server struct {
 	listener       *app.TransactionListener
 	db             *db.Database
 	siteData       *SiteData
-	addrChan       chan [2]string
+	statusChan     chan app.PaymentStatus
+	adminToken     string
 	disconnectChan chan string
 	openSockets    map[string]*websocket.Conn
 	socketLock     sync.RWMutex
@@ -53,26 +64,130 @@ type SiteData struct {
 
 type FormattedFile struct {
 	db.FileDescriptor
-	FormattedNet string
+	FormattedNet         string
+	FormattedWeightedNet string
+	Score                float64
+	Highlight            template.HTML
 }
 
 type SearchResult struct {
-	Files    []FormattedFile
-	More     bool
-	Page     int
-	Category string
-	Query    string
+	Files      []FormattedFile
+	More       bool
+	Page       int
+	Total      int
+	Category   string
+	Tag        string
+	Date       string
+	Query      string
+	Error      string
+	Categories []FacetLink
+	Tags       []FacetLink
+	Dates      []FacetLink
+	Modes      []FacetLink
+	Windows    []FacetLink
+
+	// The remaining search parameters, carried through the filter form.
+	Mode      db.SearchMode
+	Fuzziness int
+	Sorts     []SortOption
+	MinNet    string
+	Confirmed bool
+	From      string
+	To        string
+
+	// TagCloud links to the most used tags.
+	TagCloud []TagLink
+
+	// Suggestion corrects the spelling of a query with no results.
+	Suggestion    string
+	SuggestionURL string
+	// FuzzyURL repeats a search with no results tolerating typos.
+	FuzzyURL string
+}
+
+// FacetLink links to the search page drilled down into a facet, or back out
+// of it if the facet is already active.
+type FacetLink struct {
+	Name   string
+	Count  int
+	URL    string
+	Active bool
+}
+
+// TagLink links to the page of a tag in a tag cloud. Size is the font size
+// in percent, larger for more used tags.
+type TagLink struct {
+	Name  string
+	Count int
+	URL   string
+	Size  int
+}
+
+// tagCloudSize is the number of tags shown in tag clouds.
+const tagCloudSize = 50
+
+// trendingWindow restricts trending files to those published since a point
+// relative to now. Since is nil for all time.
+type trendingWindow struct {
+	Name  string
+	Label string
+	Since func(now time.Time) time.Time
+}
+
+var trendingWindows = []trendingWindow{
+	{"today", "Today", func(now time.Time) time.Time { return now.AddDate(0, 0, -1) }},
+	{"week", "This week", func(now time.Time) time.Time { return now.AddDate(0, 0, -7) }},
+	{"month", "This month", func(now time.Time) time.Time { return now.AddDate(0, -1, 0) }},
+	{"all", "All time", nil},
+}
+
+const defaultWindow = "all"
+
+type SortOption struct {
+	Value    db.SearchSort
+	Name     string
+	Selected bool
+}
+
+var sortOptions = []SortOption{
+	{Value: db.SortRelevance, Name: "Relevance"},
+	{Value: db.SortNet, Name: "Net score"},
+	{Value: db.SortWeighted, Name: "Weighted score"},
+	{Value: db.SortNewest, Name: "Newest"},
+	{Value: db.SortOldest, Name: "Oldest"},
+	{Value: db.SortComments, Name: "Most commented"},
+}
+
+// searchQuery is a search as given in the URL of the search page or API. Only
+// confirmed files are returned unless Confirmed is cleared.
+type searchQuery struct {
+	Query     string
+	Mode      db.SearchMode
+	Fuzziness int
+	Sort      db.SearchSort
+	Category  string
+	Tag       string
+	Date      string
+	From      string
+	To        string
+	MinNet    *int64
+	Confirmed bool
+	pageRequest
 }
 
 type Config struct {
-	Wallet   *bitcoincash.SPVWallet
+	Wallet   app.Wallet
 	Listener *app.TransactionListener
 	Db       *db.Database
 
 	Hostname string
 	Port     int
 
-	AddrChan chan [2]string
+	StatusChan chan app.PaymentStatus
+
+	// AdminToken enables the admin API. Requests to it must carry the token
+	// in a bearer authorization header.
+	AdminToken string
 }
 
 type NotFound struct {
@@ -107,17 +222,30 @@ func NewServer(conf Config) (*Server, error) {
 			Hostname:      conf.Hostname,
 			Port:          conf.Port,
 		},
-		addrChan:       conf.AddrChan,
+		statusChan:     conf.StatusChan,
+		adminToken:     conf.AdminToken,
 		disconnectChan: make(chan string),
 		openSockets:    make(map[string]*websocket.Conn),
 		socketLock:     sync.RWMutex{},
 	}
+	router.HandleFunc("/api/v1/search", s.apiSearch).Methods("GET")
+	router.HandleFunc("/api/v1/trending", s.apiTrending).Methods("GET")
+	router.HandleFunc("/api/v1/files/{txid}", s.apiFile).Methods("GET")
+	router.HandleFunc("/api/v1/files/{txid}/votes", s.apiVotes).Methods("GET")
+	router.HandleFunc("/api/v1/tags", s.apiTags).Methods("GET")
+	router.HandleFunc("/api/payment/{address}", s.apiPayment).Methods("GET")
+	router.HandleFunc("/api/suggest", s.apiSuggest).Methods("GET")
+	router.HandleFunc("/api/v1/admin/rescan", s.adminOnly(s.apiStartRescan)).Methods("POST")
+	router.HandleFunc("/api/v1/admin/rescan", s.adminOnly(s.apiRescanStatus)).Methods("GET")
 	router.PathPrefix("/static").Methods("GET").Handler(http.HandlerFunc(s.serveFiles))
 	router.PathPrefix("/file").Methods("GET").Handler(http.HandlerFunc(s.renderDetails))
 	router.HandleFunc("/addfile", s.submitAddFile).Methods("POST")
 	router.HandleFunc("/validatecid", s.submitValidateCid).Methods("POST")
 	router.HandleFunc("/vote", s.submitVote).Methods("POST")
+	router.HandleFunc("/editfile", s.submitEditFile).Methods("POST")
+	router.HandleFunc("/retractfile", s.submitRetractFile).Methods("POST")
 	router.HandleFunc("/trending", s.renderTrending).Methods("GET")
+	router.HandleFunc("/tag/{name}", s.renderTag).Methods("GET")
 	router.HandleFunc("/search", s.renderSearch).Methods("GET")
 	router.HandleFunc("/", s.renderIndex).Methods("GET")
 	router.HandleFunc("/ws", s.handleWebsocket)
@@ -127,6 +255,7 @@ func NewServer(conf Config) (*Server, error) {
 
 func (s *Server) Start() {
 	go s.wallet.Start()
+	go s.listener.Resume()
 	http.ListenAndServe(":"+strconv.Itoa(s.port), s.router)
 }
 
@@ -165,16 +294,10 @@ func (s *Server) renderIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) renderSearch(w http.ResponseWriter, r *http.Request) {
-	searchTerm := r.URL.Query().Get("query")
-	pageStr := r.URL.Query().Get("page")
-	page := 1
-	if pageStr != "" {
-		p, err := strconv.Atoi(pageStr)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		page = p
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 	templates, err := template.ParseFiles(path.Join("web", "templates", "search.html"), path.Join("web", "templates", "header.html"), path.Join("web", "templates", "footer.html"))
 	if err != nil {
@@ -182,43 +305,109 @@ func (s *Server) renderSearch(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	offset := 0
-	if page > 1 {
-		offset = (page-1) * 20
+	results, err := s.searchFiles(q)
+	resp := SearchResult{
+		Page:      q.Page,
+		Files:     formatHits(results.Files),
+		Query:     q.Query,
+		Category:  q.Category,
+		Tag:       q.Tag,
+		Date:      q.Date,
+		More:      results.Pagination.HasMore,
+		Total:     results.Pagination.Total,
+		Mode:      q.Mode,
+		Fuzziness: q.Fuzziness,
+		Confirmed: q.Confirmed,
+		From:      q.From,
+		To:        q.To,
 	}
-	responses, _ := s.db.Query(searchTerm, 20, offset)
-	var files []FormattedFile
-	for _, r := range responses {
-		fd := new(db.FileDescriptor)
-		s.db.Where("txid = ?", r).First(fd)
-		if fd.Txid != "" && fd.Description != "" {
-			if fd.Category == "" {
-				fd.Category = "N/A"
-			}
-			f := strconv.Itoa(int(fd.Net))
-			if fd.Net > 0 {
-				f = "+" + f
-			}
-			files = append(files, FormattedFile{*fd, f})
+	if q.MinNet != nil {
+		resp.MinNet = strconv.FormatInt(*q.MinNet, 10)
+	}
+	for _, o := range sortOptions {
+		o.Selected = o.Value == q.Sort || (q.Sort == "" && o.Value == db.SortRelevance)
+		resp.Sorts = append(resp.Sorts, o)
+	}
+	if qerr, ok := err.(*db.QueryError); ok {
+		resp.Error = qerr.Error()
+	} else if err != nil {
+		log.Error(err)
+	}
+	if resp.Total == 0 && resp.Error == "" {
+		if results.Suggestion != "" {
+			suggested := q
+			suggested.Query, suggested.Page = results.Suggestion, 0
+			resp.Suggestion, resp.SuggestionURL = results.Suggestion, suggested.url()
+		}
+		if q.Mode != db.FuzzyMode {
+			fuzzy := q
+			fuzzy.Mode, fuzzy.Page = db.FuzzyMode, 0
+			resp.FuzzyURL = fuzzy.url()
 		}
 	}
-	resp := SearchResult{Page: page, Files: files, Query: searchTerm}
+	for _, m := range []struct {
+		name string
+		mode db.SearchMode
+	}{{"Exact", db.ExactMode}, {"Typo tolerant", db.FuzzyMode}, {"Prefix", db.PrefixMode}} {
+		link := q
+		link.Mode, link.Fuzziness, link.Page = m.mode, 0, 0
+		active := m.mode == q.Mode || (q.Mode == "" && m.mode == db.ExactMode)
+		resp.Modes = append(resp.Modes, FacetLink{Name: m.name, URL: link.url(), Active: active})
+	}
+	for _, c := range results.Facets.Categories {
+		drill := q
+		drill.Category, drill.Page = c.Name, 0
+		active := c.Name == q.Category
+		if active {
+			drill.Category = ""
+		}
+		resp.Categories = append(resp.Categories, FacetLink{Name: c.Name, Count: c.Count, URL: drill.url(), Active: active})
+	}
+	for _, t := range results.Facets.Tags {
+		drill := q
+		drill.Tag, drill.Page = t.Name, 0
+		active := t.Name == db.NormalizeTag(q.Tag)
+		if active {
+			drill.Tag = ""
+		}
+		resp.Tags = append(resp.Tags, FacetLink{Name: t.Name, Count: t.Count, URL: drill.url(), Active: active})
+	}
+	for _, d := range results.Facets.Dates {
+		drill := q
+		drill.Date, drill.Page = d.Range, 0
+		active := d.Range == q.Date
+		if active {
+			drill.Date = ""
+		} else if d.Count == 0 {
+			continue
+		}
+		resp.Dates = append(resp.Dates, FacetLink{Name: d.Name, Count: d.Count, URL: drill.url(), Active: active})
+	}
 	templates.Lookup("header").ExecuteTemplate(w, "header", s.siteData)
 	templates.Lookup("search").ExecuteTemplate(w, "search", &resp)
 	templates.Lookup("footer").ExecuteTemplate(w, "footer", nil)
 }
 
 func (s *Server) renderTrending(w http.ResponseWriter, r *http.Request) {
+	s.renderTrendingPage(w, r, "")
+}
+
+// renderTag lists the files carrying a tag like the trending page does.
+func (s *Server) renderTag(w http.ResponseWriter, r *http.Request) {
+	s.renderTrendingPage(w, r, db.NormalizeTag(mux.Vars(r)["name"]))
+}
+
+func (s *Server) renderTrendingPage(w http.ResponseWriter, r *http.Request, tag string) {
 	category := r.URL.Query().Get("category")
-	pageStr := r.URL.Query().Get("page")
-	page := 1
-	if pageStr != "" {
-		p, err := strconv.Atoi(pageStr)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		page = p
+	req, err := parsePageRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	window, err := parseWindow(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 	templates, err := template.ParseFiles(path.Join("web", "templates", "trending.html"), path.Join("web", "templates", "header.html"), path.Join("web", "templates", "footer.html"))
 	if err != nil {
@@ -226,39 +415,358 @@ func (s *Server) renderTrending(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	var items []db.FileDescriptor
-	var count int
-	offset := 0
-	if page > 1 {
-		offset = (page-1) * 20
+	files, pagination, err := s.trendingFiles(category, tag, window, req)
+	if err != nil {
+		log.Error(err)
 	}
-	if category == "" {
-		s.db.Order("net desc").Find(&items).Limit(5).Count(&count).Offset(offset)
-	} else {
-		s.db.Where("category = ?", category).Order("net desc").Find(&items).Limit(5).Count(&count).Offset(offset)
+	resp := SearchResult{Files: formatFiles(files), More: pagination.HasMore, Page: pagination.Page, Category: category, Tag: tag, Total: pagination.Total}
+	base := "/trending"
+	if tag != "" {
+		base = tagURL(tag)
 	}
-	var files []FormattedFile
-	removed := 0
-	for _, item := range items {
-		if item.Txid != "" && item.Description != "" {
-			if item.Category == "" {
-				item.Category = "N/A"
-			}
-			f := strconv.Itoa(int(item.Net))
-			if item.Net > 0 {
-				f = "+" + f
-			}
-			files = append(files, FormattedFile{item, f})
-			continue
+	for _, tw := range trendingWindows {
+		v := url.Values{}
+		v.Set("window", tw.Name)
+		if category != "" {
+			v.Set("category", category)
 		}
-		removed++
+		resp.Windows = append(resp.Windows, FacetLink{Name: tw.Label, URL: base + "?" + v.Encode(), Active: tw.Name == window.Name})
+	}
+	counts, err := s.db.TagCloud(tagCloudSize)
+	if err != nil {
+		log.Error(err)
 	}
-	resp := SearchResult{files, (float64(count)-float64(removed))/20 > float64(page), page, category, ""}
+	resp.TagCloud = tagCloud(counts)
 	templates.Lookup("header").ExecuteTemplate(w, "header", s.siteData)
 	templates.Lookup("trending").ExecuteTemplate(w, "trending", &resp)
 	templates.Lookup("footer").ExecuteTemplate(w, "footer", nil)
 }
 
+// searchFiles runs a full text search and loads the matching file descriptors
+// along with the facets of all results. It backs both the search page and the
+// JSON API and returns an empty page of results on error.
+func (s *Server) searchFiles(q searchQuery) (*SearchResponse, error) {
+	resp := &SearchResponse{
+		Query:         q.Query,
+		Mode:          q.Mode,
+		Fuzziness:     q.Fuzziness,
+		Sort:          q.Sort,
+		Category:      q.Category,
+		Tag:           q.Tag,
+		Date:          q.Date,
+		From:          q.From,
+		To:            q.To,
+		MinNet:        q.MinNet,
+		ConfirmedOnly: q.Confirmed,
+		Files:         []SearchHit{},
+		Facets:        Facets{Categories: []db.FacetCount{}, Tags: []db.FacetCount{}, Dates: []db.DateFacet{}},
+		Pagination:    q.pagination(0, false, cursor{}),
+	}
+	results, err := s.db.Search(db.SearchOptions{
+		Query:         q.Query,
+		Mode:          q.Mode,
+		Fuzziness:     q.Fuzziness,
+		Sort:          q.Sort,
+		Category:      q.Category,
+		Tag:           q.Tag,
+		Date:          q.Date,
+		From:          q.From,
+		To:            q.To,
+		MinNet:        q.MinNet,
+		ConfirmedOnly: q.Confirmed,
+		Limit:         q.Size,
+		Offset:        q.offset(),
+	})
+	if err != nil {
+		return resp, err
+	}
+	ids := make([]string, 0, len(results.Hits))
+	for _, hit := range results.Hits {
+		ids = append(ids, hit.ID)
+	}
+	var fds []db.FileDescriptor
+	s.db.Where("txid in (?)", ids).Find(&fds)
+	byTxid := make(map[string]db.FileDescriptor)
+	for _, fd := range fds {
+		byTxid[fd.Txid] = fd
+	}
+	for _, hit := range results.Hits {
+		fd, ok := byTxid[hit.ID]
+		if ok && fd.Description != "" {
+			resp.Files = append(resp.Files, SearchHit{FileDescriptor: fd, Score: hit.Score, Highlight: hit.Highlight})
+		}
+	}
+	if results.Categories != nil {
+		resp.Facets.Categories = results.Categories
+	}
+	if results.Tags != nil {
+		resp.Facets.Tags = results.Tags
+	}
+	if results.Dates != nil {
+		resp.Facets.Dates = results.Dates
+	}
+	resp.Suggestion = results.Suggestion
+	hasMore := uint64(q.offset()+len(results.Hits)) < results.Total
+	resp.Pagination = q.pagination(int(results.Total), hasMore, cursor{})
+	return resp, nil
+}
+
+// trendingFiles returns the file descriptors published within window ordered
+// by hot score, optionally restricted to a single category or tag. It backs
+// the trending and tag pages and the JSON API.
+func (s *Server) trendingFiles(category, tag string, window trendingWindow, req pageRequest) ([]db.FileDescriptor, Pagination, error) {
+	query := s.db.Model(&db.FileDescriptor{}).Where("description != '' AND retracted = ?", false)
+	if category != "" {
+		query = query.Where("category = ?", category)
+	}
+	if tag != "" {
+		query = query.Where("txid IN (SELECT fd_txid FROM tags WHERE name = ? AND deleted_at IS NULL)", db.NormalizeTag(tag))
+	}
+	if window.Since != nil {
+		query = query.Where("timestamp >= ?", window.Since(time.Now()))
+	}
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, Pagination{Page: req.Page}, err
+	}
+
+	// Rows are ordered by id as well as hot score so that the cursor is
+	// unambiguous. One row more than needed tells whether there are more.
+	query = query.Order("hot desc, id desc").Limit(req.Size + 1)
+	if c := req.Cursor; c != nil {
+		query = query.Where("hot < ? OR (hot = ? AND id < ?)", c.Hot, c.Hot, c.ID)
+	} else {
+		query = query.Offset(req.offset())
+	}
+	var files []db.FileDescriptor
+	if err := query.Find(&files).Error; err != nil {
+		return nil, Pagination{Page: req.Page}, err
+	}
+	hasMore := len(files) > req.Size
+	var next cursor
+	if hasMore {
+		files = files[:req.Size]
+		last := files[len(files)-1]
+		next.Hot, next.ID = last.Hot, last.ID
+	}
+	return files, req.pagination(total, hasMore, next), nil
+}
+
+// votesPage returns a page of the votes cast on a file descriptor in the
+// order they were received.
+func (s *Server) votesPage(txid string, req pageRequest) ([]db.Vote, Pagination, error) {
+	query := s.db.Model(&db.Vote{}).Where("fd_txid = ?", txid)
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, Pagination{Page: req.Page}, err
+	}
+	query = query.Order("id asc").Limit(req.Size + 1)
+	if req.Cursor != nil {
+		query = query.Where("id > ?", req.Cursor.ID)
+	} else {
+		query = query.Offset(req.offset())
+	}
+	votes := []db.Vote{}
+	if err := query.Find(&votes).Error; err != nil {
+		return nil, Pagination{Page: req.Page}, err
+	}
+	hasMore := len(votes) > req.Size
+	var next cursor
+	if hasMore {
+		votes = votes[:req.Size]
+		next.ID = votes[len(votes)-1].ID
+	}
+	return votes, req.pagination(total, hasMore, next), nil
+}
+
+// fileDetails loads a file descriptor and all of the votes cast on it.
+func (s *Server) fileDetails(txid string) (*db.FileDescriptor, []db.Vote, error) {
+	fd := new(db.FileDescriptor)
+	if s.db.Where("txid = ?", txid).First(fd).RecordNotFound() {
+		return nil, nil, ErrFileNotFound
+	}
+	votes := []db.Vote{}
+	s.db.Where("fd_txid = ?", txid).Find(&votes)
+	return fd, votes, nil
+}
+
+func (s *Server) confirmations(height uint32) uint32 {
+	if height == 0 {
+		return 0
+	}
+	tip, _ := s.wallet.ChainTip()
+	return (tip - height) + 1
+}
+
+func formatFiles(items []db.FileDescriptor) []FormattedFile {
+	var files []FormattedFile
+	for _, item := range items {
+		if item.Category == "" {
+			item.Category = "N/A"
+		}
+		files = append(files, FormattedFile{
+			FileDescriptor:       item,
+			FormattedNet:         formatNet(item.Net),
+			FormattedWeightedNet: formatNet(item.WeightedNet),
+		})
+	}
+	return files
+}
+
+// formatNet formats a net score with its sign.
+func formatNet(net int64) string {
+	f := strconv.FormatInt(net, 10)
+	if net > 0 {
+		f = "+" + f
+	}
+	return f
+}
+
+// formatSize formats a number of bytes in the largest unit it is at least one
+// of, or returns an empty string if the size is unknown.
+func formatSize(size int64) string {
+	if size <= 0 {
+		return ""
+	}
+	units := []string{"KB", "MB", "GB", "TB"}
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, unit := float64(size)/1024, units[0]
+	for _, u := range units[1:] {
+		if value < 1024 {
+			break
+		}
+		value, unit = value/1024, u
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
+// tagCloud links to the pages of the given tags, sizing each by how much it
+// is used relative to the most used tag.
+func tagCloud(counts []db.TagCount) []TagLink {
+	max := 0
+	for _, c := range counts {
+		if c.Count > max {
+			max = c.Count
+		}
+	}
+	var links []TagLink
+	for _, c := range counts {
+		links = append(links, TagLink{Name: c.Name, Count: c.Count, URL: tagURL(c.Name), Size: 80 + 120*c.Count/max})
+	}
+	return links
+}
+
+// tagURL returns the page listing the files carrying tag.
+func tagURL(tag string) string {
+	return "/tag/" + url.PathEscape(tag)
+}
+
+func formatHits(hits []SearchHit) []FormattedFile {
+	var files []FormattedFile
+	for _, hit := range hits {
+		f := formatFiles([]db.FileDescriptor{hit.FileDescriptor})[0]
+		f.Score = hit.Score
+		// The highlighter escapes the description itself.
+		f.Highlight = template.HTML(hit.Highlight)
+		files = append(files, f)
+	}
+	return files
+}
+
+// parseWindow returns the trending window named in the request.
+func parseWindow(r *http.Request) (trendingWindow, error) {
+	name := r.URL.Query().Get("window")
+	if name == "" {
+		name = defaultWindow
+	}
+	for _, tw := range trendingWindows {
+		if tw.Name == name {
+			return tw, nil
+		}
+	}
+	return trendingWindow{}, ErrInvalidWindow
+}
+
+func parseSearchQuery(r *http.Request) (searchQuery, error) {
+	req, err := parsePageRequest(r)
+	if err != nil {
+		return searchQuery{}, err
+	}
+	v := r.URL.Query()
+	q := searchQuery{
+		Query:       v.Get("query"),
+		Mode:        db.SearchMode(v.Get("mode")),
+		Sort:        db.SearchSort(v.Get("sort")),
+		Category:    v.Get("category"),
+		Tag:         v.Get("tag"),
+		Date:        v.Get("date"),
+		From:        v.Get("from"),
+		To:          v.Get("to"),
+		Confirmed:   true,
+		pageRequest: req,
+	}
+	if f := v.Get("fuzziness"); f != "" {
+		if q.Fuzziness, err = strconv.Atoi(f); err != nil {
+			return searchQuery{}, ErrInvalidFuzziness
+		}
+	}
+	if m := v.Get("minnet"); m != "" {
+		minNet, err := strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			return searchQuery{}, ErrInvalidMinNet
+		}
+		q.MinNet = &minNet
+	}
+	if c := v.Get("confirmed"); c != "" {
+		if q.Confirmed, err = strconv.ParseBool(c); err != nil {
+			return searchQuery{}, ErrInvalidConfirmed
+		}
+	}
+	return q, nil
+}
+
+// url returns the search page for q.
+func (q searchQuery) url() string {
+	v := url.Values{}
+	v.Set("query", q.Query)
+	if q.Mode != "" {
+		v.Set("mode", string(q.Mode))
+	}
+	if q.Fuzziness != 0 {
+		v.Set("fuzziness", strconv.Itoa(q.Fuzziness))
+	}
+	if q.Sort != "" && q.Sort != db.SortRelevance {
+		v.Set("sort", string(q.Sort))
+	}
+	if q.Category != "" {
+		v.Set("category", q.Category)
+	}
+	if q.Tag != "" {
+		v.Set("tag", q.Tag)
+	}
+	if q.Date != "" {
+		v.Set("date", q.Date)
+	}
+	if q.From != "" {
+		v.Set("from", q.From)
+	}
+	if q.To != "" {
+		v.Set("to", q.To)
+	}
+	if q.MinNet != nil {
+		v.Set("minnet", strconv.FormatInt(*q.MinNet, 10))
+	}
+	if !q.Confirmed {
+		v.Set("confirmed", "false")
+	}
+	if q.Page > 1 {
+		v.Set("page", strconv.Itoa(q.Page))
+	}
+	return "/search?" + v.Encode()
+}
+
 func (s *Server) renderDetails(w http.ResponseWriter, r *http.Request) {
 	templates, err := template.ParseFiles(path.Join("web", "templates", "details.html"), path.Join("web", "templates", "notfound.html"), path.Join("web", "templates", "header.html"), path.Join("web", "templates", "footer.html"))
 	if err != nil {
@@ -275,8 +783,8 @@ func (s *Server) renderDetails(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	txid := pth[2]
-	fd := new(db.FileDescriptor)
-	if s.db.Where("txid = ?", txid).First(fd).RecordNotFound() {
+	fd, comments, err := s.fileDetails(txid)
+	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		templates.Lookup("header").ExecuteTemplate(w, "header", s.siteData)
 		templates.Lookup("notfound").ExecuteTemplate(w, "notfound", &NotFound{"Txid not found"})
@@ -289,27 +797,43 @@ func (s *Server) renderDetails(w http.ResponseWriter, r *http.Request) {
 		Timestamp string
 		Upvote    bool
 	}
+	type Revision struct {
+		Action      string
+		Description string
+		Category    string
+		Txid        string
+		Timestamp   string
+	}
 	type Details struct {
-		Description   string
-		Cid           string
-		Timestamp     string
-		Txid          string
-		Category      string
-		Upvotes       int64
-		Downvotes     int64
-		Confirmations uint32
-		Comments      []Comment
-	}
-	confirms := uint32(0)
-	height, _ := s.wallet.ChainTip()
-	if fd.Height > 0 {
-		confirms = (height - fd.Height) + 1
+		Description       string
+		Cid               string
+		Timestamp         string
+		Txid              string
+		Category          string
+		Size              string
+		MimeType          string
+		Filename          string
+		Language          string
+		License           string
+		Publisher         string
+		Tags              []TagLink
+		Upvotes           int64
+		Downvotes         int64
+		Upvoters          int64
+		Downvoters        int64
+		WeightedUpvotes   int64
+		WeightedDownvotes int64
+		WeightedNet       string
+		WeightedVotes     bool
+		Confirmations     uint32
+		Comments          []Comment
+		Retracted         bool
+		Revisions         []Revision
 	}
+	confirms := s.confirmations(fd.Height)
 	if fd.Category == "" {
 		fd.Category = "N/A"
 	}
-	comments := []db.Vote{}
-	s.db.Where("fd_txid = ?", txid).Find(&comments)
 
 	var formattedComments []Comment
 	for _, c := range comments {
@@ -325,16 +849,58 @@ func (s *Server) renderDetails(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	revisions, err := s.db.Revisions(txid)
+	if err != nil {
+		log.Error(err)
+	}
+	tags, err := s.db.Tags(txid)
+	if err != nil {
+		log.Error(err)
+	}
+	var tagLinks []TagLink
+	for _, t := range tags {
+		tagLinks = append(tagLinks, TagLink{Name: t, URL: tagURL(t)})
+	}
+	var formattedRevisions []Revision
+	for _, r := range revisions {
+		ts := r.Timestamp.Format("Mon Jan 2 15:04:05 MST 2006")
+		if r.Height <= 0 {
+			ts = "unconfirmed"
+		}
+		formattedRevisions = append(formattedRevisions, Revision{
+			Action:      strings.Title(r.Action),
+			Description: r.Description,
+			Category:    r.Category,
+			Txid:        r.Txid,
+			Timestamp:   ts,
+		})
+	}
+
 	det := Details{
-		Description:   fd.Description,
-		Cid:           fd.Cid,
-		Timestamp:     fd.Timestamp.Format("Mon Jan 2 15:04:05 MST 2006"),
-		Txid:          fd.Txid,
-		Category:      fd.Category,
-		Upvotes:       fd.Upvotes,
-		Downvotes:     fd.Downvotes,
-		Confirmations: confirms,
-		Comments:      formattedComments,
+		Description:       fd.Description,
+		Cid:               fd.Cid,
+		Timestamp:         fd.Timestamp.Format("Mon Jan 2 15:04:05 MST 2006"),
+		Txid:              fd.Txid,
+		Category:          fd.Category,
+		Size:              formatSize(fd.Size),
+		MimeType:          fd.MimeType,
+		Filename:          fd.Filename,
+		Language:          fd.Language,
+		License:           fd.License,
+		Publisher:         fd.Publisher,
+		Tags:              tagLinks,
+		Upvotes:           fd.Upvotes,
+		Downvotes:         fd.Downvotes,
+		Upvoters:          fd.Upvoters,
+		Downvoters:        fd.Downvoters,
+		WeightedUpvotes:   fd.WeightedUpvotes,
+		WeightedDownvotes: fd.WeightedDownvotes,
+		WeightedNet:       formatNet(fd.WeightedNet),
+		WeightedVotes:     s.db.WeightedVotes,
+		Confirmations:     confirms,
+		Comments:          formattedComments,
+		Retracted:         fd.Retracted,
+		Revisions:         formattedRevisions,
 	}
 	templates.Lookup("header").ExecuteTemplate(w, "header", s.siteData)
 	templates.Lookup("details").ExecuteTemplate(w, "details", &det)
@@ -343,13 +909,19 @@ func (s *Server) renderDetails(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) submitAddFile(w http.ResponseWriter, r *http.Request) {
 	type AddFile struct {
-		Cid         string `json:"cid"`
-		Description string `json:"description"`
-		Category    string `json:"category"`
+		Cid         string   `json:"cid"`
+		Description string   `json:"description"`
+		Category    string   `json:"category"`
+		Size        uint64   `json:"size"`
+		MimeType    string   `json:"mimeType"`
+		Filename    string   `json:"filename"`
+		Language    string   `json:"language"`
+		License     string   `json:"license"`
+		Tags        []string `json:"tags"`
 	}
 	af := new(AddFile)
 	err := json.NewDecoder(r.Body).Decode(af)
-	if err != nil {
+	if err != nil || af.Size > math.MaxInt64 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -360,28 +932,17 @@ func (s *Server) submitAddFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	amount, err := app.MinimumInputSize(s.wallet)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	addr := s.wallet.CurrentAddress(wallet.EXTERNAL)
-	b := make([]byte, 20)
-	rand.Read(b)
-	entry := app.UserEntry{
-		ID:          hex.EncodeToString(b),
-		Script:      &app.AddFileScript{*id, af.Description, af.Category},
-		Timestamp:   time.Now(),
-		Address:     addr,
-		AmountToPay: amount,
-	}
-	if _, err := entry.Script.Serialize(); err == app.ErrInvalidLength {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	s.listener.NewEntry(addr, entry)
-	fmt.Fprintf(w, `{"paymentAddress": "%s", "amountToPay": %f}`, addr.String(), btcutil.Amount(amount).ToBTC())
+	s.submitScript(w, &app.AddFileScript{
+		Cid:         *id,
+		Description: af.Description,
+		Category:    af.Category,
+		Size:        af.Size,
+		MimeType:    af.MimeType,
+		Filename:    af.Filename,
+		Language:    af.Language,
+		License:     af.License,
+		Tags:        af.Tags,
+	}, 0)
 }
 
 func (s *Server) submitVote(w http.ResponseWriter, r *http.Request) {
@@ -389,11 +950,17 @@ func (s *Server) submitVote(w http.ResponseWriter, r *http.Request) {
 		Txid        string `json:"txid"`
 		Upvote      bool   `json:"upvote"`
 		Description string `json:"comment"`
+		Burn        int64  `json:"burn"`
 	}
 	v := new(Vote)
 	err := json.NewDecoder(r.Body).Decode(v)
-	if err != nil {
+	if err != nil || v.Burn < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if v.Burn > 0 && !s.db.WeightedVotes {
 		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Votes are not weighted")
 		return
 	}
 	fd := &db.FileDescriptor{}
@@ -413,6 +980,76 @@ func (s *Server) submitVote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.submitScript(w, &app.VoteScript{Txid: *txid, Comment: v.Description, Upvote: v.Upvote}, uint64(v.Burn))
+}
+
+// revisedFile loads the file a revision submitted by its publisher changes.
+// It writes an error and returns nil if the file can't be revised.
+func (s *Server) revisedFile(w http.ResponseWriter, txid string) *chainhash.Hash {
+	fd := &db.FileDescriptor{}
+	if s.db.Where("txid = ?", txid).First(fd).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "File not found in database")
+		return nil
+	}
+	if fd.Retracted || fd.Publisher == "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "File can't be changed")
+		return nil
+	}
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	return hash
+}
+
+// submitEditFile asks the publisher of a file to pay for an edit of it. The
+// payment must be sent from the publisher's address or it is refunded.
+func (s *Server) submitEditFile(w http.ResponseWriter, r *http.Request) {
+	type EditFile struct {
+		Txid        string `json:"txid"`
+		Description string `json:"description"`
+		Category    string `json:"category"`
+	}
+	ef := new(EditFile)
+	if err := json.NewDecoder(r.Body).Decode(ef); err != nil || (ef.Description == "" && ef.Category == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	txid := s.revisedFile(w, ef.Txid)
+	if txid == nil {
+		return
+	}
+	s.submitScript(w, &app.EditFileScript{Txid: *txid, Description: ef.Description, Category: ef.Category}, 0)
+}
+
+// submitRetractFile asks the publisher of a file to pay for retracting it.
+// The payment must be sent from the publisher's address or it is refunded.
+func (s *Server) submitRetractFile(w http.ResponseWriter, r *http.Request) {
+	type RetractFile struct {
+		Txid string `json:"txid"`
+	}
+	rf := new(RetractFile)
+	if err := json.NewDecoder(r.Body).Decode(rf); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	txid := s.revisedFile(w, rf.Txid)
+	if txid == nil {
+		return
+	}
+	s.submitScript(w, &app.RetractFileScript{Txid: *txid}, 0)
+}
+
+// submitScript creates a payment request for script to be broadcast, burning
+// burn satoshis, and responds with the address to pay and the amount due.
+func (s *Server) submitScript(w http.ResponseWriter, script app.Script, burn uint64) {
+	if _, err := script.Serialize(); err == app.ErrInvalidLength {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	amount, err := app.MinimumInputSize(s.wallet)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -424,17 +1061,19 @@ func (s *Server) submitVote(w http.ResponseWriter, r *http.Request) {
 	rand.Read(b)
 	entry := app.UserEntry{
 		ID:          hex.EncodeToString(b),
-		Script:      &app.VoteScript{*txid, v.Description, v.Upvote},
+		Script:      script,
 		Timestamp:   time.Now(),
 		Address:     addr,
-		AmountToPay: amount,
+		AmountToPay: amount + burn,
+		Burn:        burn,
 	}
-	if _, err := entry.Script.Serialize(); err == app.ErrInvalidLength {
-		w.WriteHeader(http.StatusBadRequest)
+	if err := s.listener.NewEntry(addr, entry); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	s.listener.NewEntry(addr, entry)
-	fmt.Fprintf(w, `{"paymentAddress": "%s", "amountToPay": %f}`, addr.String(), btcutil.Amount(amount).ToBTC())
+	// Satoshis need all eight decimal places.
+	fmt.Fprintf(w, `{"paymentAddress": "%s", "amountToPay": %.8f}`, addr.String(), btcutil.Amount(entry.AmountToPay).ToBTC())
 	//TODO: map websocket
 }
 
@@ -0,0 +1,762 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/OpenBazaar/wallet-interface"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/ipfsindex/app"
+	"github.com/cpacia/ipfsindex/app/apptest"
+	"github.com/cpacia/ipfsindex/db"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCid = "QmNp85zy9RLrQ5oQD4hPyS39ezrrXpcaa7R4Y9kxdWQLLQ"
+
+// The templates and static files are loaded relative to the repo root.
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+type testServer struct {
+	*Server
+	wallet *apptest.FakeWallet
+	dir    string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	dir, err := ioutil.TempDir("", "ipfsindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := apptest.NewFakeWallet()
+	statusChan := make(chan app.PaymentStatus, 100)
+	s, err := NewServer(Config{
+		Wallet:     w,
+		Listener:   app.NewTransactionListener(w, database, statusChan),
+		Db:         database,
+		StatusChan: statusChan,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{s, w, dir}
+}
+
+func (s *testServer) Close() {
+	s.db.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *testServer) addFile(txid, description string, net int64, height uint32) {
+	s.addFileAt(txid, description, net, height, time.Now())
+}
+
+func (s *testServer) addFileAt(txid, description string, net int64, height uint32, timestamp time.Time) {
+	fd := db.FileDescriptor{
+		Txid:        txid,
+		Cid:         testCid,
+		Description: description,
+		Category:    "Music",
+		Timestamp:   timestamp,
+		Net:         net,
+		Hot:         db.HotScore(net, timestamp),
+		Height:      height,
+	}
+	s.db.Save(&fd)
+	s.db.Index(txid, fd)
+}
+
+func (s *testServer) get(t *testing.T, url string, v interface{}) int {
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+	if v != nil {
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatalf("Error decoding response from %s: %s", url, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestServer_APISearch(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.addFile("aa", "hello world", 0, 100)
+	s.addFile("bb", "goodbye moon", 0, 100)
+
+	resp := new(SearchResponse)
+	if code := s.get(t, "/api/v1/search?query=hello", resp); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if len(resp.Files) != 1 || resp.Files[0].Txid != "aa" {
+		t.Errorf("Unexpected search results: %+v", resp.Files)
+	}
+	if resp.Pagination.Total != 1 || resp.Pagination.HasMore {
+		t.Errorf("Unexpected pagination: %+v", resp.Pagination)
+	}
+	if len(resp.Files) == 1 && (resp.Files[0].Score <= 0 || resp.Files[0].Highlight != "<mark>hello</mark> world") {
+		t.Errorf("Unexpected score or highlight: %+v", resp.Files[0])
+	}
+
+	resp = new(SearchResponse)
+	s.get(t, "/api/v1/search?query=nothing", resp)
+	if resp.Files == nil || len(resp.Files) != 0 {
+		t.Errorf("Expected empty file list, got %v", resp.Files)
+	}
+
+	if code := s.get(t, "/api/v1/search?query=hello&page=x", nil); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid page, got %d", code)
+	}
+}
+
+func TestServer_APISearchFacets(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.addFile("aa", "hello world", 0, 100)
+	s.addFile("bb", "hello moon", 0, 100)
+
+	resp := new(SearchResponse)
+	if code := s.get(t, "/api/v1/search?query=hello", resp); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if len(resp.Facets.Categories) != 1 || resp.Facets.Categories[0] != (db.FacetCount{Name: "Music", Count: 2}) {
+		t.Errorf("Unexpected category facets: %+v", resp.Facets.Categories)
+	}
+	if len(resp.Facets.Dates) == 0 || resp.Facets.Dates[0].Count != 2 {
+		t.Fatalf("Unexpected date facets: %+v", resp.Facets.Dates)
+	}
+
+	// Drilling down into a facet keeps the query.
+	params := url.Values{"query": {"hello"}, "date": {resp.Facets.Dates[0].Range}, "category": {"Music"}}
+	resp = new(SearchResponse)
+	s.get(t, "/api/v1/search?"+params.Encode(), resp)
+	if resp.Pagination.Total != 2 || resp.Category != "Music" {
+		t.Errorf("Unexpected drill down results: %+v", resp)
+	}
+	resp = new(SearchResponse)
+	s.get(t, "/api/v1/search?query=hello&category=music", resp)
+	if resp.Pagination.Total != 0 || len(resp.Facets.Categories) != 0 {
+		t.Errorf("Expected category filter to be exact, got %+v", resp)
+	}
+
+	if code := s.get(t, "/api/v1/search?query=hello&date=soon", nil); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid date, got %d", code)
+	}
+}
+
+func TestServer_APISearchModes(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.addFile("aa", "hello world", 0, 100)
+
+	resp := new(SearchResponse)
+	s.get(t, "/api/v1/search?query=helo", resp)
+	if len(resp.Files) != 0 || resp.Suggestion != "hello" {
+		t.Errorf("Expected no results and a suggestion, got %+v", resp)
+	}
+	resp = new(SearchResponse)
+	s.get(t, "/api/v1/search?query=helo&mode=fuzzy", resp)
+	if len(resp.Files) != 1 || resp.Mode != db.FuzzyMode {
+		t.Errorf("Unexpected fuzzy search results: %+v", resp)
+	}
+	resp = new(SearchResponse)
+	s.get(t, "/api/v1/search?query=wor&mode=prefix", resp)
+	if len(resp.Files) != 1 || resp.Files[0].Highlight != "hello <mark>world</mark>" {
+		t.Errorf("Unexpected prefix search results: %+v", resp)
+	}
+
+	for _, query := range []string{"mode=loose", "mode=fuzzy&fuzziness=3", "mode=fuzzy&fuzziness=x"} {
+		if code := s.get(t, "/api/v1/search?query=hello&"+query, nil); code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", query, code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/search?query=helo", nil))
+	if !strings.Contains(rec.Body.String(), `Did you mean <a href="/search?query=hello">hello</a>?`) {
+		t.Error("Search page does not suggest a correction")
+	}
+}
+
+func TestServer_APISearchSortAndFilter(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.addFile("aa", "hello one", 1, 100)
+	s.addFile("bb", "hello two", 5, 100)
+	s.addFile("cc", "hello three", 3, 0)
+
+	ids := func(resp *SearchResponse) string {
+		var ids []string
+		for _, f := range resp.Files {
+			ids = append(ids, f.Txid)
+		}
+		return strings.Join(ids, " ")
+	}
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{"sort=net", "bb aa"},
+		{"sort=net&confirmed=false", "bb cc aa"},
+		{"sort=net&confirmed=false&minnet=2", "bb cc"},
+	}
+	for _, test := range tests {
+		resp := new(SearchResponse)
+		if code := s.get(t, "/api/v1/search?query=hello&"+test.params, resp); code != http.StatusOK {
+			t.Errorf("Expected status 200 for %s, got %d", test.params, code)
+			continue
+		}
+		if ids(resp) != test.expected {
+			t.Errorf("Search with %s returned %q, expected %q", test.params, ids(resp), test.expected)
+		}
+	}
+
+	for _, params := range []string{"sort=random", "minnet=x", "confirmed=maybe", "from=yesterday"} {
+		if code := s.get(t, "/api/v1/search?query=hello&"+params, nil); code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", params, code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/search?query=hello&sort=net&minnet=2", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `<option value="net" selected>`) || !strings.Contains(body, `name="minnet" value="2"`) {
+		t.Error("Search page does not keep the sort and filters")
+	}
+	if !strings.Contains(body, `href="/search?category=Music&amp;minnet=2&amp;query=hello&amp;sort=net"`) {
+		t.Error("Facet links do not keep the sort and filters")
+	}
+}
+
+func TestServer_APITrending(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	now := time.Now()
+	s.addFileAt("old", "old favourite", 50, 100, now.AddDate(0, -2, 0))
+	s.addFileAt("week", "this week", 20, 100, now.AddDate(0, 0, -3))
+	s.addFileAt("new", "brand new", 2, 100, now.Add(-time.Hour))
+
+	tests := []struct {
+		window   string
+		expected string
+	}{
+		{"", "new week old"},
+		{"all", "new week old"},
+		{"month", "new week"},
+		{"week", "new week"},
+		{"today", "new"},
+	}
+	for _, test := range tests {
+		resp := new(FileList)
+		if code := s.get(t, "/api/v1/trending?window="+test.window, resp); code != http.StatusOK {
+			t.Errorf("Expected status 200 for window %q, got %d", test.window, code)
+			continue
+		}
+		var ids []string
+		for _, f := range resp.Files {
+			ids = append(ids, f.Txid)
+		}
+		if strings.Join(ids, " ") != test.expected {
+			t.Errorf("Window %q returned %v, expected %q", test.window, ids, test.expected)
+		}
+	}
+	if code := s.get(t, "/api/v1/trending?window=decade", nil); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid window, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/trending?window=week&category=Music", nil))
+	if !strings.Contains(rec.Body.String(), `class="nav-link active" href="/trending?category=Music&amp;window=week"`) {
+		t.Error("Trending page does not mark the selected window")
+	}
+}
+
+func TestServer_Pagination(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	now := time.Now()
+	for i := 0; i < 25; i++ {
+		// Pairs of files share a hot score so the cursor has to break ties.
+		s.addFileAt(fmt.Sprintf("%02d", i), fmt.Sprintf("hello %d", i), 1, 100, now.Add(-time.Duration(i/2)*time.Minute))
+	}
+	s.addFile("empty", "", 1, 100)
+	for i := 0; i < 12; i++ {
+		s.db.Save(&db.Vote{FDTxid: "00", Txid: fmt.Sprintf("v%02d", i), Upvote: true, Height: 101})
+	}
+
+	// walk follows the cursors from the first page and checks that they visit
+	// the same items as the page numbers.
+	walk := func(endpoint string, expected int, ids func(body []byte) []string) {
+		seen := make(map[string]bool)
+		var byCursor, byPage []string
+		next := ""
+		for page := 1; ; page++ {
+			var pg struct {
+				Pagination Pagination `json:"pagination"`
+			}
+			rec := httptest.NewRecorder()
+			s.router.ServeHTTP(rec, httptest.NewRequest("GET", endpoint+"&limit=10"+next, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected status 200 for %s, got %d", endpoint, rec.Code)
+			}
+			json.Unmarshal(rec.Body.Bytes(), &pg)
+			if pg.Pagination.Page != page || pg.Pagination.Total != expected || pg.Pagination.PageSize != 10 {
+				t.Fatalf("Unexpected pagination for %s: %+v", endpoint, pg.Pagination)
+			}
+			for _, id := range ids(rec.Body.Bytes()) {
+				if seen[id] {
+					t.Errorf("%s returned %s twice", endpoint, id)
+				}
+				seen[id] = true
+				byCursor = append(byCursor, id)
+			}
+
+			rec = httptest.NewRecorder()
+			s.router.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("%s&limit=10&page=%d", endpoint, page), nil))
+			byPage = append(byPage, ids(rec.Body.Bytes())...)
+
+			if !pg.Pagination.HasMore {
+				if pg.Pagination.NextCursor != "" {
+					t.Errorf("Unexpected cursor on the last page of %s", endpoint)
+				}
+				break
+			}
+			next = "&cursor=" + pg.Pagination.NextCursor
+		}
+		if len(byCursor) != expected || strings.Join(byCursor, " ") != strings.Join(byPage, " ") {
+			t.Errorf("%s by cursor returned %v, by page %v", endpoint, byCursor, byPage)
+		}
+	}
+	fileIDs := func(body []byte) []string {
+		var list struct {
+			Files []db.FileDescriptor `json:"files"`
+		}
+		json.Unmarshal(body, &list)
+		var ids []string
+		for _, f := range list.Files {
+			ids = append(ids, f.Txid)
+		}
+		return ids
+	}
+	walk("/api/v1/trending?window=all", 25, fileIDs)
+	walk("/api/v1/search?query=hello", 25, fileIDs)
+	walk("/api/v1/files/00/votes?", 12, func(body []byte) []string {
+		list := new(VoteList)
+		json.Unmarshal(body, list)
+		var ids []string
+		for _, v := range list.Votes {
+			ids = append(ids, v.Txid)
+		}
+		return ids
+	})
+
+	for _, params := range []string{"cursor=abc", "limit=0", "limit=x", "page=x"} {
+		if code := s.get(t, "/api/v1/trending?"+params, nil); code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", params, code)
+		}
+	}
+}
+
+func TestServer_APISuggest(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.addFile("aa", "hello world", 0, 100)
+	s.addFile("bb", "help wanted", 0, 100)
+
+	resp := new(SuggestResponse)
+	if code := s.get(t, "/api/suggest?q=say+hel", resp); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if strings.Join(resp.Suggestions, ",") != "say hello,say help" {
+		t.Errorf("Unexpected suggestions: %v", resp.Suggestions)
+	}
+	resp = new(SuggestResponse)
+	s.get(t, "/api/suggest?q=hel&limit=1", resp)
+	if len(resp.Suggestions) != 1 {
+		t.Errorf("Expected 1 suggestion, got %v", resp.Suggestions)
+	}
+	resp = new(SuggestResponse)
+	s.get(t, "/api/suggest?q=", resp)
+	if resp.Suggestions == nil || len(resp.Suggestions) != 0 {
+		t.Errorf("Expected empty suggestions, got %v", resp.Suggestions)
+	}
+	if code := s.get(t, "/api/suggest?q=hel&limit=0", nil); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid limit, got %d", code)
+	}
+}
+
+func TestServer_APIFile(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.addFile("aa", "hello world", 2, 100)
+	s.wallet.SetChainTip(105, chainhash.Hash{})
+
+	resp := new(FileResponse)
+	if code := s.get(t, "/api/v1/files/aa", resp); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if resp.File.Description != "hello world" || resp.File.Net != 2 {
+		t.Errorf("Unexpected file: %+v", resp.File)
+	}
+	if resp.Confirmations != 6 {
+		t.Errorf("Expected 6 confirmations, got %d", resp.Confirmations)
+	}
+
+	apiErr := make(map[string]*APIError)
+	if code := s.get(t, "/api/v1/files/cc", &apiErr); code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", code)
+	}
+	if apiErr["error"] == nil || apiErr["error"].Code != http.StatusNotFound {
+		t.Errorf("Unexpected error body: %v", apiErr)
+	}
+}
+
+func TestServer_Revisions(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.addFile("aa", "hello world", 0, 100)
+	s.addFile("bb", "hello mars", 0, 100)
+
+	s.db.SaveRevision(&db.Revision{FDTxid: "aa", Txid: "e1", Action: db.RevisionEdit, Category: "Video", Height: 101})
+	s.db.SaveRevision(&db.Revision{FDTxid: "bb", Txid: "r1", Action: db.RevisionRetract, Height: 101})
+	s.db.ApplyRevisions("aa")
+	s.db.ApplyRevisions("bb")
+
+	resp := new(FileResponse)
+	if code := s.get(t, "/api/v1/files/aa", resp); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if resp.File.Category != "Video" || len(resp.Revisions) != 2 || resp.Revisions[1].Action != db.RevisionEdit {
+		t.Errorf("Unexpected file %+v with revisions %+v", resp.File, resp.Revisions)
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/file/aa", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "Edit Log") || !strings.Contains(body, "Video") {
+		t.Error("Details page doesn't show the edit log")
+	}
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/file/bb", nil))
+	if !strings.Contains(rec.Body.String(), "retracted by its publisher") {
+		t.Error("Details page doesn't show the retraction")
+	}
+
+	list := new(FileList)
+	if code := s.get(t, "/api/v1/trending", list); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if len(list.Files) != 1 || list.Files[0].Txid != "aa" {
+		t.Errorf("Expected retracted file left out of trending, got %+v", list.Files)
+	}
+}
+
+func TestServer_AddFile(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	rec := httptest.NewRecorder()
+	body := `{"cid": "` + testCid + `", "description": "hello world", "category": "Music"}`
+	s.router.ServeHTTP(rec, httptest.NewRequest("POST", "/addfile", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	resp := struct {
+		PaymentAddress string  `json:"paymentAddress"`
+		AmountToPay    float64 `json:"amountToPay"`
+	}{}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.PaymentAddress != s.wallet.CurrentAddress(wallet.EXTERNAL).String() || resp.AmountToPay <= 0 {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+
+	status := new(app.PaymentStatus)
+	if code := s.get(t, "/api/payment/"+resp.PaymentAddress, status); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if status.State != app.PaymentPending {
+		t.Errorf("Expected state %s, got %s", app.PaymentPending, status.State)
+	}
+
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("POST", "/addfile", strings.NewReader(`{"cid": "invalid"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid cid, got %d", rec.Code)
+	}
+
+	if code := s.get(t, "/api/payment/unknown", nil); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown payment, got %d", code)
+	}
+}
+
+func TestServer_FileMetadata(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	fd := db.FileDescriptor{
+		Txid:      "aa",
+		Cid:       testCid,
+		Timestamp: time.Now(),
+		Height:    100,
+		Size:      1572864,
+		MimeType:  "video/mp4",
+		Filename:  "hello.mp4",
+		Language:  "en",
+		License:   "CC-BY-4.0",
+	}
+	s.db.Save(&fd)
+	s.db.Index(fd.Txid, fd)
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/file/aa", nil))
+	for _, expected := range []string{"1.5 MB", "video/mp4", "hello.mp4", "CC-BY-4.0"} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("Details page doesn't show %s", expected)
+		}
+	}
+
+	resp := new(FileResponse)
+	if code := s.get(t, "/api/v1/files/aa", resp); code != http.StatusOK || resp.File.Size != fd.Size || resp.File.Filename != fd.Filename {
+		t.Errorf("Unexpected file %+v", resp.File)
+	}
+
+	rec = httptest.NewRecorder()
+	body := `{"cid": "` + testCid + `", "description": "hello world", "size": 1572864, "mimeType": "video/mp4", "filename": "hello.mp4"}`
+	s.router.ServeHTTP(rec, httptest.NewRequest("POST", "/addfile", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	body = `{"cid": "` + testCid + `", "description": "hello world", "filename": "` + strings.Repeat("a", 200) + `"}`
+	s.router.ServeHTTP(rec, httptest.NewRequest("POST", "/addfile", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an oversized script, got %d", rec.Code)
+	}
+
+	for size, expected := range map[int64]string{0: "", 512: "512 B", 2048: "2.0 KB", 3 << 30: "3.0 GB"} {
+		if formatted := formatSize(size); formatted != expected {
+			t.Errorf("Expected %d formatted as %q, got %q", size, expected, formatted)
+		}
+	}
+}
+
+func TestServer_Tags(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.addFile("aa", "hello world", 2, 100)
+	s.addFile("bb", "hello moon", 1, 100)
+	s.addFile("cc", "hello mars", 0, 100)
+	for txid, tags := range map[string][]string{"aa": {"retro", "Sci Fi"}, "bb": {"retro"}} {
+		s.db.SaveTags(txid, tags)
+		fd := db.FileDescriptor{}
+		s.db.Where("txid = ?", txid).First(&fd)
+		s.db.Index(txid, fd)
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/tag/Retro", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "Files tagged retro") || !strings.Contains(body, "hello moon") || strings.Contains(body, "hello mars") {
+		t.Error("Tag page doesn't list the tagged files")
+	}
+	if !strings.Contains(body, `href="/tag/sci-fi"`) {
+		t.Error("Tag page doesn't show the tag cloud")
+	}
+
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/file/aa", nil))
+	if !strings.Contains(rec.Body.String(), `href="/tag/retro"`) {
+		t.Error("Details page doesn't link to the tags")
+	}
+
+	tags := new(TagList)
+	if code := s.get(t, "/api/v1/tags?limit=1", tags); code != http.StatusOK || len(tags.Tags) != 1 || tags.Tags[0] != (db.TagCount{Name: "retro", Count: 2}) {
+		t.Errorf("Unexpected tags %+v", tags.Tags)
+	}
+	list := new(FileList)
+	if code := s.get(t, "/api/v1/trending?tag=sci-fi", list); code != http.StatusOK || len(list.Files) != 1 || list.Files[0].Txid != "aa" || list.Tag != "sci-fi" {
+		t.Errorf("Unexpected trending files %+v", list)
+	}
+	file := new(FileResponse)
+	if code := s.get(t, "/api/v1/files/bb", file); code != http.StatusOK || len(file.Tags) != 1 || file.Tags[0] != "retro" {
+		t.Errorf("Unexpected file tags %v", file.Tags)
+	}
+
+	resp := new(SearchResponse)
+	if code := s.get(t, "/api/v1/search?query=hello&tag=retro", resp); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if resp.Pagination.Total != 2 || len(resp.Facets.Tags) != 2 || resp.Facets.Tags[0].Name != "retro" {
+		t.Errorf("Unexpected search %+v", resp)
+	}
+}
+
+func TestServer_WeightedVote(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	txid := chainhash.Hash{0x01}.String()
+	s.addFile(txid, "hello world", 0, 100)
+
+	vote := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"txid": "` + txid + `", "upvote": true, "comment": "nice", "burn": 5000}`
+		s.router.ServeHTTP(rec, httptest.NewRequest("POST", "/vote", strings.NewReader(body)))
+		return rec
+	}
+	if rec := vote(); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 burning without weighted votes, got %d", rec.Code)
+	}
+
+	s.db.WeightedVotes = true
+	rec := vote()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	req := new(db.PaymentRequest)
+	s.db.First(req)
+	min, err := app.MinimumInputSize(s.wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Burn != 5000 || req.AmountToPay != min+5000 {
+		t.Errorf("Expected the burn to be added to the amount to pay, got %+v", req)
+	}
+	resp := struct {
+		AmountToPay float64 `json:"amountToPay"`
+	}{}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if amount, _ := btcutil.NewAmount(resp.AmountToPay); uint64(amount) != min+5000 {
+		t.Errorf("Expected to be asked for %d satoshis, got %v", min+5000, resp.AmountToPay)
+	}
+
+	s.db.Model(&db.FileDescriptor{}).Where("txid = ?", txid).UpdateColumns(map[string]interface{}{"net": 1, "weighted_net": 5000})
+	list := new(FileList)
+	if code := s.get(t, "/api/v1/trending", list); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if len(list.Files) != 1 || list.Files[0].Net != 1 || list.Files[0].WeightedNet != 5000 {
+		t.Errorf("Expected both the net and weighted scores, got %+v", list.Files)
+	}
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/trending", nil))
+	if !strings.Contains(rec.Body.String(), "5000</td>") {
+		t.Error("Trending page doesn't show the weighted score")
+	}
+}
+
+func TestServer_EditAndRetract(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	txid := chainhash.Hash{0x01}.String()
+	s.addFile(txid, "hello world", 0, 100)
+
+	post := func(url, body string) int {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		return rec.Code
+	}
+	edit := `{"txid": "` + txid + `", "description": "goodbye world"}`
+	retract := `{"txid": "` + txid + `"}`
+	if code := post("/editfile", edit); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 without a publisher, got %d", code)
+	}
+
+	s.db.Model(&db.FileDescriptor{}).Where("txid = ?", txid).UpdateColumn("publisher", "publisher")
+	if code := post("/editfile", `{"txid": "`+txid+`"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an empty edit, got %d", code)
+	}
+	if code := post("/editfile", `{"txid": "`+chainhash.Hash{0x02}.String()+`", "category": "Books"}`); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown file, got %d", code)
+	}
+	if code := post("/editfile", edit); code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", code)
+	}
+	if code := post("/retractfile", retract); code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", code)
+	}
+	var reqs []db.PaymentRequest
+	s.db.Find(&reqs)
+	if len(reqs) != 2 {
+		t.Fatalf("Expected 2 payment requests, got %d", len(reqs))
+	}
+	commands := make(map[app.Command]bool)
+	for _, req := range reqs {
+		script, err := app.ParseScript(req.Script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands[script.Command()] = true
+	}
+	if !commands[app.EditFileCommand] || !commands[app.RetractFileCommand] {
+		t.Errorf("Expected an edit and a retraction to be requested, got %v", commands)
+	}
+
+	s.db.Model(&db.FileDescriptor{}).Where("txid = ?", txid).UpdateColumn("retracted", true)
+	if code := post("/retractfile", retract); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a retracted file, got %d", code)
+	}
+}
+
+func TestServer_RenderSearch(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.addFile("aa", "hello world", 0, 100)
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest("GET", "/search?query=hello", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "<mark>hello</mark> world") {
+		t.Error("Search page does not contain highlighted result")
+	}
+	if !strings.Contains(rec.Body.String(), `href="/search?category=Music&amp;query=hello"`) {
+		t.Error("Search page does not link to category facet")
+	}
+}
+
+func TestServer_AdminRescan(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	request := func(token string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/v1/admin/rescan", strings.NewReader(`{"fromHeight": 1}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		s.router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := request("secret"); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 with the admin API disabled, got %d", code)
+	}
+	s.adminToken = "secret"
+	if code := request(""); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a token, got %d", code)
+	}
+	if code := request("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 with the wrong token, got %d", code)
+	}
+	// The fake wallet can't rescan.
+	if code := request("secret"); code != http.StatusNotImplemented {
+		t.Errorf("Expected status 501, got %d", code)
+	}
+}
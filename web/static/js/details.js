@@ -1,4 +1,5 @@
 var qrv;
+var qre;
 var upvote = false;
 var success = false;
 
@@ -37,7 +38,7 @@ $(function(){
     $("#comment").on('change keyup paste', function() {
         var comment = $("#comment").val();
         var l = lengthInUtf8Bytes(comment);
-        $("#commentRemainingChars").text(177 - l + " characters remaining");
+        $("#commentRemainingChars").text(176 - l + " characters remaining");
         maybeEnableUploadButton();
     });
 
@@ -49,29 +50,12 @@ $(function(){
             data: JSON.stringify({
                 txid: txid,
                 comment: comment,
-                upvote: upvote
+                upvote: upvote,
+                burn: parseInt($("#burn").val(), 10) || 0
             }),
             success: function(data){
-                createQRCode(qrv, data.paymentAddress);
-                $("#votePaymentAmount").text("Send " + data.amountToPay + " BCH to the following address:");
-                $("#votePaymentAddress").text(data.paymentAddress);
-                $("#voteForm").hide();
-                $("#votePaymentForm").show();
-                $("#voteUploadButton").hide();
-                var url = 'ws://'+ hostname + ':' + port + '/ws';
-                var socket = new WebSocket(url);
-                socket.onopen = function(event) {
-                    socket.send(data.paymentAddress);
-                };
-                socket.onmessage = function(event) {
-                    $("#votePaymentForm").hide();
-                    $("#voteForm").hide();
-                    $("#votePaymentReceived").show();
-                    var audio = new Audio('/static/audio/coin-sound.mp3');
-                    audio.play();
-                    socket.close();
-                    success = true;
-                };
+                sessionStorage.setItem("pendingVote:" + txid, JSON.stringify(data));
+                showVotePayment(data);
             },
             error: function(result) {
                 if (result.status === 403){
@@ -83,10 +67,94 @@ $(function(){
             dataType: "json"
         });
     });
+
+    var pending = sessionStorage.getItem("pendingVote:" + txid);
+    if (pending != null) {
+        showVotePayment(JSON.parse(pending));
+        $('#voteModal').modal();
+    }
+
+    if ($("#editModal").length === 0) {
+        return;
+    }
+    qre = new QRCode(document.getElementById("editQrcode"), "");
+    $("#editButton").click(function( event ) {
+        clearEditModal();
+        $('#editModal').modal();
+    });
+
+    $("#editDescription, #editCategory").on('change keyup paste', function() {
+        updateEditRemainingChars();
+    });
+    $("#retract").change(function() {
+        $("#editDescription, #editCategory").prop('disabled', this.checked);
+        updateEditRemainingChars();
+    });
+
+    $("#editUploadButton").click(function() {
+        var url = "/editfile";
+        var data = {
+            txid: txid,
+            description: $("#editDescription").val(),
+            category: $("#editCategory").val()
+        };
+        if ($("#retract").is(':checked')) {
+            url = "/retractfile";
+            data = {txid: txid};
+        }
+        $.ajax({
+            type: "POST",
+            url: url,
+            data: JSON.stringify(data),
+            success: function(data){
+                sessionStorage.setItem("pendingEdit:" + txid, JSON.stringify(data));
+                showEditPayment(data);
+            },
+            error: function(result) {
+                if (result.status === 403){
+                    alert("This file can no longer be changed");
+                    return
+                }
+                alert("Oops we messed up. Try again later.");
+            },
+            dataType: "json"
+        });
+    });
+
+    var pendingEdit = sessionStorage.getItem("pendingEdit:" + txid);
+    if (pendingEdit != null) {
+        showEditPayment(JSON.parse(pendingEdit));
+        $('#editModal').modal();
+    }
 });
 
+function showVotePayment(data) {
+    createQRCode(qrv, data.paymentAddress);
+    $("#votePaymentAmount").text("Send " + data.amountToPay + " BCH to the following address:");
+    $("#votePaymentAddress").text(data.paymentAddress);
+    $("#voteForm").hide();
+    $("#votePaymentForm").show();
+    $("#voteUploadButton").hide();
+    watchPayment(data.paymentAddress, function(status) {
+        $("#votePaymentStatus").text(describePayment(status));
+        if (isFinalPayment(status.state)) {
+            sessionStorage.removeItem("pendingVote:" + txid);
+        }
+        if (status.state === "broadcast") {
+            $("#votePaymentForm").hide();
+            $("#voteForm").hide();
+            $("#votePaymentReceived").show();
+            var audio = new Audio('/static/audio/coin-sound.mp3');
+            audio.play();
+            success = true;
+        }
+    });
+}
+
 function clearVoteModal() {
-    $("#commentRemainingChars").text("177 characters remaining");
+    sessionStorage.removeItem("pendingVote:" + txid);
+    $("#votePaymentStatus").text("");
+    $("#commentRemainingChars").text("176 characters remaining");
     $("#comment").val("");
     $("#voteForm").show();
     $("#votePaymentForm").hide();
@@ -112,4 +180,55 @@ function maybeEnableUploadButton() {
     } else {
         $('#voteUploadButton').prop('disabled', true);
     }
-}
\ No newline at end of file
+}
+function updateEditRemainingChars() {
+    var retract = $("#retract").is(':checked');
+    var description = $("#editDescription").val();
+    var category = $("#editCategory").val();
+    var remaining = 179 - lengthInUtf8Bytes(description);
+    if (category !== "") {
+        remaining -= lengthInUtf8Bytes(category) + 2;
+    }
+    $("#editRemainingChars").text(remaining + " characters remaining");
+    var empty = description === "" && category === "";
+    $('#editUploadButton').prop('disabled', !retract && (empty || remaining < 0));
+}
+
+function showEditPayment(data) {
+    createQRCode(qre, data.paymentAddress);
+    $("#editPaymentAmount").text("Send " + data.amountToPay + " BCH from the publisher's address to the following address:");
+    $("#editPaymentAddress").text(data.paymentAddress);
+    $("#editForm").hide();
+    $("#editPaymentForm").show();
+    $("#editUploadButton").hide();
+    watchPayment(data.paymentAddress, function(status) {
+        $("#editPaymentStatus").text(describePayment(status));
+        if (isFinalPayment(status.state)) {
+            sessionStorage.removeItem("pendingEdit:" + txid);
+        }
+        if (status.state === "broadcast") {
+            $("#editPaymentForm").hide();
+            $("#editForm").hide();
+            $("#editPaymentReceived").show();
+            var audio = new Audio('/static/audio/coin-sound.mp3');
+            audio.play();
+            success = true;
+        }
+    });
+}
+
+function clearEditModal() {
+    sessionStorage.removeItem("pendingEdit:" + txid);
+    $("#editPaymentStatus").text("");
+    $("#editRemainingChars").text("179 characters remaining");
+    $("#editDescription, #editCategory").val("").prop('disabled', false);
+    $("#retract").prop('checked', false);
+    $("#editForm").show();
+    $("#editPaymentForm").hide();
+    $("#editUploadButton").show().prop('disabled', true);
+    $("#editPaymentReceived").hide();
+    qre.clear();
+    if (success) {
+        location.reload();
+    }
+}
@@ -14,6 +14,20 @@ $(function(){
         $('#aboutModal').modal();
     });
 
+    var suggestTimer;
+    $(".searchSuggest").on("input", function() {
+        var q = $(this).val();
+        clearTimeout(suggestTimer);
+        suggestTimer = setTimeout(function() {
+            $.getJSON("/api/suggest", {q: q}, function(data) {
+                var list = $("#searchSuggestions").empty();
+                $.each(data.suggestions, function(i, suggestion) {
+                    list.append($("<option>").attr("value", suggestion));
+                });
+            });
+        }, 150);
+    });
+
     $('.dropdown-toggle').dropdown();
     $('.dropdown-item').click(function(event){
         $('#dropdownMenuButton').html(event.target.name);
@@ -32,30 +46,17 @@ $(function(){
             data: JSON.stringify({
                 cid: $("#cidInput").val(),
                 description: desc,
-                category: selectedCategory
+                category: selectedCategory,
+                size: parseInt($("#sizeInput").val()) || 0,
+                mimeType: $("#mimeTypeInput").val(),
+                filename: $("#filenameInput").val(),
+                language: $("#languageInput").val(),
+                license: $("#licenseInput").val(),
+                tags: parseTags()
             }),
             success: function(data){
-                createQRCode(qrc, data.paymentAddress);
-                $("#paymentAmount").text("Send " + data.amountToPay + " BCH to the following address:");
-                $("#paymentAddress").text(data.paymentAddress);
-                $("#uploadForm").hide();
-                $("#paymentForm").show();
-                $("#uploadButton").hide();
-                var url = 'ws://'+ hostname + ':' + port + '/ws';
-                var socket = new WebSocket(url);
-                socket.onopen = function(event) {
-                    socket.send(data.paymentAddress);
-                };
-                socket.onmessage = function(event) {
-                    var response = JSON.parse(event.data);
-                    $("#paymentForm").hide();
-                    $("#uploadForm").hide();
-                    $("#paymentReceived").show();
-                    var audio = new Audio('/static/audio/coin-sound.mp3');
-                    audio.play();
-                    socket.close();
-                    success = response.txid;
-                };
+                sessionStorage.setItem("pendingUpload", JSON.stringify(data));
+                showUploadPayment(data);
             },
             error: function(result) {
                 alert("Oops we messed up. Try again later.");
@@ -95,29 +96,171 @@ $(function(){
     $("#description").on('change keyup paste', function() {
         updateRemaining();
     });
+
+    $(".metadata").on('change keyup paste', function() {
+        updateRemaining();
+    });
+
+    var pending = sessionStorage.getItem("pendingUpload");
+    if (pending != null) {
+        showUploadPayment(JSON.parse(pending));
+        $('#uploadModal').modal();
+    }
 });
 
+function showUploadPayment(data) {
+    createQRCode(qrc, data.paymentAddress);
+    $("#paymentAmount").text("Send " + data.amountToPay + " BCH to the following address:");
+    $("#paymentAddress").text(data.paymentAddress);
+    $("#uploadForm").hide();
+    $("#paymentForm").show();
+    $("#uploadButton").hide();
+    watchPayment(data.paymentAddress, function(status) {
+        $("#paymentStatus").text(describePayment(status));
+        if (isFinalPayment(status.state)) {
+            sessionStorage.removeItem("pendingUpload");
+        }
+        if (status.state === "broadcast") {
+            $("#paymentForm").hide();
+            $("#uploadForm").hide();
+            $("#paymentReceived").show();
+            var audio = new Audio('/static/audio/coin-sound.mp3');
+            audio.play();
+            success = status.txid;
+        }
+    });
+}
+
+// watchPayment reports every status change of the payment request for
+// address to onStatus. Updates are pushed over the websocket and, if the
+// socket closes before the request finishes, polled from the status endpoint.
+function watchPayment(address, onStatus) {
+    var done = false;
+    var poller = null;
+    function handle(status) {
+        if (done) {
+            return;
+        }
+        onStatus(status);
+        if (isFinalPayment(status.state)) {
+            done = true;
+            if (poller != null) {
+                clearInterval(poller);
+            }
+        }
+    }
+    function poll() {
+        if (done || poller != null) {
+            return;
+        }
+        poller = setInterval(function() {
+            $.getJSON("/api/payment/" + address, handle);
+        }, 5000);
+    }
+    var url = 'ws://'+ hostname + ':' + port + '/ws';
+    var socket = new WebSocket(url);
+    socket.onopen = function(event) {
+        socket.send(address);
+    };
+    socket.onmessage = function(event) {
+        handle(JSON.parse(event.data));
+        if (done) {
+            socket.close();
+        }
+    };
+    socket.onclose = poll;
+    socket.onerror = poll;
+}
+
+function isFinalPayment(state) {
+    return state === "broadcast" || state === "failed" || state === "expired";
+}
+
+function describePayment(status) {
+    switch (status.state) {
+        case "pending":
+            return "Waiting for payment";
+        case "partial":
+            return "Received " + toBCH(status.amountPaid) + " of " + toBCH(status.amountToPay) + " BCH";
+        case "broadcasting":
+            return "Payment received, broadcasting transaction";
+        case "broadcast":
+            return "Transaction broadcast: " + status.txid;
+        case "failed":
+            return "Transaction failed: " + status.error;
+        case "expired":
+            return "Payment request expired";
+    }
+    return "";
+}
+
+function toBCH(satoshis) {
+    return satoshis / 100000000;
+}
+
 function updateRemaining(){
     var desc = $("#description").val();
     var currentLenth = lengthInUtf8Bytes(desc);
-    var remaining = 212 - cidLength - currentLenth;
+    var remaining = 211 - cidLength - currentLenth;
     var selectedCategory = $('#dropdownMenuButton').html();
     if (!selectedCategory.includes("Category")) {
         remaining -= lengthInUtf8Bytes(selectedCategory) + 2;
     }
+    remaining -= metadataLength();
     $("#remainingChars").text(remaining + " characters remaining");
     maybeEnableUploadButton();
 }
 
+// metadataLength returns the number of script bytes taken by the optional
+// file metadata and tags. Each field is pushed with its type byte and a length
+// byte.
+function metadataLength() {
+    var length = 0;
+    $("#filenameInput, #mimeTypeInput, #languageInput, #licenseInput").each(function() {
+        var val = $(this).val();
+        if (val.length > 0) {
+            length += lengthInUtf8Bytes(val) + 2;
+        }
+    });
+    $.each(parseTags(), function(i, tag) {
+        length += lengthInUtf8Bytes(tag) + 2;
+    });
+    var size = parseInt($("#sizeInput").val()) || 0;
+    if (size > 0) {
+        var sizeBytes = 0;
+        while (size > 0) {
+            sizeBytes++;
+            size = Math.floor(size / 256);
+        }
+        length += sizeBytes + 2;
+    }
+    return length;
+}
+
+// parseTags splits the comma separated tags input, dropping empty tags.
+function parseTags() {
+    var tags = [];
+    $.each($("#tagsInput").val().split(","), function(i, tag) {
+        tag = tag.trim();
+        if (tag.length > 0) {
+            tags.push(tag);
+        }
+    });
+    return tags;
+}
+
 function lengthInUtf8Bytes(str) {
     var m = encodeURIComponent(str).match(/%[89ABab]/g);
     return str.length + (m ? m.length : 0);
 }
 
 function clearModal() {
-    $("#remainingChars").text("212 characters remaining");
+    sessionStorage.removeItem("pendingUpload");
+    $("#paymentStatus").text("");
+    $("#remainingChars").text("211 characters remaining");
     $("#description").val("");
     $("#cidInput").val("");
+    $(".metadata").val("");
     $("#uploadForm").show();
     $("#paymentForm").hide();
     $("#uploadButton").show();
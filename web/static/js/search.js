@@ -7,12 +7,19 @@ $(function(){
     }
     $('#nextPage').click(function(){
         if (more) {
-            window.location = "/search?query=" + query + "&page=" + (page + 1);
+            gotoPage(page + 1);
         }
     });
     $('#prevPage').click(function(){
         if (page-1 > 0) {
-            window.location = "/search?query=" + query + "&page=" + (page - 1);
+            gotoPage(page - 1);
         }
     });
-});
\ No newline at end of file
+});
+
+// gotoPage keeps the query and any facets the results were drilled down into.
+function gotoPage(n) {
+    var params = new URLSearchParams(window.location.search);
+    params.set("page", n);
+    window.location = "/search?" + params.toString();
+}
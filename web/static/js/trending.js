@@ -11,27 +11,27 @@ $(function(){
         $('#categoryMenuButton').html(selectedCategory);
     }
     $('#nextPage').click(function(){
-        var selectedCategory = $('#categoryMenuButton').html();
-        var catQuery = "";
-        if (!selectedCategory.includes("Category")) {
-            catQuery = "&category=" + selectedCategory;
-        }
         if (more) {
-            window.location = "/trending?page=" + (page + 1) + catQuery;
+            gotoTrending({page: page + 1});
         }
     });
     $('#prevPage').click(function(){
-        var selectedCategory = $('#categoryMenuButton').html();
-        var catQuery = "";
-        if (!selectedCategory.includes("Category")) {
-            catQuery = "&category=" + selectedCategory;
-        }
         if (page-1 > 0) {
-            window.location = "/trending?page=" + (page - 1) + catQuery;
+            gotoTrending({page: page - 1});
         }
     });
     $('.dropdown-toggle').dropdown();
     $('.categoryButton').click(function(event){
-        window.location = "/trending?category=" + event.target.name;
+        gotoTrending({category: event.target.name, page: 1});
+    });
+});
+
+// gotoTrending keeps the page, category and window while changing the given
+// parameters, so it works on tag pages as well as the trending page.
+function gotoTrending(changes) {
+    var params = new URLSearchParams(window.location.search);
+    $.each(changes, function(key, value) {
+        params.set(key, value);
     });
-});
\ No newline at end of file
+    window.location = window.location.pathname + "?" + params.toString();
+}
@@ -1,7 +1,6 @@
 package web
 
 import (
-	"fmt"
 	"github.com/gorilla/websocket"
 	"net/http"
 )
@@ -33,6 +32,12 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	s.socketLock.Unlock()
 
 	go waitForDisconnect(conn, string(addr), s.disconnectChan)
+
+	// Push the current status so a reconnecting client catches up on any
+	// transitions it missed.
+	if status, err := s.listener.PaymentStatus(string(addr)); err == nil {
+		s.statusChan <- *status
+	}
 }
 
 func (s *Server) ProcessSocketRequests() {
@@ -47,18 +52,20 @@ func (s *Server) ProcessSocketRequests() {
 				delete(s.openSockets, addr)
 				s.socketLock.Unlock()
 			}
-		case addr := <-s.addrChan:
+		case status := <-s.statusChan:
 			s.socketLock.RLock()
-			conn, ok := s.openSockets[addr[0]]
+			conn, ok := s.openSockets[status.Address]
 			s.socketLock.RUnlock()
 			if ok {
-				err := conn.WriteMessage(1, []byte(fmt.Sprintf(`{"paymentReceived": true, "txid": "%s"}`, addr[1])))
+				err := conn.WriteJSON(&status)
 				if err != nil {
 					log.Error(err)
 				}
-				s.socketLock.Lock()
-				delete(s.openSockets, addr[0])
-				s.socketLock.Unlock()
+				if status.State.Final() {
+					s.socketLock.Lock()
+					delete(s.openSockets, status.Address)
+					s.socketLock.Unlock()
+				}
 			}
 		case <-s.ctx.Done():
 			break